@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Admin configuration
+var (
+	// AdminUser и AdminPassword — учетные данные /admin (HTTP Basic).
+	// Пока пароль не задан, раздел администратора не подключается.
+	AdminUser     = "admin"
+	AdminPassword = ""
+)
+
+const (
+	// adminListLimit ограничивает длину списков на страницах администратора
+	adminListLimit = 500
+	// adminAuditLimit — сколько последних записей журнала показывать
+	adminAuditLimit = 200
+)
+
+// adminUserInfo — строка списка пользователей
+type adminUserInfo struct {
+	ID      string
+	Stats   StorageStats
+	ModTime time.Time
+}
+
+// adminPage — данные шаблона admin.html; View выбирает раздел
+type adminPage struct {
+	View       string
+	CSRFToken  string
+	ReturnTo   string
+	Stats      StorageStats
+	Users      []adminUserInfo
+	UserID     string
+	AlbumID    string
+	Albums     []AlbumInfo
+	Images     []ImageInfo
+	Query      string
+	Audit      []AuditEntry
+	Truncated  bool
+	Quarantine []ImageInfo
+	Reports    []Report
+	Blocklist  []BlockEntry
+	Webhooks   []Webhook
+	Deliveries []WebhookDelivery
+	Status     string // фильтр жалоб
+	// OpenReports — число жалоб, ожидающих решения, для меню
+	OpenReports int
+}
+
+// adminActionForm — кнопка действия над объектом в шаблоне admin.html
+type adminActionForm struct {
+	CSRFToken, ReturnTo               string
+	Action, UserID, AlbumID, Filename string
+	ReportID                          string
+	Label, Confirm                    string // Confirm — текст подтверждения, пусто если не нужно
+	Blockable                         bool   // показать флажок «добавить в блокировку»
+}
+
+// newAdminActionForm собирает кнопку действия; вызывается из шаблона как adminAction
+func newAdminActionForm(page adminPage, action, userID, albumID, filename, label, confirm string) adminActionForm {
+	return adminActionForm{
+		CSRFToken: page.CSRFToken,
+		ReturnTo:  page.ReturnTo,
+		Action:    action,
+		UserID:    userID,
+		AlbumID:   albumID,
+		Filename:  filename,
+		Label:     label,
+		Confirm:   confirm,
+		Blockable: takedownActions[action],
+	}
+}
+
+// newReportActionForm собирает кнопку решения по жалобе; в шаблоне — reportAction
+func newReportActionForm(page adminPage, action, reportID, label, confirm string) adminActionForm {
+	form := newAdminActionForm(page, action, "", "", "", label, confirm)
+	form.ReportID = reportID
+	return form
+}
+
+// reportStatuses — фильтры очереди жалоб для шаблона
+func reportStatuses() map[string]string {
+	return map[string]string{
+		ReportOpen:      "Открытые",
+		ReportHidden:    "Скрытые",
+		ReportDeleted:   "Удаленные",
+		ReportDismissed: "Отклоненные",
+		"all":           "Все",
+	}
+}
+
+// setupAdminRoutes подключает раздел администратора
+func setupAdminRoutes(handle func(route string, handler http.HandlerFunc)) {
+	admin := func(route string, handler http.HandlerFunc) {
+		handle(route, rateLimit(LimitAdmin, adminAuth(handler)))
+	}
+
+	admin("/admin/", adminIndexHandler)
+	admin("/admin/user", adminUserHandler)
+	admin("/admin/album", adminAlbumHandler)
+	admin("/admin/search", adminSearchHandler)
+	admin("/admin/quarantine", adminQuarantineHandler)
+	admin("/admin/quarantine/file", adminQuarantineFileHandler)
+	admin("/admin/reports", adminReportsHandler)
+	admin("/admin/blocklist", adminBlocklistHandler)
+	admin("/admin/webhooks", adminWebhooksHandler)
+	admin("/admin/audit", adminAuditHandler)
+	admin("/admin/action", adminActionHandler)
+}
+
+// adminAuth проверяет учетные данные администратора
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(AdminUser)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(AdminPassword)) == 1
+		if !ok || !userOK || !passwordOK {
+			if ok {
+				logger.WarnContext(r.Context(), "admin authentication failed", "user", user, "remote_ip", clientIP(r))
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="screenguru admin", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next(w, r)
+	}
+}
+
+// adminCSRFToken возвращает CSRF-токен форм администратора.
+// Basic-авторизацию браузер отправляет и с чужих сайтов, поэтому
+// действия дополнительно требуют токен, который знает только страница.
+func adminCSRFToken() string {
+	return SignData("csrf:admin:" + AdminUser)
+}
+
+// renderAdmin отображает раздел администратора
+func renderAdmin(w http.ResponseWriter, r *http.Request, page adminPage) {
+	page.CSRFToken = adminCSRFToken()
+	page.ReturnTo = r.URL.RequestURI()
+	page.OpenReports = countOpenReports()
+	if err := renderTemplate(w, "admin.html", page); err != nil {
+		logger.ErrorContext(r.Context(), "failed to render admin page", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// adminIndexHandler показывает сводку хранилища и список пользователей
+func adminIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	users, err := listUsers()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to list users", "error", err)
+	}
+
+	page := adminPage{View: "overview", Stats: stats.Snapshot(), Users: users}
+	if len(page.Users) > adminListLimit {
+		page.Users, page.Truncated = page.Users[:adminListLimit], true
+	}
+	renderAdmin(w, r, page)
+}
+
+// adminUserHandler показывает альбомы пользователя
+func adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID := strings.TrimSpace(r.URL.Query().Get("id"))
+	if !validStorageID(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	albums, err := getUserAlbums(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Error reading user", http.StatusInternalServerError)
+		return
+	}
+	userStats, _ := measureTree(userPath(userID), levelUser)
+
+	renderAdmin(w, r, adminPage{View: "user", UserID: userID, Albums: albums, Stats: userStats})
+}
+
+// adminAlbumHandler показывает изображения альбома
+func adminAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	userID, albumID := r.URL.Query().Get("user"), r.URL.Query().Get("album")
+	if !validStorageID(userID) || !validStorageID(albumID) {
+		http.Error(w, "Invalid user or album ID", http.StatusBadRequest)
+		return
+	}
+
+	images, err := getUserImages(r.Context(), userID, albumID)
+	if err != nil {
+		http.Error(w, "Error reading album", http.StatusInternalServerError)
+		return
+	}
+
+	renderAdmin(w, r, adminPage{View: "album", UserID: userID, AlbumID: albumID, Images: images})
+}
+
+// adminSearchHandler ищет изображения по ID (имени файла с расширением или без)
+func adminSearchHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("image"))
+	// Принимаем и ссылку на изображение целиком
+	if i := strings.LastIndex(query, "/"); i >= 0 {
+		query = query[i+1:]
+	}
+
+	page := adminPage{View: "search", Query: query}
+	if validStorageID(query) {
+		images, err := findImages(query)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "image search failed", "error", err)
+		}
+		page.Images = images
+	}
+	renderAdmin(w, r, page)
+}
+
+// adminQuarantineHandler показывает изображения в карантине
+func adminQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	images, err := getQuarantinedImages()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to list quarantine", "error", err)
+	}
+	renderAdmin(w, r, adminPage{View: "quarantine", Quarantine: images})
+}
+
+// adminQuarantineFileHandler отдает изображение из карантина для просмотра
+func adminQuarantineFileHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	userID, albumID, filename := q.Get("user"), q.Get("album"), q.Get("file")
+	if !validStorageID(userID) || !validStorageID(albumID) || !validStorageID(filename) {
+		http.NotFound(w, r)
+		return
+	}
+
+	filePath := quarantinePath(userID, albumID, filename)
+	if _, err := os.Stat(filePath); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	setImageHeaders(w, filename)
+	http.ServeFile(w, r, filePath)
+}
+
+// adminReportsHandler показывает очередь жалоб; по умолчанию только открытые
+func adminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	filter := status
+	switch status {
+	case "":
+		status, filter = ReportOpen, ReportOpen
+	case "all":
+		filter = ""
+	}
+
+	reports, err := listReports(filter)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to list reports", "error", err)
+	}
+	if len(reports) > adminListLimit {
+		reports = reports[:adminListLimit]
+	}
+	renderAdmin(w, r, adminPage{View: "reports", Reports: reports, Status: status})
+}
+
+// adminBlocklistHandler показывает список блокировки
+func adminBlocklistHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := blocklist.Entries(r.Context())
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to read blocklist", "error", err)
+	}
+	renderAdmin(w, r, adminPage{View: "blocklist", Blocklist: entries})
+}
+
+// adminWebhooksHandler показывает вебхуки и журнал доставок
+func adminWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := loadWebhooks()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to load webhooks", "error", err)
+	}
+	deliveries, err := readWebhookLog(webhookLogLimit)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to read webhook log", "error", err)
+	}
+	renderAdmin(w, r, adminPage{View: "webhooks", Webhooks: hooks, Deliveries: deliveries})
+}
+
+// adminAuditHandler показывает последние записи журнала аудита
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := readAuditLog(adminAuditLimit)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to read audit log", "error", err)
+	}
+	renderAdmin(w, r, adminPage{View: "audit", Audit: entries})
+}
+
+// adminActionHandler выполняет действие модерации и записывает его в журнал аудита
+func adminActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !VerifyData("csrf:admin:"+AdminUser, r.FormValue(CSRFFormField)) {
+		ErrorResponseCode(w, http.StatusForbidden, "csrf_token_invalid", "Invalid CSRF token")
+		return
+	}
+
+	action := r.FormValue("action")
+	if strings.HasPrefix(action, "report-") {
+		adminReportAction(w, r, action)
+		return
+	}
+	if strings.HasPrefix(action, "block-") {
+		adminBlocklistAction(w, r, action)
+		return
+	}
+	if strings.HasPrefix(action, "webhook-") {
+		adminWebhookAction(w, r, action)
+		return
+	}
+
+	userID, albumID, filename := r.FormValue("user"), r.FormValue("album"), r.FormValue("file")
+
+	// Проверяем только те поля, которые нужны действию
+	needed := map[string][]string{
+		"delete-image":       {userID, albumID, filename},
+		"quarantine-image":   {userID, albumID, filename},
+		"restore-image":      {userID, albumID, filename},
+		"delete-quarantined": {userID, albumID, filename},
+		"delete-album":       {userID, albumID},
+		"delete-user":        {userID},
+	}
+	ids, known := needed[action]
+	if !known {
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	for _, id := range ids {
+		if !validStorageID(id) {
+			http.Error(w, "Invalid target", http.StatusBadRequest)
+			return
+		}
+	}
+	target := strings.Join(ids, "/")
+
+	if !adminBlockTakedown(w, r, action, userID, albumID, filename, target) {
+		return
+	}
+
+	var err error
+	switch action {
+	case "delete-image":
+		err = deleteImage(r.Context(), userID, albumID, filename)
+	case "quarantine-image":
+		err = quarantineImage(r.Context(), userID, albumID, filename)
+	case "restore-image":
+		err = restoreImage(r.Context(), userID, albumID, filename)
+	case "delete-quarantined":
+		err = deleteQuarantined(userID, albumID, filename)
+	case "delete-album":
+		err = deleteAlbum(r.Context(), userID, albumID)
+	case "delete-user":
+		err = deleteUser(r.Context(), userID)
+	}
+
+	auditRequest(r, AdminUser, action, target, err)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Action failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, adminReturnURL(r.FormValue("return")), http.StatusSeeOther)
+}
+
+// adminReportAction выполняет решение по жалобе: закрыть, скрыть или удалить контент.
+// Скрытие и удаление закрывают и остальные открытые жалобы на тот же объект.
+func adminReportAction(w http.ResponseWriter, r *http.Request, action string) {
+	id := r.FormValue("report")
+	if !validReportID(id) {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+	report, err := loadReport(id)
+	if err != nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+
+	if action != "report-dismiss" {
+		takedown := "delete-image"
+		if report.Filename == "" {
+			takedown = "delete-album"
+		}
+		if !adminBlockTakedown(w, r, takedown, report.UserID, report.AlbumID, report.Filename, "report "+id+" "+report.Target()) {
+			return
+		}
+	}
+
+	switch action {
+	case "report-dismiss":
+		err = resolveReport(id, ReportDismissed, AdminUser)
+	case "report-hide":
+		if err = hideContent(r.Context(), report.UserID, report.AlbumID, report.Filename); err == nil {
+			err = resolveReports(report.UserID, report.AlbumID, report.Filename, ReportHidden, AdminUser)
+		}
+	case "report-delete":
+		if err = deleteContent(r.Context(), report.UserID, report.AlbumID, report.Filename); err == nil {
+			err = resolveReports(report.UserID, report.AlbumID, report.Filename, ReportDeleted, AdminUser)
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	auditRequest(r, AdminUser, action, "report "+id+" "+report.Target(), err)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Action failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, adminReturnURL(r.FormValue("return")), http.StatusSeeOther)
+}
+
+// takedownActions — действия, при которых хеши снятого контента можно добавить в блокировку
+var takedownActions = map[string]bool{
+	"delete-image":       true,
+	"quarantine-image":   true,
+	"delete-quarantined": true,
+	"delete-album":       true,
+	"delete-user":        true,
+	"report-hide":        true,
+	"report-delete":      true,
+}
+
+// adminBlockTakedown добавляет хеши снимаемого контента в список блокировки,
+// если в форме отмечен флажок block. Возвращает false, если ответ уже отправлен.
+func adminBlockTakedown(w http.ResponseWriter, r *http.Request, action, userID, albumID, filename, target string) bool {
+	if r.FormValue("block") != "1" {
+		return true
+	}
+
+	var paths []string
+	switch action {
+	case "delete-image", "quarantine-image":
+		paths = []string{imagePath(userID, albumID, filename)}
+	case "delete-quarantined":
+		paths = []string{quarantinePath(userID, albumID, filename)}
+	case "delete-album":
+		paths = albumImagePaths(r.Context(), userID, albumID)
+	case "delete-user":
+		albums, _ := getUserAlbums(r.Context(), userID)
+		for _, album := range albums {
+			paths = append(paths, albumImagePaths(r.Context(), userID, album.ID)...)
+		}
+	}
+
+	added, err := blockImageFiles(r.Context(), paths, "takedown "+target)
+	auditRequest(r, AdminUser, "block-add", fmt.Sprintf("%s (%d hashes)", target, added), err)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Blocking failed: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// albumImagePaths возвращает пути изображений альбома
+func albumImagePaths(ctx context.Context, userID, albumID string) []string {
+	images, _ := getUserImages(ctx, userID, albumID)
+	paths := make([]string, 0, len(images))
+	for _, image := range images {
+		paths = append(paths, image.Path)
+	}
+	return paths
+}
+
+// adminBlocklistAction добавляет или удаляет хеш списка блокировки вручную
+func adminBlocklistAction(w http.ResponseWriter, r *http.Request, action string) {
+	entry, err := parseBlockHash(r.FormValue("hash"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry.Note = strings.TrimSpace(r.FormValue("note"))
+
+	switch action {
+	case "block-add":
+		_, err = blocklist.Add(r.Context(), entry)
+	case "block-remove":
+		_, err = blocklist.Remove(r.Context(), entry.Hash)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	auditRequest(r, AdminUser, action, entry.Kind+":"+entry.Hash, err)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Action failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, adminReturnURL(r.FormValue("return")), http.StatusSeeOther)
+}
+
+// adminWebhookAction регистрирует вебхук администратора или удаляет любой вебхук
+func adminWebhookAction(w http.ResponseWriter, r *http.Request, action string) {
+	var (
+		target string
+		err    error
+	)
+	switch action {
+	case "webhook-add":
+		var hookURL string
+		var events []string
+		if hookURL, err = parseWebhookURL(r.FormValue("url")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if events, err = parseWebhookEvents([]string{r.FormValue("events")}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var hook Webhook
+		hook, err = addWebhook(Webhook{URL: hookURL, Events: events})
+		target = hook.ID + " " + hookURL
+	case "webhook-remove":
+		id := r.FormValue("id")
+		target = id
+		var removed bool
+		removed, err = removeWebhooks(func(hook Webhook) bool { return hook.ID == id })
+		if err == nil && !removed {
+			err = fmt.Errorf("webhook not found")
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	auditRequest(r, AdminUser, action, target, err)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Action failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, adminReturnURL(r.FormValue("return")), http.StatusSeeOther)
+}
+
+// adminReturnURL разрешает возврат только на страницы администратора
+func adminReturnURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/admin/") || strings.HasPrefix(u.Path, "/admin/action") {
+		return "/admin/"
+	}
+	return u.RequestURI()
+}
+
+// listUsers возвращает пользователей с объемом их данных, крупные сверху
+func listUsers() ([]adminUserInfo, error) {
+	entries, err := os.ReadDir(DataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []adminUserInfo
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		user := adminUserInfo{ID: entry.Name()}
+		user.Stats, _ = measureTree(userPath(user.ID), levelUser)
+		if info, err := entry.Info(); err == nil {
+			user.ModTime = info.ModTime()
+		}
+		users = append(users, user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Stats.Bytes == users[j].Stats.Bytes {
+			return users[i].ID < users[j].ID
+		}
+		return users[i].Stats.Bytes > users[j].Stats.Bytes
+	})
+	return users, nil
+}
+
+// findImages ищет изображения с данным ID во всех альбомах
+func findImages(imageID string) ([]ImageInfo, error) {
+	var images []ImageInfo
+
+	err := filepath.WalkDir(DataPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := entry.Name()
+		if path != DataPath && strings.HasPrefix(name, ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		level := storageLevel(path)
+		if entry.IsDir() {
+			if level > levelAlbum {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if level != levelImage || !IsImageFile(name) {
+			return nil
+		}
+		if name != imageID && strings.TrimSuffix(name, filepath.Ext(name)) != imageID {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(DataPath, path)
+		parts := strings.Split(rel, string(filepath.Separator))
+		var size int64
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		images = append(images, ImageInfo{Filename: name, Path: path, Size: size, UserID: parts[0], AlbumID: parts[1]})
+		if len(images) >= adminListLimit {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+
+	return images, err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AlbumIndexFileName — скрытый файл в каталоге альбома с метаданными изображений.
+// Списки строятся по нему без stat и декодирования каждого файла.
+const AlbumIndexFileName = ".index.json"
+
+// isAlbumMetaFile сообщает, что файл в каталоге альбома — служебный (индекс,
+// настройки водяного знака), а не содержимое альбома
+func isAlbumMetaFile(name string) bool {
+	return name == AlbumIndexFileName || name == AlbumWatermarkFileName
+}
+
+// albumIndex — содержимое файла индекса
+type albumIndex struct {
+	Images []ImageInfo `json:"images"`
+}
+
+// albumIndexLocks сериализует изменения индекса одного альбома
+var albumIndexLocks sync.Map // путь альбома -> *sync.Mutex
+
+func lockAlbumIndex(userID, albumID string) func() {
+	value, _ := albumIndexLocks.LoadOrStore(albumPath(userID, albumID), &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func albumIndexPath(userID, albumID string) string {
+	return filepath.Join(albumPath(userID, albumID), AlbumIndexFileName)
+}
+
+// readAlbumIndex читает индекс альбома; отсутствующий или поврежденный индекс пуст
+func readAlbumIndex(ctx context.Context, userID, albumID string) map[string]ImageInfo {
+	entries := make(map[string]ImageInfo)
+	data, err := os.ReadFile(albumIndexPath(userID, albumID))
+	if err != nil {
+		return entries
+	}
+	var index albumIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		logger.WarnContext(ctx, "rebuilding damaged album index", "user_id", userID, "album_id", albumID, "error", err)
+		return entries
+	}
+	for _, image := range index.Images {
+		entries[image.Filename] = image
+	}
+	return entries
+}
+
+// writeAlbumIndex атомарно сохраняет индекс альбома
+func writeAlbumIndex(userID, albumID string, entries map[string]ImageInfo) error {
+	index := albumIndex{Images: sortedImages(entries)}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(albumIndexPath(userID, albumID), bytes.NewReader(data))
+}
+
+// sortedImages возвращает изображения в порядке загрузки (старые сверху)
+func sortedImages(entries map[string]ImageInfo) []ImageInfo {
+	images := make([]ImageInfo, 0, len(entries))
+	for _, image := range entries {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].UploadedAt.Equal(images[j].UploadedAt) {
+			return images[i].Filename < images[j].Filename
+		}
+		return images[i].UploadedAt.Before(images[j].UploadedAt)
+	})
+	return images
+}
+
+// indexImage добавляет или обновляет записи изображений в индексе альбома
+func indexImage(ctx context.Context, userID, albumID string, infos ...ImageInfo) {
+	unlock := lockAlbumIndex(userID, albumID)
+	defer unlock()
+
+	entries := readAlbumIndex(ctx, userID, albumID)
+	for _, info := range infos {
+		entries[info.Filename] = info
+	}
+	if err := writeAlbumIndex(userID, albumID, entries); err != nil {
+		logger.ErrorContext(ctx, "failed to update album index", "user_id", userID, "album_id", albumID, "error", err)
+	}
+}
+
+// unindexImage удаляет запись изображения из индекса альбома
+func unindexImage(ctx context.Context, userID, albumID, filename string) {
+	unlock := lockAlbumIndex(userID, albumID)
+	defer unlock()
+
+	entries := readAlbumIndex(ctx, userID, albumID)
+	if _, ok := entries[filename]; !ok {
+		return
+	}
+	delete(entries, filename)
+	if err := writeAlbumIndex(userID, albumID, entries); err != nil {
+		logger.ErrorContext(ctx, "failed to update album index", "user_id", userID, "album_id", albumID, "error", err)
+	}
+}
+
+// readImageMeta извлекает метаданные файла на диске: размеры и формат по
+// заголовку с учетом поворота по EXIF, заглушку и перцептивный хеш по пикселям,
+// SHA-256 по содержимому; время загрузки — время изменения файла
+func readImageMeta(path string) (ImageInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	info := ImageInfo{
+		Filename:   filepath.Base(path),
+		Path:       path,
+		Size:       stat.Size(),
+		UploadedAt: stat.ModTime().UTC(),
+	}
+	if err := fillImageMeta(&info, file); err != nil {
+		return info, err
+	}
+	if info.Format != "" && canDecodePixels(info.Format) && info.Width*info.Height <= maxHashPixels {
+		orientation, err := displayOrientation(file, info.Format)
+		if err != nil {
+			return info, err
+		}
+		if img, _, err := image.Decode(file); err == nil {
+			info.BlurHash, info.Color = imagePlaceholder(img, orientation)
+			info.PHash = formatPHash(perceptualHash(img))
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return info, err
+		}
+		if orientation >= 5 {
+			info.Width, info.Height = info.Height, info.Width
+		}
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return info, err
+	}
+	info.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return info, nil
+}
+
+// fillImageMeta читает размеры и формат из заголовка и возвращает указатель в начало.
+// Нераспознанный заголовок не ошибка: размеры остаются нулевыми.
+func fillImageMeta(info *ImageInfo, file io.ReadSeeker) error {
+	if config, format, err := image.DecodeConfig(file); err == nil {
+		info.Width, info.Height, info.Format = config.Width, config.Height, format
+	} else if strings.EqualFold(filepath.Ext(info.Filename), ".svg") {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if config, err := svgConfig(file); err == nil {
+			info.Width, info.Height, info.Format = config.Width, config.Height, "svg"
+		}
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+
+	"screenguru"
+)
+
+// embeddedTemplates содержит шаблоны и статические файлы, встроенные при сборке
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// assets — файловая система с шаблонами (*.html), статикой (static/) и changelog.md.
+// Инициализируется в initializeApp.
+var assets fs.FS
+
+// initAssets собирает файловую систему ресурсов: файлы из TemplatesDir
+// (если задан) перекрывают встроенные, что позволяет менять тему и
+// разрабатывать шаблоны без пересборки
+func initAssets() error {
+	embedded, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		return err
+	}
+
+	if TemplatesDir == "" {
+		assets = embedded
+		return nil
+	}
+
+	info, err := os.Stat(TemplatesDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(TemplatesDir + " is not a directory")
+	}
+
+	logger.Info("using templates override directory", "dir", TemplatesDir)
+	assets = overlayFS{primary: os.DirFS(TemplatesDir), fallback: embedded}
+	return nil
+}
+
+// readChangelog возвращает ченджлог из каталога перекрытия или встроенный
+func readChangelog() string {
+	if data, err := fs.ReadFile(assets, "changelog.md"); err == nil {
+		return string(data)
+	}
+	return screenguru.Changelog
+}
+
+// overlayFS отдает файлы из primary, а при их отсутствии — из fallback
+type overlayFS struct {
+	primary  fs.FS
+	fallback fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if f, err := o.primary.Open(name); err == nil {
+		return f, nil
+	}
+	return o.fallback.Open(name)
+}
+
+// ReadDir объединяет содержимое каталогов обеих систем, primary имеет приоритет
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	primaryEntries, primaryErr := fs.ReadDir(o.primary, name)
+	fallbackEntries, fallbackErr := fs.ReadDir(o.fallback, name)
+	if primaryErr != nil && fallbackErr != nil {
+		return nil, fallbackErr
+	}
+
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+	for _, entry := range append(primaryEntries, fallbackEntries...) {
+		if seen[entry.Name()] {
+			continue
+		}
+		seen[entry.Name()] = true
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AuditLogFileName — журнал действий администраторов в DataPath, по записи JSON на строку
+const AuditLogFileName = ".audit.log"
+
+// AuditEntry — запись журнала аудита
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	RemoteIP  string    `json:"remote_ip,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Result    string    `json:"result"` // ok или текст ошибки
+}
+
+// auditMu сериализует записи процесса; между процессами строки не перемешиваются
+// благодаря O_APPEND и записи строки одним вызовом
+var auditMu sync.Mutex
+
+func auditLogPath() string { return filepath.Join(DataPath, AuditLogFileName) }
+
+// recordAudit дописывает запись в журнал аудита и дублирует ее в лог
+func recordAudit(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	logger.Info("audit", "actor", entry.Actor, "action", entry.Action, "target", entry.Target, "result", entry.Result)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if err := appendJSONLine(auditLogPath(), entry); err != nil {
+		logger.Error("failed to write audit log", "error", err)
+	}
+}
+
+// appendJSONLine дописывает значение в файл одной строкой JSON
+func appendJSONLine(path string, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// auditRequest записывает действие, выполненное через HTTP запрос
+func auditRequest(r *http.Request, actor, action, target string, actionErr error) {
+	entry := AuditEntry{
+		Actor:    actor,
+		RemoteIP: clientIP(r),
+		Action:   action,
+		Target:   target,
+		Result:   auditResult(actionErr),
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		entry.RequestID = info.ID
+	}
+	recordAudit(entry)
+}
+
+// auditResult переводит результат действия в поле Result
+func auditResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// readAuditLog возвращает последние limit записей журнала, новые первыми
+func readAuditLog(limit int) ([]AuditEntry, error) {
+	return readJSONLines[AuditEntry](auditLogPath(), limit)
+}
+
+// readJSONLines читает последние limit записей файла с объектом JSON на строку, новые первыми
+func readJSONLines[T any](path string, limit int) ([]T, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []T
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry T
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Поврежденная строка не должна скрывать остальной журнал
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, scanner.Err()
+}
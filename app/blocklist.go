@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Декодеры для перцептивного хеша
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// BlocklistFileName — список заблокированных хешей в DataPath.
+// Строки вида "kind<TAB>hash<TAB>время<TAB>заметка", # — комментарий.
+const BlocklistFileName = ".blocklist"
+
+// Виды хешей в списке блокировки
+const (
+	BlockSHA256 = "sha256"
+	BlockPHash  = "phash"
+)
+
+// BlocklistPHashDistance — максимальное расстояние Хэмминга, при котором
+// перцептивный хеш загрузки считается совпавшим с заблокированным
+var BlocklistPHashDistance = 4
+
+// maxHashPixels ограничивает размер изображения, которое декодируется для перцептивного хеша
+const maxHashPixels = 50_000_000
+
+// errUploadRejected возвращается клиенту при блокировке; причина не раскрывается
+var errUploadRejected = errors.New("upload rejected")
+
+// BlockEntry — запись списка блокировки
+type BlockEntry struct {
+	Kind    string
+	Hash    string
+	AddedAt time.Time
+	Note    string
+}
+
+// imageHashes — хеши содержимого изображения
+type imageHashes struct {
+	SHA256   string
+	PHash    uint64
+	HasPHash bool // false, если изображение не удалось декодировать
+}
+
+// Blocklist хранит список блокировки в памяти и перечитывает файл, когда его
+// изменяет другой процесс (команды CLI при запущенном сервере)
+type Blocklist struct {
+	mu      sync.RWMutex
+	entries []BlockEntry
+	modTime time.Time
+	size    int64
+}
+
+// Global blocklist instance
+var blocklist = &Blocklist{}
+
+func blocklistPath() string { return filepath.Join(DataPath, BlocklistFileName) }
+
+// refresh перечитывает файл, если он изменился с последней загрузки
+func (b *Blocklist) refresh(ctx context.Context) error {
+	info, err := os.Stat(blocklistPath())
+	if os.IsNotExist(err) {
+		b.mu.Lock()
+		b.entries, b.modTime, b.size = nil, time.Time{}, 0
+		b.mu.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	fresh := info.ModTime().Equal(b.modTime) && info.Size() == b.size
+	b.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	entries, err := readBlocklist(ctx, blocklistPath())
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.entries, b.modTime, b.size = entries, info.ModTime(), info.Size()
+	b.mu.Unlock()
+	return nil
+}
+
+// Entries возвращает все записи списка
+func (b *Blocklist) Entries(ctx context.Context) ([]BlockEntry, error) {
+	if err := b.refresh(ctx); err != nil {
+		return nil, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]BlockEntry(nil), b.entries...), nil
+}
+
+// Match ищет запись, совпадающую с хешами изображения
+func (b *Blocklist) Match(ctx context.Context, hashes imageHashes) (BlockEntry, bool) {
+	if err := b.refresh(ctx); err != nil {
+		logger.ErrorContext(ctx, "failed to reload blocklist", "error", err)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, entry := range b.entries {
+		switch entry.Kind {
+		case BlockSHA256:
+			if entry.Hash == hashes.SHA256 {
+				return entry, true
+			}
+		case BlockPHash:
+			if !hashes.HasPHash {
+				continue
+			}
+			if hash, err := parsePHash(entry.Hash); err == nil && hammingDistance(hash, hashes.PHash) <= BlocklistPHashDistance {
+				return entry, true
+			}
+		}
+	}
+	return BlockEntry{}, false
+}
+
+// Add добавляет записи, пропуская уже известные хеши, и возвращает число новых
+func (b *Blocklist) Add(ctx context.Context, entries ...BlockEntry) (int, error) {
+	return b.update(ctx, func(current []BlockEntry) ([]BlockEntry, int) {
+		known := make(map[string]bool, len(current))
+		for _, entry := range current {
+			known[entry.Kind+":"+entry.Hash] = true
+		}
+		added := 0
+		for _, entry := range entries {
+			if known[entry.Kind+":"+entry.Hash] {
+				continue
+			}
+			if entry.AddedAt.IsZero() {
+				entry.AddedAt = time.Now().UTC()
+			}
+			known[entry.Kind+":"+entry.Hash] = true
+			current = append(current, entry)
+			added++
+		}
+		return current, added
+	})
+}
+
+// Remove удаляет запись с данным хешем и возвращает число удаленных
+func (b *Blocklist) Remove(ctx context.Context, hash string) (int, error) {
+	return b.update(ctx, func(current []BlockEntry) ([]BlockEntry, int) {
+		kept := current[:0]
+		for _, entry := range current {
+			if entry.Hash != hash {
+				kept = append(kept, entry)
+			}
+		}
+		return kept, len(current) - len(kept)
+	})
+}
+
+// update перечитывает файл, применяет изменение и атомарно сохраняет результат
+func (b *Blocklist) update(ctx context.Context, change func([]BlockEntry) ([]BlockEntry, int)) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, err := readBlocklist(ctx, blocklistPath())
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	updated, changed := change(current)
+	if changed == 0 {
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# screenguru blocklist: kind\thash\tadded\tnote\n")
+	for _, entry := range updated {
+		note := strings.NewReplacer("\t", " ", "\n", " ").Replace(entry.Note)
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\n", entry.Kind, entry.Hash, entry.AddedAt.UTC().Format(time.RFC3339), note)
+	}
+	if err := EnsureDir(DataPath); err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomicPerm(blocklistPath(), &buf, 0600); err != nil {
+		return 0, err
+	}
+
+	b.entries = updated
+	if info, err := os.Stat(blocklistPath()); err == nil {
+		b.modTime, b.size = info.ModTime(), info.Size()
+	}
+	return changed, nil
+}
+
+// readBlocklist разбирает файл списка блокировки
+func readBlocklist(ctx context.Context, path string) ([]BlockEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []BlockEntry
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, "\t", 4)
+		entry, err := parseBlockHash(fields[0] + ":" + strings.TrimSpace(safeField(fields, 1)))
+		if err != nil {
+			logger.WarnContext(ctx, "skipping invalid blocklist line", "line", lineNo, "error", err)
+			continue
+		}
+		entry.AddedAt, _ = time.Parse(time.RFC3339, safeField(fields, 2))
+		entry.Note = safeField(fields, 3)
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func safeField(fields []string, i int) string {
+	if i < len(fields) {
+		return fields[i]
+	}
+	return ""
+}
+
+// parseBlockHash разбирает хеш вида "sha256:<64 hex>", "phash:<16 hex>"
+// или просто hex-строку, вид которой определяется по длине
+func parseBlockHash(value string) (BlockEntry, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	kind, hash, found := strings.Cut(value, ":")
+	if !found {
+		hash = kind
+		switch len(hash) {
+		case 64:
+			kind = BlockSHA256
+		case 16:
+			kind = BlockPHash
+		}
+	}
+
+	switch kind {
+	case BlockSHA256:
+		if len(hash) != 64 {
+			return BlockEntry{}, fmt.Errorf("sha256 hash must be 64 hex characters")
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return BlockEntry{}, fmt.Errorf("sha256 hash must be hex")
+		}
+	case BlockPHash:
+		if _, err := parsePHash(hash); err != nil {
+			return BlockEntry{}, err
+		}
+	default:
+		return BlockEntry{}, fmt.Errorf("expected a sha256 (64 hex) or phash (16 hex) hash, got %q", value)
+	}
+	return BlockEntry{Kind: kind, Hash: hash}, nil
+}
+
+// hashImage вычисляет хеши содержимого и возвращает указатель в начало
+func hashImage(file io.ReadSeeker) (imageHashes, error) {
+	var img image.Image
+	if config, _, err := image.DecodeConfig(file); err == nil && config.Width*config.Height <= maxHashPixels {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return imageHashes{}, err
+		}
+		img, _, _ = image.Decode(file)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return imageHashes{}, err
+	}
+	return hashDecodedImage(file, img)
+}
+
+// hashDecodedImage вычисляет хеши по уже декодированному изображению;
+// при img == nil перцептивный хеш не вычисляется
+func hashDecodedImage(file io.ReadSeeker, img image.Image) (imageHashes, error) {
+	var hashes imageHashes
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return hashes, err
+	}
+	hashes.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if img != nil {
+		hashes.PHash, hashes.HasPHash = perceptualHash(img), true
+	}
+
+	_, err := file.Seek(0, io.SeekStart)
+	return hashes, err
+}
+
+// hashImageFile вычисляет хеши файла на диске
+func hashImageFile(path string) (imageHashes, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return imageHashes{}, err
+	}
+	defer file.Close()
+	return hashImage(file)
+}
+
+// blockEntriesFor возвращает записи блокировки для хешей изображения
+func blockEntriesFor(hashes imageHashes, note string) []BlockEntry {
+	entries := []BlockEntry{{Kind: BlockSHA256, Hash: hashes.SHA256, Note: note}}
+	if hashes.HasPHash {
+		entries = append(entries, BlockEntry{Kind: BlockPHash, Hash: formatPHash(hashes.PHash), Note: note})
+	}
+	return entries
+}
+
+// blockImageFiles добавляет хеши файлов в список блокировки
+func blockImageFiles(ctx context.Context, paths []string, note string) (int, error) {
+	var entries []BlockEntry
+	for _, path := range paths {
+		hashes, err := hashImageFile(path)
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, blockEntriesFor(hashes, note)...)
+	}
+	return blocklist.Add(ctx, entries...)
+}
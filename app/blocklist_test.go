@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"mime/multipart"
+	"os"
+	"testing"
+)
+
+// formFile собирает файл multipart-формы, как его получает uploadHandler
+func formFile(t *testing.T, filename string, data []byte) *multipart.FileHeader {
+	t.Helper()
+	req := uploadRequest(t, filename, data)
+	if err := req.ParseMultipartForm(MaxFileSize); err != nil {
+		t.Fatal(err)
+	}
+	return req.MultipartForm.File["image"][0]
+}
+
+// uploadImage сохраняет файл в альбом user/album
+func uploadImage(t *testing.T, header *multipart.FileHeader) (*ImageInfo, error) {
+	t.Helper()
+	file, err := header.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	return saveImage(context.Background(), file, header, "user", "album")
+}
+
+// encodePNG кодирует градиент testPNG с заданным уровнем сжатия
+func encodePNG(t *testing.T, level png.CompressionLevel) []byte {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(testPNG(t, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: level}).Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTakedownBlocksReencodedUpload(t *testing.T) {
+	previous := ReencodePolicy
+	ReencodePolicy = ReencodeLossless
+	t.Cleanup(func() { ReencodePolicy = previous })
+
+	tests := []struct {
+		name, filename string
+		data           []byte
+		stored         bool // сохраняется ли файл без изменений
+	}{
+		{"sanitized svg", "a.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><script>alert(1)</script><rect width="10" height="10"/></svg>`), false},
+		{"recompressed png", "a.png", encodePNG(t, png.NoCompression), false},
+		{"optimal png", "a.png", encodePNG(t, png.BestCompression), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDataPath(t)
+			withScanner(t, nil, false)
+
+			info, err := uploadImage(t, formFile(t, tt.filename, tt.data))
+			if err != nil {
+				t.Fatalf("first upload: %v", err)
+			}
+			stored, err := os.ReadFile(info.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.Equal(stored, tt.data); got != tt.stored {
+				t.Errorf("stored unchanged = %v, want %v", got, tt.stored)
+			}
+
+			// Снятие блокирует хеши сохраненного файла, а не исходника
+			if _, err := blockImageFiles(context.Background(), []string{info.Path}, "takedown"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := uploadImage(t, formFile(t, tt.filename, tt.data)); !errors.Is(err, errUploadRejected) {
+				t.Errorf("re-upload error = %v, want %v", err, errUploadRejected)
+			}
+		})
+	}
+}
+
+func TestReencodeKeepsSmallerPNG(t *testing.T) {
+	previous := ReencodePolicy
+	ReencodePolicy = ReencodeLossless
+	t.Cleanup(func() { ReencodePolicy = previous })
+
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		recode bool
+	}{
+		{"uncompressed", encodePNG(t, png.NoCompression), true},
+		{"already optimal", encodePNG(t, png.BestCompression), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := png.Decode(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := reencodeUpload(context.Background(), bytes.NewReader(tt.data), int64(len(tt.data)), img, "png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := result != nil; got != tt.recode {
+				t.Fatalf("re-encoded = %v, want %v", got, tt.recode)
+			}
+			if result != nil && len(result.data) >= len(tt.data) {
+				t.Errorf("re-encoded to %d bytes from %d", len(result.data), len(tt.data))
+			}
+		})
+	}
+}
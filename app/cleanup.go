@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,7 +12,7 @@ import (
 // startCleanupWorker запускает фоновый процесс очистки старых изображений
 func startCleanupWorker(ctx context.Context) {
 	// Первая очистка сразу при запуске
-	performCleanup()
+	performCleanup(ctx)
 
 	ticker := time.NewTicker(CleanupInterval)
 	defer ticker.Stop()
@@ -22,38 +22,90 @@ func startCleanupWorker(ctx context.Context) {
 		case <-ctx.Done():
 			return // Graceful shutdown
 		case <-ticker.C:
-			performCleanup()
+			performCleanup(ctx)
 		}
 	}
 }
 
-// performCleanup выполняет очистку
-func performCleanup() {
-	logger.Info("Starting background cleanup...")
-	if err := cleanupRecursive(DataPath); err != nil {
-		logger.Error("Cleanup failed: " + err.Error())
+// performCleanup выполняет очистку. При отмене контекста проход прерывается
+// между файлами, поэтому данные остаются в согласованном состоянии.
+func performCleanup(ctx context.Context) {
+	logger.Info("cleanup started")
+	start := time.Now()
+	err := cleanupRecursive(ctx, DataPath, cleanupOptions{})
+	if err == nil {
+		err = pruneImageVersions(ctx, cleanupOptions{})
+	}
+	if errors.Is(err, context.Canceled) {
+		logger.Info("cleanup aborted by shutdown")
+		metrics.cleanupRuns.Inc("aborted")
+	} else if err != nil {
+		logger.Error("cleanup failed", "error", err)
+		metrics.cleanupRuns.Inc("failure")
+		recordCleanupResult(err)
 	} else {
-		logger.Info("Cleanup completed successfully")
+		logger.Info("cleanup completed", "duration", time.Since(start))
+		metrics.cleanupRuns.Inc("success")
+		recordCleanupResult(nil)
 	}
+	metrics.cleanupDuration.Observe(time.Since(start).Seconds())
+}
+
+// cleanupOptions управляет проходом очистки
+type cleanupOptions struct {
+	DryRun   bool              // только найти, что было бы удалено, ничего не трогая
+	OnRemove func(path string) // вызывается для каждого удаленного (или намеченного) пути
 }
 
 // cleanupRecursive рекурсивно удаляет старые файлы и пустые директории
-func cleanupRecursive(root string) error {
+func cleanupRecursive(ctx context.Context, root string, opts cleanupOptions) error {
 	if _, err := os.Stat(root); os.IsNotExist(err) {
 		return nil
 	}
 
 	var dirs []string
 	deletedFiles := 0
+	// removed хранит удаленные пути, чтобы и в режиме dry-run понять,
+	// какие директории опустеют
+	removed := make(map[string]bool)
+
+	remove := func(path string) error {
+		if !opts.DryRun {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		removed[path] = true
+		if opts.OnRemove != nil {
+			opts.OnRemove(path)
+		}
+		return nil
+	}
 
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Пропускаем файлы с ошибками доступа
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Недописанные загрузки, оставшиеся после аварийной остановки
+		name := info.Name()
+		if !info.IsDir() && strings.HasPrefix(name, TempFilePrefix) {
+			if time.Since(info.ModTime()) > TempFileMaxAge {
+				if err := remove(path); err != nil {
+					logger.Error("failed to remove stale upload", "path", path, "error", err)
+				} else {
+					logger.Debug("removed stale upload", "path", path)
+				}
+			}
+			return nil
+		}
+
 		// Исключаем скрытые или системные файлы (начинающиеся с точки)
 		// Но не саму корневую директорию /data
-		name := info.Name()
 		if strings.HasPrefix(name, ".") && path != root {
 			if info.IsDir() {
 				return filepath.SkipDir
@@ -70,15 +122,24 @@ func cleanupRecursive(root string) error {
 
 		// Проверяем срок жизни файла используя вспомогательную функцию из utils.go
 		if isImageOld(info.ModTime()) {
-			if err := os.Remove(path); err != nil {
-				logger.Error("Failed to remove old file " + path + ": " + err.Error())
-			} else {
+			if err := remove(path); err != nil {
+				logger.Error("failed to remove expired file", "path", path, "error", err)
+			} else if !opts.DryRun {
 				deletedFiles++
-				// Обновляем глобальный счетчик, если это изображение
-				if IsImageFile(name) {
-					TotalImageCount--
+				metrics.cleanupDeleted.Inc()
+				// Обновляем статистику, если это изображение альбома
+				if IsImageFile(name) && storageLevel(path) == levelImage {
+					stats.Removed(StorageStats{Images: 1, Bytes: info.Size()})
+					if rel, err := filepath.Rel(DataPath, path); err == nil {
+						if parts := strings.Split(rel, string(filepath.Separator)); len(parts) == 3 {
+							unindexImage(ctx, parts[0], parts[1], parts[2])
+							purgeTransforms(ctx, parts[0], parts[1], parts[2])
+							purgeImageVersions(ctx, parts[0], parts[1], parts[2])
+							emitImageEvent(EventImageExpired, parts[0], parts[1], parts[2], info.Size())
+						}
+					}
 				}
-				logger.Debug("Removed old file: " + path)
+				logger.Debug("removed expired file", "path", path)
 			}
 		}
 
@@ -90,23 +151,38 @@ func cleanupRecursive(root string) error {
 	}
 
 	if deletedFiles > 0 {
-		logger.Info(fmt.Sprintf("Cleanup: deleted %d expired files", deletedFiles))
+		logger.Info("cleanup deleted expired files", "count", deletedFiles)
 	}
 
 	// Удаление пустых директорий "снизу-вверх"
 	// Используем накопленный список директорий и проходим его с конца
 	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		dir := dirs[i]
-		isEmpty, err := isDirEmpty(dir)
+		isEmpty, err := isDirEmptyAfter(dir, removed)
 		if err != nil {
 			continue
 		}
 
 		if isEmpty {
-			if err := os.Remove(dir); err != nil {
-				logger.Error("Failed to remove empty directory " + dir + ": " + err.Error())
-			} else {
-				logger.Debug("Removed empty directory: " + dir)
+			// Служебные файлы опустевшего альбома удаляются вместе с ним
+			if !opts.DryRun {
+				os.Remove(filepath.Join(dir, AlbumIndexFileName))
+				os.Remove(filepath.Join(dir, AlbumWatermarkFileName))
+			}
+			if err := remove(dir); err != nil {
+				logger.Error("failed to remove empty directory", "path", dir, "error", err)
+			} else if !opts.DryRun {
+				logger.Debug("removed empty directory", "path", dir)
+				switch storageLevel(dir) {
+				case levelUser:
+					stats.Removed(StorageStats{Users: 1})
+				case levelAlbum:
+					stats.Removed(StorageStats{Albums: 1})
+				}
 			}
 		}
 	}
@@ -114,11 +190,20 @@ func cleanupRecursive(root string) error {
 	return nil
 }
 
-// isDirEmpty проверяет, пуста ли директория
-func isDirEmpty(dirPath string) (bool, error) {
+// isDirEmptyAfter проверяет, будет ли директория пуста после удаления путей из removed.
+// Служебные файлы альбома не считаются содержимым.
+func isDirEmptyAfter(dirPath string, removed map[string]bool) (bool, error) {
 	entries, err := os.ReadDir(dirPath)
 	if err != nil {
 		return false, err
 	}
-	return len(entries) == 0, nil
-}
\ No newline at end of file
+	for _, entry := range entries {
+		if isAlbumMetaFile(entry.Name()) && !entry.IsDir() {
+			continue
+		}
+		if !removed[filepath.Join(dirPath, entry.Name())] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command — служебная команда того же бинарника, работающая с DataPath напрямую.
+// Все команды безопасны при запущенном сервере: файлы удаляются по одному,
+// а расхождения в счетчиках сервер исправит при ближайшей сверке статистики.
+type command struct {
+	name  string
+	args  []string // имена позиционных аргументов
+	usage string
+	flags func(flags *flag.FlagSet) // собственные флаги команды
+	run   func(args []string) error
+}
+
+// Флаги команд
+var (
+	cleanupDryRun bool
+	blockNote     string
+)
+
+// errProblemsFound — fsck нашел проблемы; команда завершается с кодом 1
+var errProblemsFound = errors.New("problems found")
+
+// commands возвращает список служебных команд
+func commands() []command {
+	return []command{
+		{name: "stats", usage: "показать число пользователей, альбомов, изображений и занятый объем", run: runStats},
+		{name: "cleanup", usage: "удалить устаревшие файлы и пустые директории", run: runCleanup,
+			flags: func(flags *flag.FlagSet) {
+				flags.BoolVar(&cleanupDryRun, "dry-run", false, "только показать, что будет удалено")
+			}},
+		{name: "purge-user", args: []string{"user"}, usage: "удалить все альбомы пользователя", run: runPurgeUser},
+		{name: "purge-album", args: []string{"user", "album"}, usage: "удалить альбом пользователя", run: runPurgeAlbum},
+		{name: "fsck", usage: "найти пустые, посторонние и неправильно названные файлы", run: runFsck},
+		{name: "rotate-secret", usage: "сгенерировать новый секрет подписи cookie", run: runRotateSecret},
+		{name: "blocklist", usage: "показать список блокировки", run: runBlocklist},
+		{name: "block-hash", args: []string{"hash"}, usage: "заблокировать хеш (sha256 — 64 hex, phash — 16 hex)", run: runBlockHash, flags: blockNoteFlag},
+		{name: "block-file", args: []string{"path"}, usage: "заблокировать изображение по его файлу", run: runBlockFile, flags: blockNoteFlag},
+		{name: "unblock", args: []string{"hash"}, usage: "убрать хеш из списка блокировки", run: runUnblock},
+	}
+}
+
+func blockNoteFlag(flags *flag.FlagSet) {
+	flags.StringVar(&blockNote, "note", "", "заметка к записи списка блокировки")
+}
+
+// findCommand ищет команду по имени
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// runCommand разбирает конфигурацию и аргументы команды и выполняет ее.
+// Возвращает код завершения процесса.
+func runCommand(cmd command, args []string) int {
+	synopsis := "screenguru " + cmd.name + " [flags]"
+	for _, arg := range cmd.args {
+		synopsis += " <" + arg + ">"
+	}
+
+	flags := flag.NewFlagSet("screenguru "+cmd.name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s\n\n%s\n\n", synopsis, cmd.usage)
+		flags.PrintDefaults()
+	}
+	if cmd.flags != nil {
+		cmd.flags(flags)
+	}
+
+	if err := loadConfigFlags(flags, args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 2
+	}
+	if flags.NArg() != len(cmd.args) {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n", synopsis)
+		return 2
+	}
+
+	initLogger(os.Stderr)
+
+	if err := cmd.run(flags.Args()); err != nil {
+		if !errors.Is(err, errProblemsFound) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// printCommands выводит список команд для -help основного бинарника
+func printCommands(w io.Writer) {
+	fmt.Fprintf(w, "\nCommands:\n")
+	for _, cmd := range commands() {
+		name := cmd.name
+		for _, arg := range cmd.args {
+			name += " <" + arg + ">"
+		}
+		fmt.Fprintf(w, "  %-28s %s\n", name, cmd.usage)
+	}
+	fmt.Fprintf(w, "\nWithout a command the server is started.\n")
+}
+
+func runStats(args []string) error {
+	result, err := scanStorage(DataPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("data dir: %s\n", DataPath)
+	fmt.Printf("users:    %d\n", result.Users)
+	fmt.Printf("albums:   %d\n", result.Albums)
+	fmt.Printf("images:   %d\n", result.Images)
+	fmt.Printf("bytes:    %d (%s)\n", result.Bytes, formatBytes(result.Bytes))
+	return nil
+}
+
+func runCleanup(args []string) error {
+	var count int
+	opts := cleanupOptions{
+		DryRun: cleanupDryRun,
+		OnRemove: func(path string) {
+			count++
+			fmt.Println(path)
+		},
+	}
+
+	if err := cleanupRecursive(context.Background(), DataPath, opts); err != nil {
+		return err
+	}
+	if err := pruneImageVersions(context.Background(), opts); err != nil {
+		return err
+	}
+
+	if cleanupDryRun {
+		fmt.Printf("%d paths would be removed\n", count)
+	} else {
+		fmt.Printf("%d paths removed\n", count)
+	}
+	return nil
+}
+
+func runPurgeUser(args []string) error {
+	userID := args[0]
+	if !validStorageID(userID) {
+		return fmt.Errorf("invalid user ID %q", userID)
+	}
+
+	err := deleteUser(context.Background(), userID)
+	recordAudit(AuditEntry{Actor: "cli", Action: "delete-user", Target: userID, Result: auditResult(err)})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user %s purged\n", userID)
+	return nil
+}
+
+func runPurgeAlbum(args []string) error {
+	userID, albumID := args[0], args[1]
+	if !validStorageID(userID) || !validStorageID(albumID) {
+		return fmt.Errorf("invalid user or album ID")
+	}
+
+	err := deleteAlbum(context.Background(), userID, albumID)
+	recordAudit(AuditEntry{Actor: "cli", Action: "delete-album", Target: userID + "/" + albumID, Result: auditResult(err)})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("album %s/%s purged\n", userID, albumID)
+	return nil
+}
+
+// Имена, которые выдает сервер: ID из RandomID и файлы вида <ID>.<ext>
+var (
+	storageIDPattern = regexp.MustCompile(`^[0-9a-f]{5}$`)
+	imageNamePattern = regexp.MustCompile(`^[0-9a-f]{5}\.[a-z0-9]+$`)
+)
+
+// fsckProblem — найденная fsck проблема
+type fsckProblem struct {
+	path   string
+	reason string
+}
+
+func runFsck(args []string) error {
+	problems, err := checkStorage(DataPath)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("%s\t%s\n", problem.reason, problem.path)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problems found\n", len(problems))
+		return errProblemsFound
+	}
+	fmt.Println("no problems found")
+	return nil
+}
+
+// checkStorage проверяет, что DataPath соответствует раскладке
+// <user>/<album>/<image>, и возвращает найденные отклонения. Ничего не изменяет.
+func checkStorage(root string) ([]fsckProblem, error) {
+	var problems []fsckProblem
+	report := func(path, reason string) {
+		problems = append(problems, fsckProblem{path: path, reason: reason})
+	}
+
+	root = filepath.Clean(root)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			report(path, "unreadable")
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+
+		name := entry.Name()
+		level := storageLevel(path)
+
+		// Недописанные загрузки
+		if strings.HasPrefix(name, TempFilePrefix) {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > TempFileMaxAge {
+				report(path, "stale_temp")
+			}
+			return nil
+		}
+
+		// Служебные файлы допустимы только в корне: секреты и т.п.
+		// Исключение — служебные файлы в каталоге альбома.
+		if strings.HasPrefix(name, ".") {
+			if level > levelUser && !(isAlbumMetaFile(name) && level == levelImage && !entry.IsDir()) {
+				report(path, "hidden")
+			}
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case entry.IsDir() && level > levelAlbum:
+			report(path, "unexpected_dir")
+			return filepath.SkipDir
+		case entry.IsDir():
+			if !storageIDPattern.MatchString(name) {
+				report(path, "bad_name")
+			}
+			if empty, err := isDirEmptyAfter(path, nil); err == nil && empty {
+				report(path, "empty_dir")
+			}
+		case level < levelImage:
+			report(path, "orphaned")
+		default:
+			checkImageFile(path, entry, report)
+		}
+		return nil
+	})
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].path < problems[j].path })
+	return problems, err
+}
+
+// checkImageFile проверяет файл изображения: имя, размер и содержимое
+func checkImageFile(path string, entry fs.DirEntry, report func(path, reason string)) {
+	name := entry.Name()
+	if !IsImageFile(name) {
+		report(path, "non_image")
+		return
+	}
+	if !imageNamePattern.MatchString(name) {
+		report(path, "bad_name")
+	}
+
+	info, err := entry.Info()
+	if err != nil {
+		report(path, "unreadable")
+		return
+	}
+	if info.Size() == 0 {
+		report(path, "zero_byte")
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		report(path, "unreadable")
+		return
+	}
+	defer file.Close()
+
+	if _, ok := validateImageType(file); !ok {
+		report(path, "non_image")
+	}
+}
+
+func runRotateSecret(args []string) error {
+	if err := EnsureDir(DataPath); err != nil {
+		return err
+	}
+	if err := rotateSecret(); err != nil {
+		return err
+	}
+
+	fmt.Println("secret rotated; sessions signed with the previous secret stay valid until the next rotation")
+	fmt.Println("restart running servers to pick up the new secret")
+	return nil
+}
+
+func runBlocklist(args []string) error {
+	entries, err := blocklist.Entries(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\t%s\t%s\n", entry.Kind, entry.Hash, entry.AddedAt.Format(time.RFC3339), entry.Note)
+	}
+	fmt.Printf("%d entries\n", len(entries))
+	return nil
+}
+
+func runBlockHash(args []string) error {
+	entry, err := parseBlockHash(args[0])
+	if err != nil {
+		return err
+	}
+	entry.Note = blockNote
+
+	added, err := blocklist.Add(context.Background(), entry)
+	recordAudit(AuditEntry{Actor: "cli", Action: "block-add", Target: entry.Kind + ":" + entry.Hash, Result: auditResult(err)})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d entries added\n", added)
+	return nil
+}
+
+func runBlockFile(args []string) error {
+	hashes, err := hashImageFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	entries := blockEntriesFor(hashes, blockNote)
+	added, err := blocklist.Add(context.Background(), entries...)
+	for _, entry := range entries {
+		recordAudit(AuditEntry{Actor: "cli", Action: "block-add", Target: entry.Kind + ":" + entry.Hash, Result: auditResult(err)})
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\n", entry.Kind, entry.Hash)
+	}
+	fmt.Printf("%d entries added\n", added)
+	return nil
+}
+
+func runUnblock(args []string) error {
+	entry, err := parseBlockHash(args[0])
+	if err != nil {
+		return err
+	}
+
+	removed, err := blocklist.Remove(context.Background(), entry.Hash)
+	recordAudit(AuditEntry{Actor: "cli", Action: "block-remove", Target: entry.Kind + ":" + entry.Hash, Result: auditResult(err)})
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("hash not in blocklist")
+	}
+	fmt.Printf("%d entries removed\n", removed)
+	return nil
+}
+
+// formatBytes форматирует размер в байтах для человека
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,26 +1,55 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Server configuration
-const (
+var (
 	ServerAddr = "0.0.0.0:8000"
+	BaseURL    = "https://screengu.ru" // публичный адрес сервиса для canonical, OG и sitemap
+
+	ReadHeaderTimeout = 10 * time.Second
+	ReadTimeout       = 5 * time.Minute // загрузка нескольких крупных файлов на медленном канале
+	WriteTimeout      = 5 * time.Minute
+	IdleTimeout       = 2 * time.Minute
+	ShutdownTimeout   = 30 * time.Second // время на завершение активных запросов при остановке
+	ShutdownDelay     = 5 * time.Second  // сколько /readyz отвечает 503 перед закрытием слушателей
 )
 
 // File system configuration
+var (
+	DataPath = "/data"
+)
+
 const (
-	DataPath       = "/data"
-	TemplatesPath  = "templates"
-	StaticPath     = "templates/static"
-	SecretFilePath = DataPath + "/.secret"
-	ChangelogPath  = "../changelog.md"
-	ChangelogURL   = "https://raw.githubusercontent.com/q0wqex/screenguru/main/changelog.md"
+	SecretFileName         = ".secret"
+	PreviousSecretFileName = ".secret.previous"
+	// QuarantineDirName — скрытый каталог в DataPath для изображений, снятых модератором
+	QuarantineDirName = ".quarantine"
 
 	DefaultFilePerm = 0755
+
+	// TempFilePrefix — префикс недописанных загрузок; такие файлы скрыты и не считаются изображениями
+	TempFilePrefix = ".upload-"
+)
+
+var (
+	// TemplatesDir — необязательный каталог, файлы которого перекрывают
+	// встроенные шаблоны, статику и changelog.md
+	TemplatesDir = ""
 )
 
 var (
@@ -34,42 +63,496 @@ var (
 		"image/png":  true,
 		"image/gif":  true,
 		"image/webp": true,
+		"image/bmp":  true,
+		"image/tiff": true,
+		"image/avif": true,
+		// SVG принимается только после очистки, см. sanitizeSVG
+		"image/svg+xml": true,
 	}
 
 	ImageExtensions = map[string]string{
-		"image/jpeg": "jpg",
-		"image/png":  "png",
-		"image/gif":  "gif",
-		"image/webp": "webp",
+		"image/jpeg":    "jpg",
+		"image/png":     "png",
+		"image/gif":     "gif",
+		"image/webp":    "webp",
+		"image/bmp":     "bmp",
+		"image/tiff":    "tiff",
+		"image/avif":    "avif",
+		"image/svg+xml": "svg",
+		// Ролики принимаются только при включенном VideoUploads
+		"video/mp4":  "mp4",
+		"video/webm": "webm",
 	}
 
 	// AppSecret is used to sign cookies. It's loaded on startup.
 	AppSecret []byte
+	// PreviousAppSecret — секрет до последней ротации; подписанные им cookie
+	// еще принимаются и переподписываются текущим
+	PreviousAppSecret []byte
 )
 
 // Session configuration
-const (
-	SessionCookieName = "session_id"
-	SessionMaxAge     = 86400 * 30 // 30 days
+var (
+	SessionCookieName   = "session_id"
+	SessionMaxAge       = 720 * time.Hour // 30 days
+	SessionCookieSecure = false
+	SessionSameSite     = http.SameSiteLaxMode
 )
 
 // Cleanup configuration
 var (
 	CleanupDuration = 720 * time.Hour // 30 days default
 	CleanupInterval = 24 * time.Hour  // 24 hours default
+	TempFileMaxAge  = time.Hour       // недописанные загрузки старше этого удаляются
 )
 
-// LoadConfig loads configuration from environment variables
-func LoadConfig() {
-	if maxSizeStr := os.Getenv("MAX_FILE_SIZE_MB"); maxSizeStr != "" {
-		if size, err := strconv.ParseInt(maxSizeStr, 10, 64); err == nil {
-			MaxFileSize = size * 1024 * 1024
+// PrintConfig — вывести итоговую конфигурацию и завершиться (флаг --print-config)
+var PrintConfig bool
+
+// setting описывает одну настройку. Значение задается по возрастанию приоритета:
+// значение по умолчанию, файл конфигурации, переменная окружения, флаг командной строки.
+type setting struct {
+	key        string     // ключ в файле конфигурации и имя флага
+	env        string     // переменная окружения
+	usage      string     // описание для --help
+	value      flag.Value // привязка к глобальной переменной
+	allowEmpty bool       // пустая переменная окружения — допустимое значение
+	secret     bool       // значение скрывается в --print-config
+}
+
+// settings возвращает реестр всех настроек приложения
+func settings() []setting {
+	list := []setting{
+		{key: "listen-addr", env: "LISTEN_ADDR", usage: "адрес HTTP сервера (host:port)", value: stringValue{&ServerAddr}},
+		{key: "base-url", env: "BASE_URL", usage: "публичный адрес сервиса", value: stringValue{&BaseURL}},
+		{key: "data-dir", env: "DATA_DIR", usage: "каталог хранения изображений", value: stringValue{&DataPath}},
+		{key: "templates-dir", env: "TEMPLATES_DIR", usage: "каталог, перекрывающий встроенные шаблоны и статику", value: stringValue{&TemplatesDir}},
+		{key: "max-file-size-mb", env: "MAX_FILE_SIZE_MB", usage: "лимит размера загрузки в МБ", value: megabytesValue{&MaxFileSize}},
+		{key: "cleanup-duration-hours", env: "CLEANUP_DURATION_HOURS", usage: "срок хранения файлов в часах", value: hoursValue{&CleanupDuration}},
+		{key: "cleanup-interval", env: "CLEANUP_INTERVAL", usage: "период запуска очистки", value: durationValue{&CleanupInterval}},
+		{key: "session-cookie-name", env: "SESSION_COOKIE_NAME", usage: "имя cookie сессии", value: stringValue{&SessionCookieName}},
+		{key: "session-max-age", env: "SESSION_MAX_AGE", usage: "время жизни cookie сессии", value: durationValue{&SessionMaxAge}},
+		{key: "cookie-secure", env: "COOKIE_SECURE", usage: "выставлять cookie только по HTTPS", value: boolValue{&SessionCookieSecure}},
+		{key: "cookie-samesite", env: "COOKIE_SAMESITE", usage: "атрибут SameSite cookie: lax, strict или none", value: sameSiteValue{&SessionSameSite}},
+		{key: "stats-reconcile-interval", env: "STATS_RECONCILE_INTERVAL", usage: "период сверки счетчиков с диском", value: durationValue{&StatsReconcileInterval}},
+		{key: "http-read-header-timeout", env: "HTTP_READ_HEADER_TIMEOUT", usage: "таймаут чтения заголовков запроса", value: durationValue{&ReadHeaderTimeout}},
+		{key: "http-read-timeout", env: "HTTP_READ_TIMEOUT", usage: "таймаут чтения запроса", value: durationValue{&ReadTimeout}},
+		{key: "http-write-timeout", env: "HTTP_WRITE_TIMEOUT", usage: "таймаут записи ответа", value: durationValue{&WriteTimeout}},
+		{key: "http-idle-timeout", env: "HTTP_IDLE_TIMEOUT", usage: "таймаут простоя keep-alive соединения", value: durationValue{&IdleTimeout}},
+		{key: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT", usage: "время на завершение активных запросов при остановке", value: durationValue{&ShutdownTimeout}},
+		{key: "shutdown-delay", env: "SHUTDOWN_DELAY", usage: "сколько /readyz отвечает 503 перед остановкой сервера (0 — не ждать)", value: optionalDurationValue{&ShutdownDelay}},
+	}
+
+	for _, class := range []string{LimitUpload, LimitAlbum, LimitDelete, LimitPage, LimitFile, LimitAdmin, LimitReport} {
+		list = append(list, setting{
+			key:   "rate-limit-" + class,
+			env:   "RATE_LIMIT_" + strings.ToUpper(class),
+			usage: "бюджет лимитера " + class + ": запросов_в_минуту:ёмкость, 0 отключает",
+			value: rateLimitValue{class},
+		})
+	}
+
+	return append(list,
+		setting{key: "rate-limit-max-entries", env: "RATE_LIMIT_MAX_ENTRIES", usage: "максимум отслеживаемых ключей лимитера", value: intValue{&MaxRateLimitEntries}},
+		setting{key: "trusted-proxies", env: "TRUSTED_PROXIES", usage: "доверенные прокси (CIDR через запятую)", value: cidrsValue{&TrustedProxies}, allowEmpty: true},
+		setting{key: "min-free-disk-mb", env: "MIN_FREE_DISK_MB", usage: "минимум свободного места в data-dir для /readyz, МБ", value: megabytesValue{&MinFreeDiskBytes}},
+		setting{key: "metrics-addr", env: "METRICS_ADDR", usage: "отдельный адрес для /metrics (пусто — основной сервер)", value: stringValue{&MetricsAddr}},
+		setting{key: "metrics-token", env: "METRICS_TOKEN", usage: "Bearer-токен для доступа к /metrics", value: stringValue{&MetricsToken}, secret: true},
+		setting{key: "max-image-dimension", env: "MAX_IMAGE_DIMENSION", usage: "максимальная ширина и высота загружаемого изображения, px", value: intValue{&MaxImageDimension}},
+		setting{key: "max-image-pixels", env: "MAX_IMAGE_PIXELS", usage: "максимальная площадь загружаемого изображения, px", value: intValue{&MaxImagePixels}},
+		setting{key: "image-decode-timeout", env: "IMAGE_DECODE_TIMEOUT", usage: "время на проверочное декодирование загрузки", value: durationValue{&ImageDecodeTimeout}},
+		setting{key: "image-decode-memory-mb", env: "IMAGE_DECODE_MEMORY_MB", usage: "предел памяти под пиксели одного декодируемого изображения, МБ", value: megabytesValue{&ImageDecodeMemory}},
+		setting{key: "convert-bmp-tiff", env: "CONVERT_BMP_TIFF", usage: "сохранять BMP и TIFF как PNG", value: boolValue{&ConvertBMPTIFF}},
+		setting{key: "reencode-policy", env: "REENCODE_POLICY", usage: "перекодирование загрузок: keep, lossless (PNG и GIF) или jpeg (плюс крупные фото в JPEG)", value: reencodePolicyValue{&ReencodePolicy}},
+		setting{key: "reencode-jpeg-quality", env: "REENCODE_JPEG_QUALITY", usage: "качество JPEG при конвертации фотографий (1–100)", value: intValue{&ReencodeJPEGQuality}},
+		setting{key: "reencode-jpeg-min-pixels", env: "REENCODE_JPEG_MIN_PIXELS", usage: "площадь фотографии, начиная с которой она конвертируется в JPEG, px", value: intValue{&ReencodeJPEGMinPixels}},
+		setting{key: "video-uploads", env: "VIDEO_UPLOADS", usage: "принимать ролики MP4 и WebM", value: boolValue{&VideoUploads}},
+		setting{key: "video-max-size-mb", env: "VIDEO_MAX_SIZE_MB", usage: "лимит размера ролика в МБ", value: megabytesValue{&MaxVideoSize}},
+		setting{key: "blocklist-phash-distance", env: "BLOCKLIST_PHASH_DISTANCE", usage: "расстояние Хэмминга (0–32), при котором перцептивный хеш совпадает с заблокированным", value: intValue{&BlocklistPHashDistance}},
+		setting{key: "similar-phash-distance", env: "SIMILAR_PHASH_DISTANCE", usage: "расстояние Хэмминга (0–32), при котором изображения считаются похожими", value: intValue{&SimilarPHashDistance}},
+		setting{key: "scanner-command", env: "SCANNER_COMMAND", usage: "программа проверки загрузок; путь к файлу передается последним аргументом", value: stringValue{&ScannerCommand}},
+		setting{key: "scanner-url", env: "SCANNER_URL", usage: "адрес HTTP сервиса проверки загрузок", value: stringValue{&ScannerURL}},
+		setting{key: "scanner-token", env: "SCANNER_TOKEN", usage: "Bearer-токен для scanner-url", value: stringValue{&ScannerToken}, secret: true},
+		setting{key: "scanner-timeout", env: "SCANNER_TIMEOUT", usage: "таймаут одной проверки", value: durationValue{&ScannerTimeout}},
+		setting{key: "scanner-fail-open", env: "SCANNER_FAIL_OPEN", usage: "публиковать загрузку, если сканер недоступен (иначе отклонять)", value: boolValue{&ScannerFailOpen}},
+		setting{key: "webhook-timeout", env: "WEBHOOK_TIMEOUT", usage: "таймаут одной доставки вебхука", value: durationValue{&WebhookTimeout}},
+		setting{key: "webhook-max-attempts", env: "WEBHOOK_MAX_ATTEMPTS", usage: "число попыток доставки вебхука", value: intValue{&WebhookMaxAttempts}},
+		setting{key: "webhook-allow-private", env: "WEBHOOK_ALLOW_PRIVATE", usage: "разрешить вебхукам пользователей локальные и внутренние адреса", value: boolValue{&WebhookAllowPrivate}},
+		setting{key: "transform-sizes", env: "TRANSFORM_SIZES", usage: "допустимые w и h преобразований через запятую (пусто — преобразования отключены)", value: intsValue{&TransformSizes}, allowEmpty: true},
+		setting{key: "transform-cache-mb", env: "TRANSFORM_CACHE_MB", usage: "предел кеша преобразованных изображений, МБ", value: megabytesValue{&TransformCacheSize}},
+		setting{key: "image-version-retention", env: "IMAGE_VERSION_RETENTION", usage: "срок хранения прежних версий отредактированных изображений", value: durationValue{&ImageVersionRetention}},
+		setting{key: "watermark-logo", env: "WATERMARK_LOGO", usage: "PNG-логотип, который владельцы могут выбрать водяным знаком альбома", value: stringValue{&WatermarkLogo}},
+		setting{key: "admin-user", env: "ADMIN_USER", usage: "логин раздела /admin", value: stringValue{&AdminUser}},
+		setting{key: "admin-password", env: "ADMIN_PASSWORD", usage: "пароль раздела /admin (пусто — раздел отключен)", value: stringValue{&AdminPassword}, secret: true},
+		setting{key: "log-level", env: "LOG_LEVEL", usage: "уровень логирования: debug, info, warn или error", value: logLevelValue{&LogLevel}},
+		setting{key: "log-format", env: "LOG_FORMAT", usage: "формат логов: text или json", value: logFormatValue{&LogFormat}},
+		setting{key: "debug", env: "DEBUG", usage: "подробное логирование (то же, что log-level = debug)", value: boolValue{&LogDebug}},
+	)
+}
+
+// LoadConfig загружает конфигурацию из файла, переменных окружения и флагов и проверяет ее
+func LoadConfig(args []string) error {
+	return loadConfigFlags(flag.NewFlagSet("screenguru", flag.ContinueOnError), args)
+}
+
+// loadConfigFlags — LoadConfig с заранее подготовленным набором флагов,
+// в котором команды CLI регистрируют собственные флаги
+func loadConfigFlags(flags *flag.FlagSet, args []string) error {
+	registry := settings()
+
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "файл конфигурации (строки key = value)")
+	flags.BoolVar(&PrintConfig, "print-config", false, "вывести итоговую конфигурацию и выйти")
+
+	// Флаги запоминаются и применяются последними, после файла и окружения
+	flagValues := make([]*pendingValue, len(registry))
+	for i, s := range registry {
+		flagValues[i] = &pendingValue{target: s.value}
+		flags.Var(flagValues[i], s.key, s.usage+" (env "+s.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var errs []error
+
+	if *configPath != "" {
+		errs = append(errs, loadConfigFile(*configPath, registry)...)
+	}
+
+	for _, s := range registry {
+		value, ok := os.LookupEnv(s.env)
+		if !ok || (value == "" && !s.allowEmpty) {
+			continue
+		}
+		if err := s.value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+		}
+	}
+
+	for i, s := range registry {
+		if !flagValues[i].set {
+			continue
+		}
+		if err := s.value.Set(flagValues[i].raw); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", s.key, err))
+		}
+	}
+
+	errs = append(errs, validateConfig())
+	return errors.Join(errs...)
+}
+
+// loadConfigFile применяет настройки из файла вида "key = value" с комментариями через #
+func loadConfigFile(path string, registry []setting) []error {
+	file, err := os.Open(path)
+	if err != nil {
+		return []error{fmt.Errorf("config file: %w", err)}
+	}
+	defer file.Close()
+
+	byKey := make(map[string]flag.Value, len(registry))
+	for _, s := range registry {
+		byKey[s.key] = s.value
+	}
+
+	var errs []error
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		target, known := byKey[key]
+		switch {
+		case !found:
+			errs = append(errs, fmt.Errorf("%s:%d: expected key = value", path, lineNum))
+		case !known:
+			errs = append(errs, fmt.Errorf("%s:%d: unknown setting %q", path, lineNum, key))
+		default:
+			if err := target.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %s: %w", path, lineNum, key, err))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("config file: %w", err))
+	}
+	return errs
+}
+
+// validateConfig проверяет согласованность итоговых значений
+func validateConfig() error {
+	var errs []error
+
+	if _, port, err := net.SplitHostPort(ServerAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen-addr: %w", err))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs = append(errs, fmt.Errorf("listen-addr: invalid port %q", port))
+	}
+
+	if u, err := url.Parse(BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("base-url: %q must be an absolute http(s) URL", BaseURL))
+	}
+	BaseURL = strings.TrimRight(BaseURL, "/")
+
+	if DataPath == "" {
+		errs = append(errs, errors.New("data-dir: must not be empty"))
+	} else if info, err := os.Stat(DataPath); err == nil && !info.IsDir() {
+		errs = append(errs, fmt.Errorf("data-dir: %s is not a directory", DataPath))
+	}
+	DataPath = filepath.Clean(DataPath)
+
+	if TemplatesDir != "" {
+		if info, err := os.Stat(TemplatesDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("templates-dir: %s is not a directory", TemplatesDir))
+		}
+	}
+
+	if WatermarkLogo != "" {
+		if _, err := loadWatermarkLogo(); err != nil {
+			errs = append(errs, fmt.Errorf("watermark-logo: %w", err))
+		}
+	}
+
+	if AdminPassword != "" && AdminUser == "" {
+		errs = append(errs, errors.New("admin-user: must not be empty when admin-password is set"))
+	}
+
+	if SessionCookieName == "" || strings.ContainsAny(SessionCookieName, " \t;,=\"") {
+		errs = append(errs, fmt.Errorf("session-cookie-name: %q is not a valid cookie name", SessionCookieName))
+	}
+
+	if MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(MetricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("metrics-addr: %w", err))
+		} else if MetricsAddr == ServerAddr {
+			errs = append(errs, errors.New("metrics-addr: must differ from listen-addr"))
+		}
+	}
+
+	if ScannerCommand != "" && ScannerURL != "" {
+		errs = append(errs, errors.New("scanner-command: cannot be combined with scanner-url"))
+	}
+	if ScannerURL != "" {
+		if u, err := url.Parse(ScannerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("scanner-url: %q must be an absolute http(s) URL", ScannerURL))
 		}
 	}
 
-	if cleanupHoursStr := os.Getenv("CLEANUP_DURATION_HOURS"); cleanupHoursStr != "" {
-		if hours, err := strconv.Atoi(cleanupHoursStr); err == nil {
-			CleanupDuration = time.Duration(hours) * time.Hour
+	if WebhookMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhook-max-attempts: %d must be at least 1", WebhookMaxAttempts))
+	}
+
+	if ReencodeJPEGQuality < 1 || ReencodeJPEGQuality > 100 {
+		errs = append(errs, fmt.Errorf("reencode-jpeg-quality: %d is out of range 1..100", ReencodeJPEGQuality))
+	}
+
+	if BlocklistPHashDistance < 0 || BlocklistPHashDistance > 32 {
+		errs = append(errs, fmt.Errorf("blocklist-phash-distance: %d is out of range 0..32", BlocklistPHashDistance))
+	}
+	if SimilarPHashDistance < 0 || SimilarPHashDistance > 32 {
+		errs = append(errs, fmt.Errorf("similar-phash-distance: %d is out of range 0..32", SimilarPHashDistance))
+	}
+
+	if SessionSameSite == http.SameSiteNoneMode && !SessionCookieSecure {
+		errs = append(errs, errors.New("cookie-samesite: none requires cookie-secure = true"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// printConfig выводит итоговую конфигурацию в формате файла конфигурации
+func printConfig(w io.Writer) {
+	for _, s := range settings() {
+		value := s.value.String()
+		if s.secret && value != "" {
+			value = "********"
 		}
+		fmt.Fprintf(w, "%s = %s\n", s.key, value)
+	}
+}
+
+// pendingValue запоминает значение флага до применения остальных источников
+type pendingValue struct {
+	target flag.Value
+	raw    string
+	set    bool
+}
+
+func (v *pendingValue) String() string {
+	if v.target == nil {
+		return ""
+	}
+	return v.target.String()
+}
+
+func (v *pendingValue) Set(value string) error {
+	v.raw, v.set = value, true
+	return nil
+}
+
+// Типы значений настроек. Set проверяет и применяет значение, String возвращает текущее.
+
+type stringValue struct{ p *string }
+
+func (v stringValue) String() string { return *v.p }
+func (v stringValue) Set(value string) error {
+	*v.p = strings.TrimSpace(value)
+	return nil
+}
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) String() string { return strconv.FormatBool(*v.p) }
+func (v boolValue) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", value)
+	}
+	*v.p = b
+	return nil
+}
+
+type intValue struct{ p *int }
+
+func (v intValue) String() string { return strconv.Itoa(*v.p) }
+func (v intValue) Set(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("expected a positive integer, got %q", value)
+	}
+	*v.p = n
+	return nil
+}
+
+type intsValue struct{ p *[]int }
+
+func (v intsValue) String() string { return intsString(*v.p) }
+func (v intsValue) Set(value string) error {
+	var values []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("expected a comma-separated list of positive integers, got %q", value)
+		}
+		values = append(values, n)
+	}
+	*v.p = values
+	return nil
+}
+
+type durationValue struct{ p *time.Duration }
+
+func (v durationValue) String() string { return v.p.String() }
+func (v durationValue) Set(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("expected a positive duration like 30s or 24h, got %q", value)
+	}
+	*v.p = d
+	return nil
+}
+
+// optionalDurationValue — длительность, которую можно выключить значением 0
+type optionalDurationValue struct{ p *time.Duration }
+
+func (v optionalDurationValue) String() string { return v.p.String() }
+func (v optionalDurationValue) Set(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return fmt.Errorf("expected a duration like 5s or 0, got %q", value)
+	}
+	*v.p = d
+	return nil
+}
+
+type hoursValue struct{ p *time.Duration }
+
+func (v hoursValue) String() string { return strconv.Itoa(int(v.p.Hours())) }
+func (v hoursValue) Set(value string) error {
+	hours, err := strconv.Atoi(value)
+	if err != nil || hours <= 0 {
+		return fmt.Errorf("expected a positive number of hours, got %q", value)
+	}
+	*v.p = time.Duration(hours) * time.Hour
+	return nil
+}
+
+type megabytesValue struct{ p *int64 }
+
+func (v megabytesValue) String() string { return strconv.FormatInt(*v.p/(1024*1024), 10) }
+func (v megabytesValue) Set(value string) error {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("expected a positive number of megabytes, got %q", value)
+	}
+	*v.p = size * 1024 * 1024
+	return nil
+}
+
+type sameSiteValue struct{ p *http.SameSite }
+
+func (v sameSiteValue) String() string {
+	switch *v.p {
+	case http.SameSiteStrictMode:
+		return "strict"
+	case http.SameSiteNoneMode:
+		return "none"
+	default:
+		return "lax"
+	}
+}
+func (v sameSiteValue) Set(value string) error {
+	switch strings.ToLower(value) {
+	case "lax":
+		*v.p = http.SameSiteLaxMode
+	case "strict":
+		*v.p = http.SameSiteStrictMode
+	case "none":
+		*v.p = http.SameSiteNoneMode
+	default:
+		return fmt.Errorf("expected lax, strict or none, got %q", value)
+	}
+	return nil
+}
+
+type rateLimitValue struct{ class string }
+
+func (v rateLimitValue) String() string {
+	limit := RateLimits[v.class]
+	return strconv.FormatFloat(limit.PerMinute, 'f', -1, 64) + ":" + strconv.Itoa(limit.Burst)
+}
+func (v rateLimitValue) Set(value string) error {
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		return err
+	}
+	RateLimits[v.class] = limit
+	return nil
+}
+
+type cidrsValue struct{ p *[]*net.IPNet }
+
+func (v cidrsValue) String() string {
+	var parts []string
+	for _, network := range *v.p {
+		parts = append(parts, network.String())
+	}
+	return strings.Join(parts, ",")
+}
+func (v cidrsValue) Set(value string) error {
+	networks, err := parseCIDRs(value)
+	if err != nil {
+		return err
 	}
+	*v.p = networks
+	return nil
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CSRF configuration
+const (
+	CSRFHeaderName = "X-CSRF-Token"
+	CSRFFormField  = "csrf_token"
+)
+
+// csrfToken возвращает CSRF-токен, привязанный к сессии пользователя.
+// Токен не хранится на сервере: это HMAC от ID сессии, поэтому его
+// невозможно подобрать без AppSecret, а проверка не требует состояния.
+func csrfToken(sessionID string) string {
+	return SignData("csrf:" + sessionID)
+}
+
+// apiToken возвращает API-токен сессии для заголовка Authorization: Bearer.
+// Как и cookie сессии, токен — ID с подписью и проверяется без хранения.
+func apiToken(sessionID string) string {
+	return sessionID + "." + SignData("api:"+sessionID)
+}
+
+// readAPIToken возвращает ID сессии из действительного API-токена запроса
+func readAPIToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	sessionID, signature, ok := strings.Cut(token, ".")
+	if !ok || !validStorageID(sessionID) || !VerifyData("api:"+sessionID, signature) {
+		return "", false
+	}
+	return sessionID, true
+}
+
+// readSessionID возвращает ID сессии из API-токена или подписанной cookie, не создавая новую
+func readSessionID(r *http.Request) (string, bool) {
+	if sessionID, ok := readAPIToken(r); ok {
+		return sessionID, true
+	}
+
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+
+	parts := strings.Split(cookie.Value, ":")
+	if len(parts) != 2 || !VerifyData(parts[0], parts[1]) {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// requestCSRFToken извлекает CSRF-токен из заголовка или поля формы
+func requestCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(CSRFHeaderName); token != "" {
+		return token
+	}
+	return r.FormValue(CSRFFormField)
+}
+
+// csrfProtect оборачивает обработчик проверкой CSRF-токена для POST запросов.
+// Запросы с API-токеном не проверяются: браузер не подставляет заголовок
+// Authorization сам, а чужая страница не может отправить его без CORS.
+func csrfProtect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := readAPIToken(r); ok || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		sessionID, ok := readSessionID(r)
+		if !ok {
+			logger.DebugContext(r.Context(), "csrf rejected: no valid session cookie", "path", r.URL.Path)
+			ErrorResponseCode(w, http.StatusForbidden, "csrf_session_missing", "Session required")
+			return
+		}
+
+		if !VerifyData("csrf:"+sessionID, requestCSRFToken(r)) {
+			logger.DebugContext(r.Context(), "csrf rejected: invalid token", "path", r.URL.Path)
+			ErrorResponseCode(w, http.StatusForbidden, "csrf_token_invalid", "Invalid CSRF token")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// apiTokenHandler выдает API-токен текущей сессии
+func apiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	SuccessResponse(w, map[string]string{"token": apiToken(getSessionID(w, r))})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// sessionRequest собирает запрос с подписанной cookie сессии
+func sessionRequest(method, sessionID string, form url.Values) *http.Request {
+	req := httptest.NewRequest(method, "/delete-album", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if sessionID != "" {
+		req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: sessionID + ":" + SignData(sessionID)})
+	}
+	return req
+}
+
+func TestCSRFProtect(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode string // пусто, если запрос пропускается
+	}{
+		{"missing token", sessionRequest("POST", "alice", nil), "csrf_token_invalid"},
+		{"no session", sessionRequest("POST", "", url.Values{CSRFFormField: {csrfToken("alice")}}), "csrf_session_missing"},
+		{"token of another session", sessionRequest("POST", "alice", url.Values{CSRFFormField: {csrfToken("bob")}}), "csrf_token_invalid"},
+		{"valid form field", sessionRequest("POST", "alice", url.Values{CSRFFormField: {csrfToken("alice")}}), ""},
+		{"valid header", func() *http.Request {
+			req := sessionRequest("POST", "alice", nil)
+			req.Header.Set(CSRFHeaderName, csrfToken("alice"))
+			return req
+		}(), ""},
+		{"get passthrough", sessionRequest("GET", "alice", nil), ""},
+		{"api token", func() *http.Request {
+			req := sessionRequest("POST", "", nil)
+			req.Header.Set("Authorization", "Bearer "+apiToken("alice"))
+			return req
+		}(), ""},
+		{"forged api token", func() *http.Request {
+			req := sessionRequest("POST", "alice", nil)
+			req.Header.Set("Authorization", "Bearer alice."+csrfToken("alice"))
+			return req
+		}(), "csrf_token_invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			rec := httptest.NewRecorder()
+			csrfProtect(func(w http.ResponseWriter, r *http.Request) { called = true })(rec, tt.req)
+
+			if tt.wantCode == "" {
+				if !called || rec.Code != http.StatusOK {
+					t.Errorf("handler called = %v, status %d; want request passed through", called, rec.Code)
+				}
+				return
+			}
+			if called {
+				t.Fatal("handler called for a rejected request")
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusForbidden || body.Code != tt.wantCode {
+				t.Errorf("got %d %q, want 403 %q", rec.Code, body.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAPITokenAuthenticatesSession(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+apiToken("alice"))
+	rec := httptest.NewRecorder()
+	if got := getSessionID(rec, req); got != "alice" {
+		t.Errorf("getSessionID() = %q, want alice", got)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("API request got a session cookie %v", cookies[0])
+	}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
+)
+
+// VersionsDirName — скрытый каталог в DataPath с прежними версиями
+// отредактированных изображений: .versions/<user>/<album>/<file>/<version>
+const VersionsDirName = ".versions"
+
+// ImageVersionRetention — сколько хранится прежняя версия изображения после правки
+var ImageVersionRetention = 7 * 24 * time.Hour
+
+const (
+	// maxImageVersions — предел прежних версий одного изображения; старшие удаляются
+	maxImageVersions = 10
+	// maxEditRects — предел прямоугольников в одной правке
+	maxEditRects = 50
+	// editJPEGQuality — качество JPEG после правки; выше, чем при конвертации
+	// загрузок, потому что изображение может редактироваться несколько раз
+	editJPEGQuality = 92
+)
+
+// Операции редактирования
+const (
+	EditRotate   = "rotate"
+	EditCrop     = "crop"
+	EditBlackout = "blackout"
+	EditPixelate = "pixelate"
+)
+
+// errNotEditable — формат или изображение нельзя отредактировать на сервере
+var errNotEditable = errors.New("image cannot be edited")
+
+// isEditableFile сообщает, что формат файла по расширению можно редактировать;
+// шаблоны показывают для него кнопку правки
+func isEditableFile(filename string) bool {
+	switch GetFileExtension(filename) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff":
+		return true
+	}
+	return false
+}
+
+// imageEdit — разобранная правка. Координаты — в пикселях изображения в том
+// виде, в каком его показывает браузер (после поворота по EXIF).
+type imageEdit struct {
+	Op    string
+	Angle int // поворот по часовой стрелке: 90, 180 или 270
+	Rects []image.Rectangle
+}
+
+// parseImageEdit проверяет параметры правки из формы
+func parseImageEdit(form map[string][]string) (imageEdit, error) {
+	value := func(key string) string {
+		if values := form[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	edit := imageEdit{Op: value("op")}
+	switch edit.Op {
+	case EditRotate:
+		angle, err := strconv.Atoi(value("angle"))
+		if err != nil || (angle != 90 && angle != 180 && angle != 270) {
+			return edit, errors.New("angle must be 90, 180 or 270")
+		}
+		edit.Angle = angle
+		return edit, nil
+	case EditCrop, EditBlackout, EditPixelate:
+	default:
+		return edit, errors.New("op must be rotate, crop, blackout or pixelate")
+	}
+
+	rects := form["rect"]
+	if len(rects) == 0 {
+		return edit, errors.New("rect required")
+	}
+	if edit.Op == EditCrop && len(rects) > 1 {
+		return edit, errors.New("crop takes a single rect")
+	}
+	if len(rects) > maxEditRects {
+		return edit, fmt.Errorf("at most %d rects per edit", maxEditRects)
+	}
+	for _, rect := range rects {
+		parts := strings.Split(rect, ",")
+		if len(parts) != 4 {
+			return edit, fmt.Errorf("rect %q must be x,y,width,height", rect)
+		}
+		var n [4]int
+		for i, part := range parts {
+			v, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || v < 0 {
+				return edit, fmt.Errorf("rect %q must be x,y,width,height", rect)
+			}
+			n[i] = v
+		}
+		if n[2] == 0 || n[3] == 0 {
+			return edit, fmt.Errorf("rect %q is empty", rect)
+		}
+		edit.Rects = append(edit.Rects, image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]))
+	}
+	return edit, nil
+}
+
+// apply применяет правку к изображению с началом координат в (0, 0)
+func (e imageEdit) apply(img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	switch e.Op {
+	case EditRotate:
+		// Поворот задается тегами EXIF Orientation: 6 — 90°, 3 — 180°, 8 — 270°
+		return applyOrientation(img, map[int]int{90: 6, 180: 3, 270: 8}[e.Angle]), nil
+	case EditCrop:
+		crop := e.Rects[0].Intersect(bounds)
+		if crop.Empty() {
+			return nil, fmt.Errorf("%w: crop rect is outside the image", errNotEditable)
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+		draw.Draw(dst, dst.Bounds(), img, crop.Min, draw.Src)
+		return dst, nil
+	}
+
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	// Крупные блоки: мелкую пикселизацию текста можно прочитать
+	block := max(12, min(bounds.Dx(), bounds.Dy())/40)
+	for _, rect := range e.Rects {
+		rect = rect.Intersect(bounds)
+		if rect.Empty() {
+			continue
+		}
+		if e.Op == EditBlackout {
+			draw.Draw(dst, rect, image.Black, image.Point{}, draw.Src)
+		} else {
+			pixelate(dst, rect, block)
+		}
+	}
+	return dst, nil
+}
+
+// pixelate заменяет каждый блок block×block внутри rect его средним цветом
+func pixelate(img *image.RGBA, rect image.Rectangle, block int) {
+	for by := rect.Min.Y; by < rect.Max.Y; by += block {
+		for bx := rect.Min.X; bx < rect.Max.X; bx += block {
+			cell := image.Rect(bx, by, bx+block, by+block).Intersect(rect)
+			var sum [4]int
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					c := img.RGBAAt(x, y)
+					sum[0] += int(c.R)
+					sum[1] += int(c.G)
+					sum[2] += int(c.B)
+					sum[3] += int(c.A)
+				}
+			}
+			n := cell.Dx() * cell.Dy()
+			avg := color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+			draw.Draw(img, cell, image.NewUniform(avg), image.Point{}, draw.Src)
+		}
+	}
+}
+
+// imageEditLocks сериализует правки одного изображения
+var imageEditLocks sync.Map // путь изображения -> *sync.Mutex
+
+func lockImageEdit(path string) func() {
+	value, _ := imageEditLocks.LoadOrStore(path, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// editImage применяет правку и сохраняет результат по тому же адресу в том же
+// формате. Прежний файл становится версией, которую можно восстановить в
+// течение ImageVersionRetention. Метаданные (EXIF) не переносятся, поворот
+// из EXIF применяется к пикселям.
+func editImage(ctx context.Context, userID, albumID, filename string, edit imageEdit) (ImageInfo, error) {
+	path := imagePath(userID, albumID, filename)
+	unlock := lockImageEdit(path)
+	defer unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer file.Close()
+
+	config, format, err := image.DecodeConfig(file)
+	if err != nil || !slices.Contains([]string{"jpeg", "png", "gif", "bmp", "tiff"}, format) {
+		return ImageInfo{}, fmt.Errorf("%w: only JPEG, PNG, GIF, BMP and TIFF can be edited", errNotEditable)
+	}
+	if config.Width*config.Height > maxTransformPixels {
+		return ImageInfo{}, fmt.Errorf("%w: image too large: %dx%d", errNotEditable, config.Width, config.Height)
+	}
+
+	select {
+	case decodeSlots <- struct{}{}:
+		defer func() { <-decodeSlots }()
+	case <-ctx.Done():
+		return ImageInfo{}, ctx.Err()
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return ImageInfo{}, err
+	}
+	var img image.Image
+	if format == "gif" {
+		animation, err := gif.DecodeAll(file)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		if len(animation.Image) > 1 {
+			return ImageInfo{}, fmt.Errorf("%w: animated GIF", errNotEditable)
+		}
+		// Кадр может занимать часть холста GIF
+		canvas := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+		frame := animation.Image[0]
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+		img = canvas
+	} else if img, _, err = image.Decode(file); err != nil {
+		return ImageInfo{}, err
+	}
+	orientation, err := displayOrientation(file, format)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	edited, err := edit.apply(applyOrientation(img, orientation))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	data, err := encodeEdited(edited, format)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	if err := replaceImage(ctx, userID, albumID, filename, file, bytes.NewReader(data)); err != nil {
+		return ImageInfo{}, err
+	}
+	return reindexEdited(ctx, userID, albumID, filename)
+}
+
+// encodeEdited кодирует результат правки в формат исходника
+func encodeEdited(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: editJPEGQuality})
+	case "png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, &gif.Options{NumColors: 256, Drawer: draw.FloydSteinberg})
+	case "bmp":
+		err = bmp.Encode(&buf, img)
+	case "tiff":
+		err = tiff.Encode(&buf, img, &tiff.Options{Compression: tiff.Deflate})
+	default:
+		err = errNotEditable
+	}
+	return buf.Bytes(), err
+}
+
+// replaceImage сохраняет текущий файл как версию и атомарно заменяет его новым
+// содержимым; копии в кеше преобразований удаляются
+func replaceImage(ctx context.Context, userID, albumID, filename string, current io.ReadSeeker, replacement io.Reader) error {
+	path := imagePath(userID, albumID, filename)
+	before, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if _, err := current.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := saveImageVersion(userID, albumID, filename, current); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, replacement); err != nil {
+		return err
+	}
+	purgeTransforms(ctx, userID, albumID, filename)
+
+	if after, err := os.Stat(path); err == nil {
+		stats.Removed(StorageStats{Bytes: before.Size() - after.Size()})
+		emitImageEvent(EventImageEdited, userID, albumID, filename, after.Size())
+	}
+	return nil
+}
+
+// reindexEdited обновляет запись индекса после замены файла. Время загрузки
+// сохраняется, чтобы изображение осталось на своем месте в альбоме.
+func reindexEdited(ctx context.Context, userID, albumID, filename string) (ImageInfo, error) {
+	meta, err := readImageMeta(imagePath(userID, albumID, filename))
+	if err != nil {
+		return meta, err
+	}
+	if previous, ok := readAlbumIndex(ctx, userID, albumID)[filename]; ok {
+		meta.UploadedAt = previous.UploadedAt
+	}
+	indexImage(ctx, userID, albumID, meta)
+	return meta, nil
+}
+
+// Версии
+
+func imageVersionsDir(userID, albumID, filename string) string {
+	return filepath.Join(DataPath, VersionsDirName, userID, albumID, filename)
+}
+
+// ImageVersion — прежняя версия изображения
+type ImageVersion struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// saveImageVersion записывает содержимое как новую версию изображения и
+// удаляет самые старые версии сверх maxImageVersions
+func saveImageVersion(userID, albumID, filename string, content io.Reader) error {
+	dir := imageVersionsDir(userID, albumID, filename)
+	if err := EnsureDir(dir); err != nil {
+		return err
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := writeFileAtomic(filepath.Join(dir, id), content); err != nil {
+		return err
+	}
+
+	versions, err := listImageVersions(userID, albumID, filename)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions[min(len(versions), maxImageVersions):] {
+		os.Remove(filepath.Join(dir, version.ID))
+	}
+	return nil
+}
+
+// listImageVersions возвращает версии изображения от новых к старым
+func listImageVersions(userID, albumID, filename string) ([]ImageVersion, error) {
+	entries, err := os.ReadDir(imageVersionsDir(userID, albumID, filename))
+	if os.IsNotExist(err) {
+		return []ImageVersion{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	versions := []ImageVersion{}
+	for _, entry := range entries {
+		nanos, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, ImageVersion{ID: entry.Name(), CreatedAt: time.Unix(0, nanos).UTC(), Size: info.Size()})
+	}
+	slices.SortFunc(versions, func(a, b ImageVersion) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return versions, nil
+}
+
+// imageVersionPath возвращает путь версии; ID — только цифры, чтобы не выйти за каталог
+func imageVersionPath(userID, albumID, filename, id string) (string, bool) {
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", false
+	}
+	return filepath.Join(imageVersionsDir(userID, albumID, filename), id), true
+}
+
+// restoreImageVersion возвращает изображению прежнюю версию. Текущий файл сам
+// становится версией, поэтому восстановление тоже можно отменить.
+func restoreImageVersion(ctx context.Context, userID, albumID, filename, id string) (ImageInfo, error) {
+	versionPath, ok := imageVersionPath(userID, albumID, filename, id)
+	if !ok {
+		return ImageInfo{}, os.ErrNotExist
+	}
+	path := imagePath(userID, albumID, filename)
+	unlock := lockImageEdit(path)
+	defer unlock()
+
+	version, err := os.Open(versionPath)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer version.Close()
+	current, err := os.Open(path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer current.Close()
+
+	if err := replaceImage(ctx, userID, albumID, filename, current, version); err != nil {
+		return ImageInfo{}, err
+	}
+	os.Remove(versionPath)
+	return reindexEdited(ctx, userID, albumID, filename)
+}
+
+// purgeImageVersions удаляет версии изображения, альбома (filename == "") или
+// пользователя (albumID == ""), чтобы удаленное нельзя было восстановить
+func purgeImageVersions(ctx context.Context, userID, albumID, filename string) {
+	root := filepath.Join(DataPath, VersionsDirName)
+	dir := filepath.Join(root, userID, albumID, filename)
+	if dir == root {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		logger.WarnContext(ctx, "failed to purge image versions", "path", dir, "error", err)
+	}
+	removeEmptyParents(filepath.Dir(dir), root)
+}
+
+// pruneImageVersions удаляет версии старше ImageVersionRetention
+func pruneImageVersions(ctx context.Context, opts cleanupOptions) error {
+	root := filepath.Join(DataPath, VersionsDirName)
+	var expired []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			stale := strings.HasPrefix(entry.Name(), TempFilePrefix) && time.Since(info.ModTime()) > TempFileMaxAge
+			if stale || time.Since(info.ModTime()) > ImageVersionRetention {
+				expired = append(expired, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range expired {
+		if !opts.DryRun {
+			if err := os.Remove(path); err != nil {
+				logger.Error("failed to remove expired image version", "path", path, "error", err)
+				continue
+			}
+			removeEmptyParents(filepath.Dir(path), root)
+		}
+		if opts.OnRemove != nil {
+			opts.OnRemove(path)
+		}
+	}
+	if len(expired) > 0 && !opts.DryRun {
+		logger.Info("cleanup deleted expired image versions", "count", len(expired))
+	}
+	return nil
+}
+
+// Обработчики
+
+// editTarget проверяет album_id и filename запроса и наличие изображения у владельца
+func editTarget(w http.ResponseWriter, r *http.Request) (sessionID, albumID, filename string, ok bool) {
+	sessionID = getSessionID(w, r)
+	albumID, filename = r.FormValue("album_id"), r.FormValue("filename")
+	if !validStorageID(albumID) || !validStorageID(filename) || !IsImageFile(filename) {
+		ErrorResponseCode(w, http.StatusBadRequest, "invalid_image", "album_id and filename required")
+		return "", "", "", false
+	}
+	if _, err := os.Stat(imagePath(sessionID, albumID, filename)); err != nil {
+		ErrorResponseCode(w, http.StatusNotFound, "image_not_found", "Image not found")
+		return "", "", "", false
+	}
+	return sessionID, albumID, filename, true
+}
+
+// editImageHandler поворачивает, обрезает или закрашивает области изображения владельца
+func editImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID, albumID, filename, ok := editTarget(w, r)
+	if !ok {
+		return
+	}
+	edit, err := parseImageEdit(r.PostForm)
+	if err != nil {
+		ErrorResponseCode(w, http.StatusBadRequest, "invalid_edit", err.Error())
+		return
+	}
+
+	info, err := editImage(r.Context(), sessionID, albumID, filename, edit)
+	if errors.Is(err, errNotEditable) {
+		ErrorResponseCode(w, http.StatusUnprocessableEntity, "not_editable", err.Error())
+		return
+	} else if err != nil {
+		logger.ErrorContext(r.Context(), "image edit failed", "album_id", albumID, "file", filename, "op", edit.Op, "error", err)
+		ErrorResponseCode(w, http.StatusInternalServerError, "edit_failed", "Could not edit image")
+		return
+	}
+	logger.InfoContext(r.Context(), "image edited", "album_id", albumID, "file", filename, "op", edit.Op)
+	SuccessResponse(w, info)
+}
+
+// imageVersionsHandler возвращает владельцу список версий изображения, а с
+// параметром version — файл этой версии
+func imageVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID, albumID, filename, ok := editTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if id := r.FormValue("version"); id != "" {
+		path, ok := imageVersionPath(sessionID, albumID, filename, id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		setImageHeaders(w, filename)
+		http.ServeContent(w, r, filename, info.ModTime(), file)
+		return
+	}
+
+	versions, err := listImageVersions(sessionID, albumID, filename)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to list image versions", "album_id", albumID, "file", filename, "error", err)
+		ErrorResponseCode(w, http.StatusInternalServerError, "versions_failed", "Could not list versions")
+		return
+	}
+	SuccessResponse(w, versions)
+}
+
+// restoreImageVersionHandler возвращает изображению владельца прежнюю версию
+func restoreImageVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID, albumID, filename, ok := editTarget(w, r)
+	if !ok {
+		return
+	}
+	id := r.FormValue("version")
+
+	info, err := restoreImageVersion(r.Context(), sessionID, albumID, filename, id)
+	if errors.Is(err, os.ErrNotExist) {
+		ErrorResponseCode(w, http.StatusNotFound, "version_not_found", "Version not found")
+		return
+	} else if err != nil {
+		logger.ErrorContext(r.Context(), "image version restore failed", "album_id", albumID, "file", filename, "version", id, "error", err)
+		ErrorResponseCode(w, http.StatusInternalServerError, "restore_failed", "Could not restore version")
+		return
+	}
+	logger.InfoContext(r.Context(), "image version restored", "album_id", albumID, "file", filename, "version", id)
+	SuccessResponse(w, info)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+	"testing"
+)
+
+// gradient возвращает изображение 40x30, цвет каждого пикселя которого
+// однозначно задает его координаты
+func gradient() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+	return img
+}
+
+func rgbaAt(img image.Image, x, y int) color.RGBA {
+	return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+}
+
+func TestParseImageEdit(t *testing.T) {
+	tooMany := make([]string, maxEditRects+1)
+	for i := range tooMany {
+		tooMany[i] = "0,0,1,1"
+	}
+	tests := []struct {
+		name    string
+		form    map[string][]string
+		want    imageEdit
+		wantErr bool
+	}{
+		{"rotate", map[string][]string{"op": {"rotate"}, "angle": {"270"}}, imageEdit{Op: EditRotate, Angle: 270}, false},
+		{"rotate by 45", map[string][]string{"op": {"rotate"}, "angle": {"45"}}, imageEdit{}, true},
+		{"unknown op", map[string][]string{"op": {"flip"}}, imageEdit{}, true},
+		{"crop", map[string][]string{"op": {"crop"}, "rect": {"10, 5, 20, 15"}},
+			imageEdit{Op: EditCrop, Rects: []image.Rectangle{image.Rect(10, 5, 30, 20)}}, false},
+		{"crop with two rects", map[string][]string{"op": {"crop"}, "rect": {"0,0,1,1", "1,1,1,1"}}, imageEdit{}, true},
+		{"blackout rects", map[string][]string{"op": {"blackout"}, "rect": {"0,0,1,1", "5,5,2,3"}},
+			imageEdit{Op: EditBlackout, Rects: []image.Rectangle{image.Rect(0, 0, 1, 1), image.Rect(5, 5, 7, 8)}}, false},
+		{"no rect", map[string][]string{"op": {"pixelate"}}, imageEdit{}, true},
+		{"too many rects", map[string][]string{"op": {"pixelate"}, "rect": tooMany}, imageEdit{}, true},
+		{"negative origin", map[string][]string{"op": {"blackout"}, "rect": {"-1,0,5,5"}}, imageEdit{}, true},
+		{"empty rect", map[string][]string{"op": {"blackout"}, "rect": {"0,0,0,5"}}, imageEdit{}, true},
+		{"three numbers", map[string][]string{"op": {"blackout"}, "rect": {"0,0,5"}}, imageEdit{}, true},
+		{"not a number", map[string][]string{"op": {"blackout"}, "rect": {"0,0,5,x"}}, imageEdit{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseImageEdit(tt.form)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseImageEdit() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("parseImageEdit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageEditApply(t *testing.T) {
+	src := gradient()
+	black := color.RGBA{0, 0, 0, 0xff}
+
+	t.Run("rotate", func(t *testing.T) {
+		got, err := imageEdit{Op: EditRotate, Angle: 90}.apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := got.Bounds(); b.Dx() != 30 || b.Dy() != 40 {
+			t.Fatalf("rotated to %v, want 30x40", b)
+		}
+		// Левый верхний угол уходит в правый верхний
+		if c := rgbaAt(got, 29, 0); c != rgbaAt(src, 0, 0) {
+			t.Errorf("top right = %v, want %v", c, rgbaAt(src, 0, 0))
+		}
+	})
+
+	t.Run("crop past the edge", func(t *testing.T) {
+		got, err := imageEdit{Op: EditCrop, Rects: []image.Rectangle{image.Rect(30, 20, 60, 60)}}.apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := got.Bounds(); b != image.Rect(0, 0, 10, 10) {
+			t.Fatalf("cropped to %v, want 10x10 clipped to the image", b)
+		}
+		if c := rgbaAt(got, 0, 0); c != rgbaAt(src, 30, 20) {
+			t.Errorf("origin = %v, want %v", c, rgbaAt(src, 30, 20))
+		}
+	})
+
+	t.Run("crop outside the image", func(t *testing.T) {
+		_, err := imageEdit{Op: EditCrop, Rects: []image.Rectangle{image.Rect(40, 0, 50, 10)}}.apply(src)
+		if !errors.Is(err, errNotEditable) {
+			t.Errorf("apply() error = %v, want %v", err, errNotEditable)
+		}
+	})
+
+	t.Run("blackout past the edge", func(t *testing.T) {
+		got, err := imageEdit{Op: EditBlackout, Rects: []image.Rectangle{image.Rect(35, 25, 100, 100)}}.apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Bounds() != src.Bounds() {
+			t.Fatalf("bounds %v, want %v", got.Bounds(), src.Bounds())
+		}
+		for _, p := range []image.Point{{35, 25}, {39, 29}} {
+			if c := rgbaAt(got, p.X, p.Y); c != black {
+				t.Errorf("pixel %v = %v, want black", p, c)
+			}
+		}
+		for _, p := range []image.Point{{34, 25}, {35, 24}, {0, 0}} {
+			if c := rgbaAt(got, p.X, p.Y); c != rgbaAt(src, p.X, p.Y) {
+				t.Errorf("pixel %v outside the rect changed to %v", p, c)
+			}
+		}
+	})
+
+	t.Run("pixelate outside the image", func(t *testing.T) {
+		got, err := imageEdit{Op: EditPixelate, Rects: []image.Rectangle{image.Rect(50, 50, 60, 60)}}.apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.(*image.RGBA).Pix, src.Pix) {
+			t.Error("pixelating outside the image changed it")
+		}
+	})
+
+	t.Run("pixelate", func(t *testing.T) {
+		got, err := imageEdit{Op: EditPixelate, Rects: []image.Rectangle{image.Rect(0, 0, 24, 12)}}.apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Блоки 12x12: каждый залит средним цветом исходных пикселей
+		for _, cell := range []image.Rectangle{image.Rect(0, 0, 12, 12), image.Rect(12, 0, 24, 12)} {
+			want := color.RGBA{uint8((cell.Min.X + cell.Max.X - 1) / 2), 5, 0x80, 0xff}
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					if c := rgbaAt(got, x, y); c != want {
+						t.Fatalf("pixel (%d,%d) = %v, want block average %v", x, y, c, want)
+					}
+				}
+			}
+		}
+		if c := rgbaAt(got, 24, 0); c != rgbaAt(src, 24, 0) {
+			t.Errorf("pixel right of the rect changed to %v", c)
+		}
+	})
+
+	if c := rgbaAt(src, 39, 29); c != (color.RGBA{39, 29, 0x80, 0xff}) {
+		t.Errorf("apply modified its input: %v", c)
+	}
+}
+
+func TestSaveImageVersionPrunesOldest(t *testing.T) {
+	withDataPath(t)
+	const saved = maxImageVersions + 3
+	for i := range saved {
+		if err := saveImageVersion("user", "album", "a.png", strings.NewReader(fmt.Sprintf("version %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := listImageVersions("user", "album", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != maxImageVersions {
+		t.Fatalf("kept %d versions, want %d", len(versions), maxImageVersions)
+	}
+	// Остаются самые новые, от новых к старым
+	for i, version := range versions {
+		path, _ := imageVersionPath("user", "album", "a.png", version.ID)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("version %d", saved-1-i); string(data) != want {
+			t.Errorf("version %d = %q, want %q", i, data, want)
+		}
+	}
+}
+
+func TestEditAndRestoreRoundTrip(t *testing.T) {
+	withDataPath(t)
+	withScanner(t, nil, false)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, gradient()); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+	info, err := uploadImage(t, formFile(t, "a.png", original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	readPixel := func(x, y int) color.RGBA {
+		t.Helper()
+		data, err := os.ReadFile(info.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rgbaAt(img, x, y)
+	}
+
+	edit := imageEdit{Op: EditBlackout, Rects: []image.Rectangle{image.Rect(0, 0, 5, 5)}}
+	if _, err := editImage(ctx, "user", "album", info.Filename, edit); err != nil {
+		t.Fatal(err)
+	}
+	if c := readPixel(2, 2); c != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Fatalf("edited pixel = %v, want black", c)
+	}
+
+	versions, err := listImageVersions("user", "album", info.Filename)
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("versions after edit = %v, %v; want 1", versions, err)
+	}
+	restored, err := restoreImageVersion(ctx, "user", "album", info.Filename, versions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(info.Path); !bytes.Equal(data, original) {
+		t.Error("restored file differs from the original upload")
+	}
+	if restored.Width != 40 || restored.Height != 30 || !restored.UploadedAt.Equal(info.UploadedAt) {
+		t.Errorf("restored index entry = %+v, want 40x30 uploaded at %v", restored, info.UploadedAt)
+	}
+
+	// Восстановленная версия удалена, а отмененная правка стала версией
+	versions, err = listImageVersions("user", "album", info.Filename)
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("versions after restore = %v, %v; want 1", versions, err)
+	}
+	if _, err := restoreImageVersion(ctx, "user", "album", info.Filename, versions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if c := readPixel(2, 2); c != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Errorf("pixel after undoing the restore = %v, want black again", c)
+	}
+
+	if _, err := restoreImageVersion(ctx, "user", "album", info.Filename, "../../a.png"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("restore with a path as version = %v, want %v", err, os.ErrNotExist)
+	}
+}
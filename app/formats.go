@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/bmp" // BMP и TIFF декодируются и по умолчанию сохраняются как PNG
+	_ "golang.org/x/image/tiff"
+)
+
+// ConvertBMPTIFF сохраняет BMP и TIFF как PNG: браузеры показывают TIFF плохо,
+// а BMP без сжатия занимает в разы больше места
+var ConvertBMPTIFF = true
+
+// ImageContentSecurityPolicy отдается вместе с изображениями и роликами. SVG,
+// открытый напрямую, становится документом, поэтому сценарии и внешние загрузки
+// запрещены; media-src нужен встроенному плееру браузера при открытии ролика.
+const ImageContentSecurityPolicy = "default-src 'none'; img-src data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// setImageHeaders выставляет безопасные заголовки для отдачи файла изображения
+func setImageHeaders(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Type", imageContentType(GetFileExtension(filename)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", ImageContentSecurityPolicy)
+}
+
+// sniffImageType определяет MIME тип по началу файла. Форматы, которых нет
+// в http.DetectContentType (TIFF, AVIF, SVG), распознаются отдельно.
+func sniffImageType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return "image/tiff"
+	case isAVIFHeader(header):
+		return "image/avif"
+	case isSVGHeader(header):
+		return "image/svg+xml"
+	case isMP4Header(header):
+		return "video/mp4"
+	case isWebMHeader(header):
+		return "video/webm"
+	}
+	return http.DetectContentType(header)
+}
+
+// canDecodePixels сообщает, что пиксели формата можно декодировать на сервере.
+// AVIF, SVG и ролики хранятся без декодирования: у AVIF и роликов проверяется
+// структура и размеры, SVG очищается от активного содержимого.
+func canDecodePixels(format string) bool {
+	return format != "avif" && format != "svg" && !isVideoExtension(format)
+}
+
+// AVIF
+
+func init() {
+	image.RegisterFormat("avif", "????ftypavif", decodeAVIF, decodeAVIFConfig)
+	image.RegisterFormat("avif", "????ftypavis", decodeAVIF, decodeAVIFConfig)
+	// Общие бренды HEIF; в загрузки попадают только файлы с брендом avif (см. isAVIFHeader)
+	image.RegisterFormat("avif", "????ftypmif1", decodeAVIF, decodeAVIFConfig)
+	image.RegisterFormat("avif", "????ftypmiaf", decodeAVIF, decodeAVIFConfig)
+}
+
+// isAVIFHeader проверяет бокс ftyp: основной или совместимый бренд avif/avis
+func isAVIFHeader(header []byte) bool {
+	if len(header) < 16 || string(header[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(header[:4]))
+	if size > len(header) {
+		size = len(header)
+	}
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 { // minor_version
+			continue
+		}
+		if brand := string(header[i : i+4]); brand == "avif" || brand == "avis" {
+			return true
+		}
+	}
+	return false
+}
+
+var errAVIFDecode = errors.New("avif: decoding pixels is not supported")
+
+func decodeAVIF(io.Reader) (image.Image, error) { return nil, errAVIFDecode }
+
+// decodeAVIFConfig читает размеры из свойства ispe в meta/iprp/ipco
+func decodeAVIFConfig(r io.Reader) (image.Config, error) {
+	s := &byteScanner{r: bufio.NewReader(r)}
+	width, height, err := s.findImageSpatialExtents(-1)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: width, Height: height}, nil
+}
+
+// boxHeader читает заголовок бокса ISOBMFF; size — полный размер бокса, 0 — до конца файла
+func (s *byteScanner) boxHeader() (string, int64, error) {
+	start := s.pos
+	header := make([]byte, 8)
+	if err := s.read(header); err != nil {
+		return "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	if size == 1 {
+		if err := s.read(header); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(header))
+	}
+	if size != 0 && size < s.pos-start {
+		return "", 0, errStructure
+	}
+	return string(header[4:8]), size, nil
+}
+
+// findImageSpatialExtents ищет ispe среди боксов до позиции end (-1 — до конца потока)
+func (s *byteScanner) findImageSpatialExtents(end int64) (int, int, error) {
+	for end < 0 || s.pos < end {
+		start := s.pos
+		typ, size, err := s.boxHeader()
+		if err != nil {
+			return 0, 0, err
+		}
+		boxEnd := start + size
+		if size == 0 {
+			boxEnd = -1
+		}
+		switch typ {
+		case "meta": // FullBox: версия и флаги перед дочерними боксами
+			if err := s.skip(4); err != nil {
+				return 0, 0, err
+			}
+			return s.findImageSpatialExtents(boxEnd)
+		case "iprp", "ipco":
+			return s.findImageSpatialExtents(boxEnd)
+		case "ispe":
+			extents := make([]byte, 12)
+			if err := s.read(extents); err != nil {
+				return 0, 0, err
+			}
+			return int(binary.BigEndian.Uint32(extents[4:8])), int(binary.BigEndian.Uint32(extents[8:12])), nil
+		}
+		if size == 0 {
+			break
+		}
+		if err := s.skip(boxEnd - s.pos); err != nil {
+			return 0, 0, err
+		}
+	}
+	return 0, 0, errors.New("avif: image size not found")
+}
+
+// skipISOBMFF проходит боксы верхнего уровня до конца файла
+func (s *byteScanner) skipISOBMFF() error {
+	for {
+		if _, err := s.r.Peek(1); err == io.EOF {
+			return nil
+		}
+		start := s.pos
+		_, size, err := s.boxHeader()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			n, err := io.Copy(io.Discard, s.r)
+			s.pos += n
+			return err
+		}
+		if err := s.skip(start + size - s.pos); err != nil {
+			return err
+		}
+	}
+}
+
+// BMP
+
+// skipBMP пропускает файл BMP по размеру из заголовка; нулевой размер
+// допускается форматом, тогда файлом считается все содержимое
+func (s *byteScanner) skipBMP() error {
+	header := make([]byte, 6)
+	if err := s.read(header); err != nil {
+		return err
+	}
+	size := int64(binary.LittleEndian.Uint32(header[2:6]))
+	if size == 0 {
+		n, err := io.Copy(io.Discard, s.r)
+		s.pos += n
+		return err
+	}
+	return s.skip(size - s.pos)
+}
+
+// SVG
+
+// isSVGHeader проверяет, что первым элементом документа является <svg>.
+// Пропускаются BOM, пробелы, объявление XML, комментарии и DOCTYPE.
+func isSVGHeader(header []byte) bool {
+	rest := bytes.TrimPrefix(header, []byte("\xEF\xBB\xBF"))
+	for {
+		rest = bytes.TrimLeft(rest, " \t\r\n")
+		var end []byte
+		switch {
+		case bytes.HasPrefix(rest, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(rest, []byte("<!")):
+			end = []byte(">")
+			// DOCTYPE с внутренним подмножеством: <!DOCTYPE svg [ ... ]>
+			if open := bytes.IndexByte(rest, '['); open >= 0 && open < bytes.IndexByte(rest, '>') {
+				end = []byte("]>")
+			}
+		default:
+			return bytes.HasPrefix(rest, []byte("<svg")) && len(rest) > 4 && strings.IndexByte(" \t\r\n>/", rest[4]) >= 0
+		}
+		i := bytes.Index(rest, end)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(end):]
+	}
+}
+
+// maxSVGSide ограничивает стороны SVG в метаданных: вектор масштабируется без потерь
+const maxSVGSide = 1 << 16
+
+// svgConfig читает размеры корневого элемента SVG из width/height или viewBox
+func svgConfig(r io.Reader) (image.Config, error) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return image.Config{}, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "svg" {
+			return image.Config{}, fmt.Errorf("root element is <%s>, not <svg>", start.Name.Local)
+		}
+
+		var width, height float64
+		var viewBox []string
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width = svgLength(attr.Value)
+			case "height":
+				height = svgLength(attr.Value)
+			case "viewBox":
+				viewBox = strings.FieldsFunc(attr.Value, func(r rune) bool { return r == ',' || r == ' ' })
+			}
+		}
+		if (width == 0 || height == 0) && len(viewBox) == 4 {
+			width, _ = strconv.ParseFloat(viewBox[2], 64)
+			height, _ = strconv.ParseFloat(viewBox[3], 64)
+		}
+		config := image.Config{ColorModel: color.RGBAModel}
+		if width > 0 && height > 0 {
+			config.Width = int(math.Min(math.Round(width), maxSVGSide))
+			config.Height = int(math.Min(math.Round(height), maxSVGSide))
+		}
+		return config, nil
+	}
+}
+
+// svgLength разбирает длину в пикселях; относительные единицы дают 0
+func svgLength(value string) float64 {
+	value = strings.TrimSuffix(strings.TrimSpace(value), "px")
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// svgDroppedElements удаляются вместе с содержимым: сценарии, встроенный
+// HTML и внешние документы
+var svgDroppedElements = map[string]bool{
+	"script":        true,
+	"foreignObject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"audio":         true,
+	"video":         true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// svgURLPattern находит ссылки url(...) в CSS и атрибутах представления
+var svgURLPattern = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")\s]*)`)
+
+// safeSVGReference разрешает ссылки внутри документа и встроенные растровые изображения
+func safeSVGReference(ref string) bool {
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	if strings.HasPrefix(ref, "#") {
+		return true
+	}
+	for _, prefix := range []string{"data:image/png", "data:image/jpeg", "data:image/gif", "data:image/webp"} {
+		if strings.HasPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// safeSVGStyle проверяет CSS: без импорта, выражений и внешних url()
+func safeSVGStyle(css string) bool {
+	lower := strings.ToLower(css)
+	if strings.Contains(lower, "@import") || strings.Contains(lower, "expression(") || strings.Contains(lower, "javascript:") {
+		return false
+	}
+	for _, match := range svgURLPattern.FindAllStringSubmatch(css, -1) {
+		if !safeSVGReference(match[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// safeSVGAttr решает, сохранить ли атрибут элемента
+func safeSVGAttr(element string, attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return false
+	case attr.Name.Space == "xml" && name == "base":
+		return false
+	case name == "href":
+		return safeSVGReference(attr.Value)
+	case name == "attributename" && (element == "set" || strings.HasPrefix(element, "animate")):
+		// Анимация может подменить href на javascript: или включить обработчик
+		value := strings.ToLower(attr.Value)
+		return !strings.HasSuffix(value, "href") && !strings.HasPrefix(value, "on")
+	}
+	return safeSVGStyle(attr.Value)
+}
+
+// sanitizeSVG пересобирает документ SVG из токенов, удаляя активное содержимое:
+// сценарии, обработчики событий, внешние ссылки и загрузки, DOCTYPE с
+// сущностями, инструкции обработки и все, что следует за корневым элементом.
+func sanitizeSVG(r io.Reader) ([]byte, error) {
+	d := xml.NewDecoder(r)
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+
+	var stack []string
+	dropped := 0 // глубина внутри удаляемого элемента
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 && out.Len() > len(xml.Header) {
+				return nil, errors.New("content after the root element")
+			}
+			if len(stack) == 0 && t.Name.Local != "svg" {
+				return nil, fmt.Errorf("root element is <%s>, not <svg>", t.Name.Local)
+			}
+			stack = append(stack, svgName(t.Name))
+			if dropped > 0 || svgDroppedElements[t.Name.Local] {
+				dropped++
+				continue
+			}
+			out.WriteString("<" + svgName(t.Name))
+			for _, attr := range t.Attr {
+				if !safeSVGAttr(t.Name.Local, attr) {
+					continue
+				}
+				out.WriteString(" " + svgName(attr.Name) + `="` + svgAttrEscaper.Replace(attr.Value) + `"`)
+			}
+			out.WriteString(">")
+
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1] != svgName(t.Name) {
+				return nil, fmt.Errorf("unexpected closing tag </%s>", svgName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+			if dropped > 0 {
+				dropped--
+				continue
+			}
+			out.WriteString("</" + svgName(t.Name) + ">")
+
+		case xml.CharData:
+			if len(stack) == 0 || dropped > 0 {
+				continue
+			}
+			// Содержимое <style> без внешних ссылок, иначе стили удаляются целиком
+			if strings.HasSuffix(stack[len(stack)-1], "style") && !safeSVGStyle(string(t)) {
+				continue
+			}
+			out.WriteString(svgTextEscaper.Replace(string(t)))
+		}
+	}
+	if len(stack) != 0 || out.Len() == len(xml.Header) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return out.Bytes(), nil
+}
+
+// Экранирование при сборке SVG; переводы строк в тексте сохраняются как есть
+var (
+	svgTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	svgAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// svgName возвращает имя с префиксом пространства имен, как в исходном документе
+func svgName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const svgOpen = `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="10" height="10">`
+
+func TestSanitizeSVG(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		drop    []string // не должно остаться в результате
+		keep    []string // должно сохраниться
+		wantErr bool
+	}{
+		{
+			name: "script element",
+			in:   svgOpen + `<script>alert(1)</script><script xlink:href="https://evil/x.js"/><rect width="5"/></svg>`,
+			drop: []string{"script", "alert", "evil"},
+			keep: []string{`<rect width="5"></rect>`},
+		},
+		{
+			name: "event handlers",
+			in:   svgOpen + `<rect onclick="alert(1)" ONLOAD="alert(2)" onMouseOver="alert(3)" fill="red"/></svg>`,
+			drop: []string{"alert", "onclick", "ONLOAD", "onMouseOver"},
+			keep: []string{`fill="red"`},
+		},
+		{
+			name: "script and external links",
+			in: svgOpen +
+				`<a href="javascript:alert(1)"><rect/></a>` +
+				`<a xlink:href=" JavaScript:alert(2)"><rect/></a>` +
+				`<a href="https://evil/"><rect/></a>` +
+				`<use xlink:href="https://evil/sprite.svg#icon"/>` +
+				`<image href="data:text/html;base64,PHNjcmlwdD4="/>` +
+				`<image href="data:image/svg+xml;base64,PHN2Zz4="/>` +
+				`<use href="#icon"/><image xlink:href="data:image/png;base64,iVBORw0K"/></svg>`,
+			drop: []string{"javascript", "JavaScript", "evil", "text/html", "image/svg+xml"},
+			keep: []string{`<use href="#icon">`, `xlink:href="data:image/png;base64,iVBORw0K"`},
+		},
+		{
+			name: "foreign object",
+			in:   svgOpen + `<foreignObject><body xmlns="http://www.w3.org/1999/xhtml"><iframe src="https://evil/"/></body></foreignObject><circle r="1"/></svg>`,
+			drop: []string{"foreignObject", "body", "iframe", "evil"},
+			keep: []string{`<circle r="1"></circle>`},
+		},
+		{
+			name: "animation swaps href",
+			in:   svgOpen + `<a><set attributeName="href" to="javascript:alert(1)"/><animate attributeName="onclick" values="alert(1)"/><animate attributeName="x" values="1;2"/></a></svg>`,
+			drop: []string{`attributeName="href"`, `attributeName="onclick"`},
+			keep: []string{`attributeName="x"`},
+		},
+		{
+			name: "external styles",
+			in: svgOpen +
+				`<style>@import url(https://evil/x.css);</style>` +
+				`<style>rect { fill: red }</style>` +
+				`<rect style="fill: url(https://evil/p.svg#g)"/><rect style="fill: url(#g)"/></svg>`,
+			drop: []string{"evil", "@import"},
+			keep: []string{"rect { fill: red }", `style="fill: url(#g)"`},
+		},
+		{
+			name: "cdata stays text",
+			in:   svgOpen + `<text><![CDATA[<script>alert(1)</script>]]></text><script><![CDATA[</script><script>alert(2)]]></script></svg>`,
+			drop: []string{"<script", "alert(2)"},
+			keep: []string{"<text>&lt;script&gt;alert(1)&lt;/script&gt;</text>"},
+		},
+		{
+			name: "character references are decoded before checks",
+			in:   svgOpen + `<a href="&#106;ava&#x73;cript:alert(1)"><rect/></a><a href="java&#x09;script:alert(2)"><rect/></a></svg>`,
+			drop: []string{"alert", "href"},
+		},
+		{
+			name: "processing instructions and comments",
+			in:   `<?xml-stylesheet href="https://evil/x.css"?>` + svgOpen + `<!-- <script>alert(1)</script> --><rect/></svg>`,
+			drop: []string{"xml-stylesheet", "evil", "<!--", "alert"},
+		},
+		{
+			name:    "entity declared in doctype",
+			in:      `<!DOCTYPE svg [<!ENTITY x "<script>alert(1)</script>">]>` + svgOpen + `&x;</svg>`,
+			wantErr: true,
+		},
+		{
+			name:    "content after root",
+			in:      svgOpen + `</svg><script>alert(1)</script>`,
+			wantErr: true,
+		},
+		{
+			name:    "html root",
+			in:      `<html><script>alert(1)</script></html>`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := sanitizeSVG(strings.NewReader(tt.in))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sanitizeSVG() = %q, want error", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.drop {
+				if strings.Contains(string(out), s) {
+					t.Errorf("output keeps %q: %s", s, out)
+				}
+			}
+			for _, s := range tt.keep {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("output lost %q: %s", s, out)
+				}
+			}
+			// Результат снова разбирается как SVG
+			if _, err := svgConfig(strings.NewReader(string(out))); err != nil {
+				t.Errorf("sanitized output is not valid svg: %v", err)
+			}
+		})
+	}
+}
+
+func TestServeSVGWithContentSecurityPolicy(t *testing.T) {
+	withDataPath(t)
+	withScanner(t, nil, false)
+
+	info, err := uploadImage(t, formFile(t, "a.svg", []byte(svgOpen+`<script>alert(1)</script><rect/></svg>`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(info.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), "script") {
+		t.Errorf("stored svg keeps the script: %s", stored)
+	}
+
+	rec := httptest.NewRecorder()
+	contentHandler(rec, httptest.NewRequest("GET", "/user/album/"+info.Filename, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":            "image/svg+xml",
+		"Content-Security-Policy": ImageContentSecurityPolicy,
+		"X-Content-Type-Options":  "nosniff",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if !strings.Contains(ImageContentSecurityPolicy, "sandbox") || !strings.Contains(ImageContentSecurityPolicy, "default-src 'none'") {
+		t.Errorf("policy %q does not block scripts", ImageContentSecurityPolicy)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -16,7 +18,6 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
-	logger.Debug(fmt.Sprintf("indexHandler: request received, path=%s, method=%s", r.URL.Path, r.Method))
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -32,8 +33,8 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	sessionID := getSessionID(w, r)
 
 	// Получаем список альбомов
-	albums, err := getUserAlbums(sessionID)
-	logger.Debug(fmt.Sprintf("getUserAlbums: sessionID=%s, albums_count=%d, err=%v", sessionID, len(albums), err))
+	albums, err := getUserAlbums(r.Context(), sessionID)
+	logger.DebugContext(r.Context(), "index albums loaded", "albums", len(albums), "error", err)
 	if err != nil {
 		albums = []AlbumInfo{}
 	}
@@ -43,12 +44,14 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		Albums          []AlbumInfo
 		HasAlbums       bool
 		SessionID       string
-		TotalImageCount int
+		CSRFToken       string
+		TotalImageCount int64
 	}{
 		Albums:          albums,
 		HasAlbums:       len(albums) > 0,
 		SessionID:       sessionID,
-		TotalImageCount: TotalImageCount,
+		CSRFToken:       csrfToken(sessionID),
+		TotalImageCount: stats.Images(),
 	}
 
 	// Отображаем страницу
@@ -59,34 +62,55 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 // uploadHandler обрабатывает загрузку изображений
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	logger.Debug(fmt.Sprintf("uploadHandler: request received, method=%s", r.Method))
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	sessionID := getSessionID(w, r)
-	logger.Debug(fmt.Sprintf("uploadHandler: sessionID=%s", sessionID))
 
 	// Ограничиваем размер запроса
 	if err := r.ParseMultipartForm(MaxFileSize); err != nil {
+		metrics.uploadRejected.Inc("bad_form")
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
 
 	// Получаем ID альбома
+	if id := r.FormValue("album_id"); id != "" && !validStorageID(id) {
+		metrics.uploadRejected.Inc("bad_form")
+		http.Error(w, "Invalid album_id", http.StatusBadRequest)
+		return
+	}
 	albumID := getAlbumID(r, sessionID)
 
 	// Проверяем файлы
 	files := getUploadFiles(r)
 	if len(files) == 0 {
+		metrics.uploadRejected.Inc("no_files")
 		http.Error(w, "No files selected", http.StatusBadRequest)
 		return
 	}
 
 	// Обрабатываем файлы
-	if err := processUpload(files, sessionID, albumID); err != nil {
-		http.Error(w, fmt.Sprintf("Upload failed: %v", err), http.StatusInternalServerError)
+	if err := processUpload(r.Context(), files, sessionID, albumID); err != nil {
+		// Отказ по содержимому файла отдается с причиной, понятной клиенту
+		var rejection *ImageRejection
+		if errors.As(err, &rejection) {
+			ErrorResponseCode(w, http.StatusUnprocessableEntity, rejection.Reason, rejection.Detail)
+			return
+		}
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errUploadRejected):
+			status = http.StatusUnprocessableEntity
+		case errors.Is(err, errScanUnavailable):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, errUploadHeld):
+			// Файл сохранен, но станет виден только после решения модератора
+			status = http.StatusAccepted
+		}
+		http.Error(w, fmt.Sprintf("Upload failed: %v", err), status)
 		return
 	}
 
@@ -110,6 +134,14 @@ func contentHandler(w http.ResponseWriter, r *http.Request) {
 
 	parts := strings.SplitN(path, "/", 3)
 
+	// Служебные каталоги (.quarantine, .cache и т.п.) и вложенные пути недоступны
+	for _, part := range parts {
+		if !validStorageID(part) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
 	switch len(parts) {
 	case 2:
 		// Страница альбома
@@ -127,12 +159,21 @@ func handleAlbumPage(w http.ResponseWriter, r *http.Request, sessionID, albumID
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
-	logger.Debug(fmt.Sprintf("handleAlbumPage: sessionID=%s, albumID=%s", sessionID, albumID))
 	currentSessionID := getSessionID(w, r)
 	isOwner := currentSessionID == sessionID
 
-	images, _ := getUserImages(sessionID, albumID)
-	logger.Debug(fmt.Sprintf("handleAlbumPage: images_count=%d", len(images)))
+	images, _ := getUserImages(r.Context(), sessionID, albumID)
+	watermark, err := albumWatermark(sessionID, albumID)
+	if err != nil {
+		logger.WarnContext(r.Context(), "failed to read album watermark", "album_id", albumID, "error", err)
+	}
+	if watermark != nil && !isOwner {
+		// Файлы, на которые нельзя наложить знак, посетителям не отдаются
+		images = slices.DeleteFunc(images, func(info ImageInfo) bool {
+			return !canDecodePixels(strings.TrimPrefix(GetFileExtension(info.Filename), "."))
+		})
+	}
+	logger.DebugContext(r.Context(), "album page", "owner_id", sessionID, "album_id", albumID, "images", len(images))
 
 	data := struct {
 		Images          []ImageInfo
@@ -141,7 +182,10 @@ func handleAlbumPage(w http.ResponseWriter, r *http.Request, sessionID, albumID
 		OwnerSessionID  string
 		AlbumID         string
 		IsOwner         bool
-		TotalImageCount int
+		Watermark       *Watermark
+		WatermarkLogo   bool
+		CSRFToken       string
+		TotalImageCount int64
 	}{
 		Images:          images,
 		HasImages:       len(images) > 0,
@@ -149,7 +193,10 @@ func handleAlbumPage(w http.ResponseWriter, r *http.Request, sessionID, albumID
 		OwnerSessionID:  sessionID,
 		AlbumID:         albumID,
 		IsOwner:         isOwner,
-		TotalImageCount: TotalImageCount,
+		Watermark:       watermark,
+		WatermarkLogo:   WatermarkLogo != "",
+		CSRFToken:       csrfToken(currentSessionID),
+		TotalImageCount: stats.Images(),
 	}
 
 	if err := renderTemplate(w, "album.html", data); err != nil {
@@ -166,6 +213,32 @@ func handleImageFile(w http.ResponseWriter, r *http.Request, sessionID, albumID,
 		return
 	}
 
+	watermark, err := albumWatermark(sessionID, albumID)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to read album watermark", "album_id", albumID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if watermark != nil {
+		// Владелец видит оригинал, посетители — только копии со знаком, поэтому
+		// ответ по одному адресу зависит от cookie и не кешируется общими кешами
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Add("Vary", "Cookie")
+		if viewer, ok := readSessionID(r); ok && viewer == sessionID {
+			watermark = nil
+		} else if !canDecodePixels(strings.TrimPrefix(GetFileExtension(filename), ".")) {
+			http.Error(w, "This file is not available in a watermarked album", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Параметры w, h, fit, format, quality отдают преобразованную копию
+	if watermark != nil || wantsTransform(r.URL.Query()) {
+		serveTransformed(w, r, sessionID, albumID, filename, watermark)
+		return
+	}
+
+	setImageHeaders(w, filename)
 	http.ServeFile(w, r, filePath)
 }
 
@@ -180,12 +253,12 @@ func deleteImageHandler(w http.ResponseWriter, r *http.Request) {
 	albumID := r.FormValue("album_id")
 	filename := r.FormValue("filename")
 
-	if albumID == "" || filename == "" {
+	if !validStorageID(albumID) || !validStorageID(filename) {
 		http.Error(w, "album_id and filename required", http.StatusBadRequest)
 		return
 	}
 
-	if err := deleteImage(sessionID, albumID, filename); err != nil {
+	if err := deleteImage(r.Context(), sessionID, albumID, filename); err != nil {
 		http.Error(w, fmt.Sprintf("Error deleting image: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -203,12 +276,12 @@ func deleteAlbumHandler(w http.ResponseWriter, r *http.Request) {
 	sessionID := getSessionID(w, r)
 	albumID := r.FormValue("album_id")
 
-	if albumID == "" {
+	if !validStorageID(albumID) {
 		http.Error(w, "album_id required", http.StatusBadRequest)
 		return
 	}
 
-	if err := deleteAlbum(sessionID, albumID); err != nil {
+	if err := deleteAlbum(r.Context(), sessionID, albumID); err != nil {
 		http.Error(w, fmt.Sprintf("Error deleting album: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -225,20 +298,13 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	sessionID := getSessionID(w, r)
 
-	if err := deleteUser(sessionID); err != nil {
+	if err := deleteUser(r.Context(), sessionID); err != nil {
 		http.Error(w, fmt.Sprintf("Error deleting user data: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	// Очищаем cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     SessionCookieName,
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	http.SetCookie(w, sessionCookie("", -1))
 
 	SuccessResponse(w, map[string]string{"message": "Profile deleted successfully"})
 }
@@ -252,7 +318,7 @@ func createAlbumHandler(w http.ResponseWriter, r *http.Request) {
 
 	sessionID := getSessionID(w, r)
 
-	albumID, err := createAlbum(sessionID)
+	albumID, err := createAlbum(r.Context(), sessionID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error creating album: %v", err), http.StatusInternalServerError)
 		return
@@ -262,68 +328,9 @@ func createAlbumHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `{"album_id": "%s", "session_id": "%s"}`, albumID, sessionID)
 }
 
-// changelogCache хранит содержимое ченджлога в памяти
-var (
-	changelogCache      string
-	changelogCacheMutex sync.RWMutex
-	lastFetchTime       time.Time
-)
-
 // changelogHandler возвращает содержимое ченджлога
 func changelogHandler(w http.ResponseWriter, r *http.Request) {
-	changelogCacheMutex.RLock()
-	// Кэшируем на 1 час
-	if changelogCache != "" && time.Since(lastFetchTime) < time.Hour {
-		content := changelogCache
-		changelogCacheMutex.RUnlock()
-		SuccessResponse(w, map[string]string{"content": content})
-		return
-	}
-	changelogCacheMutex.RUnlock()
-
-	var content string
-	// Пробуем прочитать локально (в разных возможных путях)
-	paths := []string{ChangelogPath, "./changelog.md", "changelog.md"}
-	for _, p := range paths {
-		bytes, err := os.ReadFile(p)
-		if err == nil {
-			content = string(bytes)
-			break
-		}
-	}
-
-	if content == "" {
-		// Если локально нет, тянем с GitHub
-		logger.Info("Local changelog not found, fetching from GitHub...")
-		client := &http.Client{Timeout: 5 * time.Second}
-		resp, err := client.Get(ChangelogURL)
-		if err != nil {
-			http.Error(w, "Changelog not found", http.StatusNotFound)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			http.Error(w, "Changelog not found on GitHub", http.StatusNotFound)
-			return
-		}
-
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, "Error reading changelog", http.StatusInternalServerError)
-			return
-		}
-		content = string(bodyBytes)
-	}
-
-	// Обновляем кэш
-	changelogCacheMutex.Lock()
-	changelogCache = content
-	lastFetchTime = time.Now()
-	changelogCacheMutex.Unlock()
-
-	w.Header().Set("Content-Type", "application/json")
-	SuccessResponse(w, map[string]string{"content": content})
+	SuccessResponse(w, map[string]string{"content": readChangelog()})
 }
 
 // Вспомогательные функции
@@ -336,7 +343,7 @@ func getAlbumID(r *http.Request, sessionID string) string {
 	}
 
 	// Создаем новый альбом если не указан
-	newAlbumID, err := createAlbum(sessionID)
+	newAlbumID, err := createAlbum(r.Context(), sessionID)
 	if err != nil {
 		return ""
 	}
@@ -358,8 +365,8 @@ func getUploadFiles(r *http.Request) []*multipart.FileHeader {
 }
 
 // processUpload обрабатывает загрузку файлов параллельно
-func processUpload(files []*multipart.FileHeader, sessionID, albumID string) error {
-	logger.Debug(fmt.Sprintf("processUpload: starting, files_count=%d, sessionID=%s, albumID=%s", len(files), sessionID, albumID))
+func processUpload(ctx context.Context, files []*multipart.FileHeader, sessionID, albumID string) error {
+	logger.DebugContext(ctx, "processing upload", "files", len(files), "album_id", albumID)
 	var wg sync.WaitGroup
 	errs := make(chan error, len(files))
 
@@ -374,9 +381,9 @@ func processUpload(files []*multipart.FileHeader, sessionID, albumID string) err
 			}
 			defer file.Close()
 
-			_, err = saveImage(file, fh, sessionID, albumID)
+			_, err = saveImage(ctx, file, fh, sessionID, albumID)
 			if err != nil {
-				errs <- fmt.Errorf("error saving file %s: %v", fh.Filename, err)
+				errs <- fmt.Errorf("error saving file %s: %w", fh.Filename, err)
 				return
 			}
 		}(fileHeader)
@@ -385,15 +392,11 @@ func processUpload(files []*multipart.FileHeader, sessionID, albumID string) err
 	wg.Wait()
 	close(errs)
 
-	var uploadErrors []string
+	var uploadErrors []error
 	for err := range errs {
-		uploadErrors = append(uploadErrors, err.Error())
-	}
-
-	if len(uploadErrors) > 0 {
-		return fmt.Errorf("%v", strings.Join(uploadErrors, "; "))
+		uploadErrors = append(uploadErrors, err)
 	}
-	return nil
+	return errors.Join(uploadErrors...)
 }
 
 // renderTemplate рендерит HTML шаблон из кеша
@@ -404,14 +407,14 @@ func renderTemplate(w http.ResponseWriter, name string, data interface{}) error
 // sitemapHandler генерирует sitemap.xml
 func sitemapHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/xml")
-	// Всегда используем https и основной домен для sitemap
+	// Публичный адрес берем из конфигурации, а не из заголовка Host
 	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
 <urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
   <url>
-    <loc>https://screengu.ru/</loc>
+    <loc>%s/</loc>
     <lastmod>%s</lastmod>
     <changefreq>daily</changefreq>
     <priority>1.0</priority>
   </url>
-</urlset>`, time.Now().Format("2006-01-02"))
+</urlset>`, BaseURL, time.Now().Format("2006-01-02"))
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MinFreeDiskBytes — минимальный свободный объем в DataPath для готовности
+var MinFreeDiskBytes = int64(100 * 1024 * 1024)
+
+// shuttingDown выставляется при остановке, чтобы балансировщик перестал слать запросы
+var shuttingDown atomic.Bool
+
+// cleanupState хранит результат последнего прохода очистки
+var cleanupState struct {
+	sync.Mutex
+	lastRun time.Time
+	lastErr error
+}
+
+// recordCleanupResult запоминает результат прохода очистки для /readyz
+func recordCleanupResult(err error) {
+	cleanupState.Lock()
+	defer cleanupState.Unlock()
+	cleanupState.lastRun = time.Now()
+	cleanupState.lastErr = err
+}
+
+// CheckResult описывает результат одной проверки готовности
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthzHandler сообщает, что процесс жив
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, "ok", nil)
+}
+
+// readyzHandler проверяет, может ли экземпляр обслуживать запросы
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{
+		"shutdown":   checkNotShuttingDown(),
+		"data_dir":   checkDataDirWritable(),
+		"templates":  checkTemplatesLoaded(),
+		"secret":     checkSecretLoaded(),
+		"disk_space": checkDiskSpace(),
+		"cleanup":    checkCleanupWorker(),
+	}
+
+	results := make(map[string]CheckResult, len(checks))
+	status, code := "ok", http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			results[name] = CheckResult{Status: "fail", Error: err.Error()}
+			status, code = "fail", http.StatusServiceUnavailable
+			continue
+		}
+		results[name] = CheckResult{Status: "ok"}
+	}
+
+	writeHealth(w, code, status, results)
+}
+
+func writeHealth(w http.ResponseWriter, code int, status string, checks map[string]CheckResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string                 `json:"status"`
+		Checks map[string]CheckResult `json:"checks,omitempty"`
+	}{status, checks})
+}
+
+func checkNotShuttingDown() error {
+	if shuttingDown.Load() {
+		return fmt.Errorf("server is shutting down")
+	}
+	return nil
+}
+
+// checkDataDirWritable создает и удаляет пробный файл в DataPath
+func checkDataDirWritable() error {
+	f, err := os.CreateTemp(DataPath, TempFilePrefix+"readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func checkTemplatesLoaded() error {
+	if templates == nil {
+		return fmt.Errorf("templates are not parsed")
+	}
+	return nil
+}
+
+func checkSecretLoaded() error {
+	if len(AppSecret) < 32 {
+		return fmt.Errorf("app secret is not loaded")
+	}
+	return nil
+}
+
+func checkDiskSpace() error {
+	free, err := freeDiskBytes(DataPath)
+	if err != nil {
+		return err
+	}
+	if free < MinFreeDiskBytes {
+		return fmt.Errorf("free space %d MB is below %d MB", free/(1024*1024), MinFreeDiskBytes/(1024*1024))
+	}
+	return nil
+}
+
+// checkCleanupWorker проверяет, что последний проход очистки успешен и не слишком стар
+func checkCleanupWorker() error {
+	cleanupState.Lock()
+	defer cleanupState.Unlock()
+
+	switch {
+	case cleanupState.lastRun.IsZero():
+		return nil // первый проход еще идет
+	case cleanupState.lastErr != nil:
+		return fmt.Errorf("last cleanup failed: %v", cleanupState.lastErr)
+	case time.Since(cleanupState.lastRun) > 2*CleanupInterval:
+		return fmt.Errorf("last cleanup ran at %s", cleanupState.lastRun.Format(time.RFC3339))
+	}
+	return nil
+}
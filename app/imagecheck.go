@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Image validation configuration
+var (
+	// MaxImageDimension ограничивает ширину и высоту загружаемого изображения
+	MaxImageDimension = 20000
+	// MaxImagePixels ограничивает площадь изображения: маленький файл может
+	// объявить огромные размеры и потребовать гигабайты памяти при декодировании
+	MaxImagePixels = 50_000_000
+	// ImageDecodeTimeout ограничивает полное декодирование при проверке
+	ImageDecodeTimeout = 10 * time.Second
+	// ImageDecodeMemory ограничивает оценку памяти под декодированные пиксели
+	ImageDecodeMemory = int64(256 * 1024 * 1024)
+)
+
+// Причины отказа в загрузке, возвращаемые клиенту в поле code
+const (
+	RejectTooLarge      = "too_large"
+	RejectInvalidType   = "invalid_type"
+	RejectMalformed     = "malformed_image"
+	RejectDimensions    = "dimensions_too_large"
+	RejectPixels        = "too_many_pixels"
+	RejectDecodeTimeout = "decode_timeout"
+	RejectTrailingData  = "trailing_data"
+)
+
+// ImageRejection — отказ в загрузке с машиночитаемой причиной
+type ImageRejection struct {
+	Reason string
+	Detail string
+}
+
+func (e *ImageRejection) Error() string {
+	return "image rejected: " + e.Detail
+}
+
+func rejectImage(reason, format string, args ...any) *ImageRejection {
+	metrics.uploadRejected.Inc(reason)
+	return &ImageRejection{Reason: reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+// decodeSlots ограничивает число одновременных проверочных декодирований числом ядер
+var decodeSlots = make(chan struct{}, runtime.NumCPU())
+
+// inspectImage проверяет загрузку до записи на диск: размеры по заголовку,
+// отсутствие данных после конца изображения и полное декодирование в пределах
+// бюджета времени и памяти. Возвращает заголовок, формат и декодированное изображение.
+func inspectImage(ctx context.Context, file io.ReadSeeker, size int64, extension string) (image.Config, string, image.Image, error) {
+	// У роликов проверяется структура контейнера; кадры не декодируются
+	if isVideoExtension(extension) {
+		config, format, err := inspectVideo(file, size, extension)
+		if err == nil && (config.Width > MaxImageDimension || config.Height > MaxImageDimension) {
+			err = rejectImage(RejectDimensions, "%dx%d exceeds %d pixels per side", config.Width, config.Height, MaxImageDimension)
+		}
+		return config, format, nil, err
+	}
+
+	// SVG проверяется разбором XML при очистке, см. reencodeUpload
+	if extension == "svg" {
+		config, err := svgConfig(file)
+		if err != nil {
+			return config, "", nil, rejectImage(RejectMalformed, "invalid svg: %v", err)
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		return config, "svg", nil, err
+	}
+
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return config, "", nil, rejectImage(RejectMalformed, "cannot read image header: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return config, format, nil, rejectImage(RejectMalformed, "invalid dimensions %dx%d", config.Width, config.Height)
+	}
+	if config.Width > MaxImageDimension || config.Height > MaxImageDimension {
+		return config, format, nil, rejectImage(RejectDimensions, "%dx%d exceeds %d pixels per side", config.Width, config.Height, MaxImageDimension)
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels > int64(MaxImagePixels) {
+		return config, format, nil, rejectImage(RejectPixels, "%dx%d exceeds %d pixels", config.Width, config.Height, MaxImagePixels)
+	}
+	if need := pixels * bytesPerPixel(config.ColorModel); need > ImageDecodeMemory {
+		return config, format, nil, rejectImage(RejectPixels, "%dx%d needs %s to decode", config.Width, config.Height, formatBytes(need))
+	}
+
+	if err := checkTrailingData(file, format, size); err != nil {
+		return config, format, nil, err
+	}
+	if !canDecodePixels(format) {
+		_, err = file.Seek(0, io.SeekStart)
+		return config, format, nil, err
+	}
+
+	img, err := decodeWithBudget(ctx, file)
+	if err != nil {
+		return config, format, nil, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return config, format, img, err
+}
+
+// bytesPerPixel оценивает объем памяти на пиксель для цветовой модели
+func bytesPerPixel(model color.Model) int64 {
+	switch model {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := model.(color.Palette); ok {
+		return 1
+	}
+	return 4
+}
+
+// decodeWithBudget полностью декодирует изображение с ограничением по времени.
+// Декодер читает файл через contextReader: после таймаута или отмены запроса
+// следующее чтение завершается ошибкой, и брошенный декодер быстро освобождает
+// слот. Пока он доигрывает, слот занят; такие декодирования учитываются в метриках.
+func decodeWithBudget(ctx context.Context, file io.ReadSeeker) (image.Image, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ImageDecodeTimeout)
+	defer cancel()
+
+	select {
+	case decodeSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, decodeAborted(ctx, "no decoder available within %s", ImageDecodeTimeout)
+	}
+
+	type decoded struct {
+		img image.Image
+		err error
+	}
+	done := make(chan decoded, 1)
+	// settled выставляет первый из двух: горутина по завершении или вызывающий,
+	// бросая декодирование; так брошенное учитывается ровно один раз
+	var settled atomic.Bool
+	go func() {
+		defer func() { <-decodeSlots }()
+		img, _, err := image.Decode(&contextReader{ctx: ctx, r: file})
+		done <- decoded{img, err}
+		if !settled.CompareAndSwap(false, true) {
+			metrics.abandonedDecodes.Add(-1)
+		}
+	}()
+
+	var result decoded
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		if settled.CompareAndSwap(false, true) {
+			metrics.abandonedDecodes.Add(1)
+			metrics.decodesAbandoned.Inc()
+			return nil, decodeAborted(ctx, "decoding took longer than %s", ImageDecodeTimeout)
+		}
+		result = <-done // декодер успел закончить
+	}
+
+	if result.err != nil {
+		if ctx.Err() != nil {
+			return nil, decodeAborted(ctx, "decoding took longer than %s", ImageDecodeTimeout)
+		}
+		return nil, rejectImage(RejectMalformed, "cannot decode image: %v", result.err)
+	}
+	return result.img, nil
+}
+
+// decodeAborted возвращает ошибку прерванного декодирования: отмену запроса
+// как есть, истекший бюджет — как отказ decode_timeout
+func decodeAborted(ctx context.Context, format string, args ...any) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return rejectImage(RejectDecodeTimeout, format, args...)
+	}
+	return ctx.Err()
+}
+
+// contextReader перестает отдавать данные после отмены контекста
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// checkTrailingData отклоняет файлы с данными после конца изображения
+// (полиглоты, приклеенные архивы). Допускается только дополнение нулями.
+func checkTrailingData(file io.ReadSeeker, format string, size int64) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := &byteScanner{r: bufio.NewReader(file)}
+
+	var err error
+	switch format {
+	case "png":
+		err = r.skipPNG()
+	case "jpeg":
+		err = r.skipJPEG()
+	case "gif":
+		err = r.skipGIF()
+	case "webp":
+		err = r.skipRIFF()
+	case "avif":
+		err = r.skipISOBMFF()
+	case "bmp":
+		err = r.skipBMP()
+	default: // TIFF адресует данные смещениями, конец файла по структуре не определить
+		return nil
+	}
+	if err != nil {
+		return rejectImage(RejectMalformed, "broken %s structure: %v", format, err)
+	}
+	if r.pos > size {
+		return rejectImage(RejectMalformed, "truncated %s file", format)
+	}
+
+	rest, err := io.ReadAll(io.LimitReader(r.r, size-r.pos))
+	if err != nil {
+		return err
+	}
+	if len(bytes.Trim(rest, "\x00")) > 0 {
+		return rejectImage(RejectTrailingData, "%d bytes after end of %s data", len(rest), format)
+	}
+	return nil
+}
+
+// errStructure — нарушение структуры файла изображения
+var errStructure = errors.New("unexpected byte")
+
+// byteScanner читает поток, считая позицию
+type byteScanner struct {
+	r   *bufio.Reader
+	pos int64
+
+	framePixels int64 // суммарная площадь кадров GIF
+}
+
+func (s *byteScanner) byte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.pos++
+	}
+	return b, noEOF(err)
+}
+
+func (s *byteScanner) read(buf []byte) error {
+	n, err := io.ReadFull(s.r, buf)
+	s.pos += int64(n)
+	return noEOF(err)
+}
+
+func (s *byteScanner) skip(n int64) error {
+	copied, err := io.CopyN(io.Discard, s.r, n)
+	s.pos += copied
+	return noEOF(err)
+}
+
+// noEOF превращает конец файла внутри структуры в ошибку обрезанного файла
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// skipPNG проходит чанки PNG до IEND включительно
+func (s *byteScanner) skipPNG() error {
+	if err := s.skip(8); err != nil {
+		return err
+	}
+	header := make([]byte, 8)
+	for {
+		if err := s.read(header); err != nil {
+			return err
+		}
+		// данные чанка и CRC
+		if err := s.skip(int64(binary.BigEndian.Uint32(header[:4])) + 4); err != nil {
+			return err
+		}
+		if string(header[4:]) == "IEND" {
+			return nil
+		}
+	}
+}
+
+// skipJPEG проходит сегменты JPEG до маркера EOI. Сегменты с длиной, включая
+// EXIF с вложенными миниатюрами, пропускаются целиком; после SOS маркер ищется
+// в энтропийных данных.
+func (s *byteScanner) skipJPEG() error {
+	if err := s.skip(2); err != nil { // SOI
+		return err
+	}
+	marker, err := s.marker()
+	for err == nil {
+		switch {
+		case marker == 0xD9: // EOI
+			return nil
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7:
+			marker, err = s.marker()
+			continue
+		}
+
+		length := make([]byte, 2)
+		if err = s.read(length); err != nil {
+			return err
+		}
+		if err = s.skip(int64(binary.BigEndian.Uint16(length)) - 2); err != nil {
+			return err
+		}
+		if marker == 0xDA { // SOS
+			marker, err = s.entropyMarker()
+		} else {
+			marker, err = s.marker()
+		}
+	}
+	return err
+}
+
+// marker читает маркер JPEG, пропуская заполняющие 0xFF
+func (s *byteScanner) marker() (byte, error) {
+	b, err := s.byte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, errStructure
+	}
+	for b == 0xFF {
+		if b, err = s.byte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// entropyMarker пропускает энтропийные данные до первого маркера, кроме RSTn
+func (s *byteScanner) entropyMarker() (byte, error) {
+	for {
+		b, err := s.byte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xFF {
+			continue
+		}
+		for b == 0xFF {
+			if b, err = s.byte(); err != nil {
+				return 0, err
+			}
+		}
+		if b != 0x00 && (b < 0xD0 || b > 0xD7) {
+			return b, nil
+		}
+	}
+}
+
+// skipGIF проходит блоки GIF до завершающего байта 0x3B
+func (s *byteScanner) skipGIF() error {
+	header := make([]byte, 13)
+	if err := s.read(header); err != nil {
+		return err
+	}
+	if err := s.skipColorTable(header[10]); err != nil {
+		return err
+	}
+	descriptor := make([]byte, 9)
+	for {
+		b, err := s.byte()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case 0x21: // расширение: метка и подблоки
+			if err := s.skip(1); err != nil {
+				return err
+			}
+		case 0x2C: // кадр: дескриптор, локальная палитра, размер кода LZW и подблоки
+			if err := s.read(descriptor); err != nil {
+				return err
+			}
+			s.framePixels += int64(binary.LittleEndian.Uint16(descriptor[4:6])) * int64(binary.LittleEndian.Uint16(descriptor[6:8]))
+			if err := s.skipColorTable(descriptor[8]); err != nil {
+				return err
+			}
+			if err := s.skip(1); err != nil {
+				return err
+			}
+		case 0x3B:
+			return nil
+		default:
+			return errStructure
+		}
+		if err := s.skipSubBlocks(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *byteScanner) skipColorTable(flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	return s.skip(3 << ((flags & 0x07) + 1))
+}
+
+func (s *byteScanner) skipSubBlocks() error {
+	for {
+		n, err := s.byte()
+		if err != nil || n == 0 {
+			return err
+		}
+		if err := s.skip(int64(n)); err != nil {
+			return err
+		}
+	}
+}
+
+// skipRIFF пропускает контейнер RIFF (WebP) по размеру из заголовка
+func (s *byteScanner) skipRIFF() error {
+	header := make([]byte, 12)
+	if err := s.read(header); err != nil {
+		return err
+	}
+	size := int64(binary.LittleEndian.Uint32(header[4:8]))
+	size += size & 1
+	return s.skip(size - 4)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// uploadRequest собирает POST /upload с одним файлом в поле image
+func uploadRequest(t *testing.T, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+// pngChunk кодирует чанк PNG с контрольной суммой
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// pngHeaderOnly возвращает PNG, заголовок которого объявляет размеры без пикселей
+func pngHeaderOnly(width, height uint32) []byte {
+	ihdr := binary.BigEndian.AppendUint32(nil, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0) // 8 бит, RGB
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = append(data, pngChunk("IHDR", ihdr)...)
+	return append(data, pngChunk("IEND", nil)...)
+}
+
+// testJPEG кодирует однотонное изображение 16x16
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadRejectsUnsafeImages(t *testing.T) {
+	zipHeader := []byte("PK\x03\x04\x14\x00\x00\x00\x08\x00payload")
+	tests := []struct {
+		name, filename string
+		data           []byte
+		setup          func(t *testing.T)
+		wantCode       string // пусто, если загрузка принимается
+	}{
+		{"clean png", "a.png", testPNG(t, 32), nil, ""},
+		{"png padded with zeros", "a.png", append(testPNG(t, 32), make([]byte, 16)...), nil, ""},
+		{"clean jpeg", "a.jpg", testJPEG(t), nil, ""},
+		{"declared 50000x50000", "a.png", pngHeaderOnly(50000, 50000), nil, RejectDimensions},
+		{"declared 15000x15000", "a.png", pngHeaderOnly(15000, 15000), nil, RejectPixels},
+		{"payload after IEND", "a.png", append(testPNG(t, 32), zipHeader...), nil, RejectTrailingData},
+		{"payload after EOI", "a.jpg", append(testJPEG(t), zipHeader...), nil, RejectTrailingData},
+		{"truncated png", "a.png", testPNG(t, 32)[:60], nil, RejectMalformed},
+		{"decode timeout", "a.png", testPNG(t, 32), func(t *testing.T) {
+			previous := ImageDecodeTimeout
+			ImageDecodeTimeout = time.Nanosecond
+			t.Cleanup(func() { ImageDecodeTimeout = previous })
+		}, RejectDecodeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDataPath(t)
+			withScanner(t, nil, false)
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+
+			rec := httptest.NewRecorder()
+			uploadHandler(rec, uploadRequest(t, tt.filename, tt.data))
+
+			if tt.wantCode == "" {
+				if rec.Code != http.StatusNoContent {
+					t.Errorf("status %d, want upload accepted: %s", rec.Code, rec.Body)
+				}
+				return
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusUnprocessableEntity || body.Code != tt.wantCode {
+				t.Errorf("got %d %q, want 422 %q", rec.Code, body.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// slowReader отдает по байту с задержкой, имитируя долгое декодирование
+type slowReader struct{ *bytes.Reader }
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return r.Reader.Read(p[:min(len(p), 1)])
+}
+
+func TestDecodeTimeoutReleasesSlot(t *testing.T) {
+	previous := ImageDecodeTimeout
+	ImageDecodeTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { ImageDecodeTimeout = previous })
+
+	data := testPNG(t, 64)
+
+	_, err := decodeWithBudget(context.Background(), slowReader{bytes.NewReader(data)})
+	var rejection *ImageRejection
+	if !errors.As(err, &rejection) || rejection.Reason != RejectDecodeTimeout {
+		t.Fatalf("decodeWithBudget() error = %v, want %s", err, RejectDecodeTimeout)
+	}
+
+	// Брошенный декодер упирается в отмененный контекст и освобождает слот
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.abandonedDecodes.Load() != 0 || len(decodeSlots) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned decodes %d, busy slots %d after timeout", metrics.abandonedDecodes.Load(), len(decodeSlots))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Отмена запроса клиентом — не отказ по содержимому
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := decodeWithBudget(ctx, bytes.NewReader(data)); !errors.Is(err, context.Canceled) {
+		t.Errorf("decodeWithBudget() with cancelled request = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logging configuration
+var (
+	LogFormat = "text" // text или json
+	LogLevel  = slog.LevelInfo
+	// LogDebug — совместимость с прежней переменной DEBUG=true
+	LogDebug = false
+)
+
+// RequestIDHeader — заголовок, в котором передается и возвращается ID запроса
+const RequestIDHeader = "X-Request-ID"
+
+// Global logger instance. До initLogger пишет текстом в stderr.
+var logger = slog.New(contextHandler{slog.NewTextHandler(os.Stderr, nil)})
+
+// initLogger настраивает глобальный логгер по конфигурации
+func initLogger(w io.Writer) {
+	level := LogLevel
+	if LogDebug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if LogFormat == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	logger = slog.New(contextHandler{handler})
+	slog.SetDefault(logger)
+}
+
+// requestInfo хранит данные запроса, которые попадают во все его строки лога
+type requestInfo struct {
+	ID     string
+	UserID string
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom возвращает данные запроса из контекста
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setRequestUser запоминает пользователя запроса для лога
+func setRequestUser(r *http.Request, userID string) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.UserID = userID
+	}
+}
+
+// contextHandler добавляет к записи ID запроса и пользователя из контекста
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info := requestInfoFrom(ctx); info != nil {
+		record.AddAttrs(slog.String("request_id", info.ID))
+		if info.UserID != "" {
+			record.AddAttrs(slog.String("user_id", info.UserID))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// accessLog присваивает запросу ID и пишет строку журнала доступа после ответа
+func accessLog(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		info := &requestInfo{ID: incomingRequestID(r)}
+		if info.ID == "" {
+			info.ID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, info.ID)
+		if userID, ok := readSessionID(r); ok {
+			info.UserID = userID
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_ip", clientIP(r)),
+		)
+	}
+}
+
+// incomingRequestID принимает ID от прокси, если он выглядит безопасно для логов
+func incomingRequestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > 128 {
+		return ""
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return ""
+		}
+	}
+	return id
+}
+
+// newRequestID генерирует случайный ID запроса
+func newRequestID() string {
+	return RandomHex(8)
+}
+
+// logLevelValue — настройка уровня логирования
+type logLevelValue struct{ p *slog.Level }
+
+func (v logLevelValue) String() string { return strings.ToLower(v.p.String()) }
+func (v logLevelValue) Set(value string) error {
+	if err := v.p.UnmarshalText([]byte(value)); err != nil {
+		return fmt.Errorf("expected debug, info, warn or error, got %q", value)
+	}
+	return nil
+}
+
+// logFormatValue — настройка формата логов
+type logFormatValue struct{ p *string }
+
+func (v logFormatValue) String() string { return *v.p }
+func (v logFormatValue) Set(value string) error {
+	value = strings.ToLower(value)
+	if value != "text" && value != "json" {
+		return fmt.Errorf("expected text or json, got %q", value)
+	}
+	*v.p = value
+	return nil
+}
@@ -2,75 +2,182 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
 	"syscall"
+	"time"
 )
 
 // Template cache for improved performance
 var templates *template.Template
 
 func main() {
+	// Служебные команды: screenguru <command> [flags] [args]
+	if len(os.Args) > 1 {
+		if cmd, ok := findCommand(os.Args[1]); ok {
+			os.Exit(runCommand(cmd, os.Args[2:]))
+		}
+	}
+
+	// Загрузка и проверка конфигурации: файл, переменные окружения, флаги
+	if err := LoadConfig(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printCommands(os.Stderr)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+
+	if PrintConfig {
+		printConfig(os.Stdout)
+		return
+	}
+
+	initLogger(os.Stderr)
+
 	// Инициализация приложения
 	if err := initializeApp(); err != nil {
-		fmt.Printf("Failed to initialize app: %v\n", err)
+		logger.Error("failed to initialize app", "error", err)
 		os.Exit(1)
 	}
 
-	// Создание HTTP роутера
-	mux := setupRoutes()
+	// Создание HTTP сервера
+	server := newServer(setupRoutes())
 
 	// Запуск cleanup worker
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go startCleanupWorker(ctx)
+	cleanupDone := make(chan struct{})
+	go func() {
+		defer close(cleanupDone)
+		startCleanupWorker(ctx)
+	}()
+	go startStatsReconciler(ctx)
+	webhooks.Start(ctx)
 
 	// Настройка graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	// Запуск сервера
-	serverErr := make(chan error, 1)
+	serverErr := make(chan error, 2)
 	go func() {
-		fmt.Printf("Server starting on %s\n", ServerAddr)
-		serverErr <- http.ListenAndServe(ServerAddr, mux)
+		logger.Info("server starting", "addr", ServerAddr)
+		serverErr <- server.ListenAndServe()
 	}()
 
+	// Отдельный сервер метрик, недоступный снаружи при привязке к внутреннему адресу
+	var metricsServer *http.Server
+	if MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", metricsHandler)
+		metricsServer = &http.Server{Addr: MetricsAddr, Handler: metricsMux, ReadHeaderTimeout: ReadHeaderTimeout}
+		go func() {
+			logger.Info("metrics server starting", "addr", MetricsAddr)
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+	}
+
 	// Ожидание сигнала или ошибки
+	drain := true
 	select {
 	case <-sigChan:
-		fmt.Println("Received shutdown signal")
+		logger.Info("received shutdown signal")
 	case err := <-serverErr:
-		fmt.Printf("Server error: %v\n", err)
+		logger.Error("server error", "error", err)
+		drain = false
+	}
+
+	// /readyz отвечает 503, пока слушатели еще открыты: балансировщик успевает
+	// снять экземпляр до того, как соединения начнут отклоняться
+	shuttingDown.Store(true)
+	if drain && ShutdownDelay > 0 {
+		logger.Info("draining before shutdown", "delay", ShutdownDelay)
+		select {
+		case <-time.After(ShutdownDelay):
+		case <-sigChan:
+			logger.Info("received second shutdown signal, skipping drain delay")
+		}
 	}
 
-	fmt.Println("Shutting down gracefully...")
+	logger.Info("shutting down gracefully", "timeout", ShutdownTimeout)
 	cancel()
+
+	// Дожидаемся завершения активных запросов, но не дольше ShutdownTimeout
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("shutdown timed out, closing remaining connections", "error", err)
+		server.Close()
+	}
+
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+
+	// Cleanup worker прерывает проход между файлами, поэтому ждать его недолго
+	select {
+	case <-cleanupDone:
+	case <-shutdownCtx.Done():
+		logger.Warn("cleanup worker did not stop in time")
+	}
+
+	logger.Info("server stopped")
+}
+
+// newServer создает HTTP сервер с таймаутами из конфигурации
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ServerAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		ReadTimeout:       ReadTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+	}
 }
 
 // initializeApp инициализирует приложение
 func initializeApp() error {
-	// Загружаем конфигурацию из переменных окружения
-	LoadConfig()
+	// Лимитер запросов зависит от загруженной конфигурации
+	rateLimiter = NewRateLimiter(MaxRateLimitEntries)
 
 	// Создание директории для хранения данных
 	if err := EnsureDir(DataPath); err != nil {
 		return err
 	}
 
-	// Подсчет общего количества изображений при запуске приложения
-	TotalImageCount = countAllFilesInDataPath()
-	logger.Info(fmt.Sprintf("Total images on startup: %d", TotalImageCount))
+	// Подсчет содержимого хранилища при запуске приложения
+	if snapshot, err := stats.Reconcile(); err != nil {
+		logger.Error("failed to count stored images", "error", err)
+	} else {
+		logger.Info("storage counted on startup", "users", snapshot.Users, "albums", snapshot.Albums, "images", snapshot.Images, "bytes", snapshot.Bytes)
+	}
+
+	// Сканер загрузок, если настроен, и клиенты вебхуков
+	setupScanner()
+	setupWebhooks()
 
 	// Инициализация секретного ключа для подписи куки
 	if err := loadOrGenerateSecret(); err != nil {
 		return fmt.Errorf("failed to initialize secret: %w", err)
 	}
 
-	// Проверка доступности директории шаблонов
+	// Подключение встроенных ресурсов и каталога перекрытия
+	if err := initAssets(); err != nil {
+		return fmt.Errorf("failed to initialize assets: %w", err)
+	}
+
+	// Загрузка шаблонов
 	if err := checkTemplates(); err != nil {
 		return err
 	}
@@ -80,7 +187,16 @@ func initializeApp() error {
 
 // checkTemplates загружает и кеширует шаблоны
 func checkTemplates() error {
-	tmpl, err := template.ParseGlob(TemplatesPath + "/*.html")
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"baseURL":        func() string { return BaseURL },
+		"bytes":          formatBytes,
+		"adminAction":    newAdminActionForm,
+		"reportAction":   newReportActionForm,
+		"reportStatuses": reportStatuses,
+		"isVideo":        isVideoFile,
+		"videoUploads":   func() bool { return VideoUploads },
+		"canEdit":        isEditableFile,
+	}).ParseFS(assets, "*.html")
 	if err != nil {
 		return fmt.Errorf("failed to load templates: %w", err)
 	}
@@ -92,39 +208,75 @@ func checkTemplates() error {
 func setupRoutes() *http.ServeMux {
 	mux := http.NewServeMux()
 
+	// Все маршруты получают ID запроса, журнал доступа и метрики под своим шаблоном
+	handle := func(route string, handler http.HandlerFunc) {
+		mux.HandleFunc(route, accessLog(route, instrument(route, handler)))
+	}
+
 	// Статические файлы
-	mux.HandleFunc("/static/", handleStaticFiles)
-	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, StaticPath+"/robots.txt")
+	handle("/static/", handleStaticFiles)
+	handle("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, assets, "static/robots.txt")
 	})
-	mux.HandleFunc("/sitemap.xml", sitemapHandler)
+	handle("/sitemap.xml", sitemapHandler)
 
 	// API endpoints
-	mux.HandleFunc("/", indexHandler)
-	mux.HandleFunc("/upload", uploadHandler)
-	mux.HandleFunc("/create-album", createAlbumHandler)
-	mux.HandleFunc("/delete-image", deleteImageHandler)
-	mux.HandleFunc("/delete-album", deleteAlbumHandler)
-	mux.HandleFunc("/delete-user", deleteUserHandler)
-	mux.HandleFunc("/changelog", changelogHandler)
+	handle("/", rateLimitContent(indexHandler))
+	handle("/upload", rateLimit(LimitUpload, csrfProtect(uploadHandler)))
+	handle("/create-album", rateLimit(LimitAlbum, csrfProtect(createAlbumHandler)))
+	handle("/delete-image", rateLimit(LimitDelete, csrfProtect(deleteImageHandler)))
+	handle("/delete-images", rateLimit(LimitDelete, csrfProtect(deleteImagesHandler)))
+	handle("/delete-album", rateLimit(LimitDelete, csrfProtect(deleteAlbumHandler)))
+	handle("/delete-user", rateLimit(LimitDelete, csrfProtect(deleteUserHandler)))
+	handle("/edit-image", rateLimit(LimitUpload, csrfProtect(editImageHandler)))
+	handle("/image-versions", rateLimit(LimitPage, imageVersionsHandler))
+	handle("/restore-image-version", rateLimit(LimitUpload, csrfProtect(restoreImageVersionHandler)))
+	handle("/album-watermark", rateLimit(LimitAlbum, csrfProtect(albumWatermarkHandler)))
+	handle("/similar", rateLimit(LimitPage, similarHandler))
+	handle("/report", rateLimit(LimitReport, csrfProtect(reportHandler)))
+	handle("/webhooks", rateLimit(LimitAlbum, csrfProtect(webhooksHandler)))
+	handle("/webhooks/delete", rateLimit(LimitAlbum, csrfProtect(deleteWebhookHandler)))
+	handle("/changelog", changelogHandler)
+	handle("/api/stats", rateLimit(LimitPage, statsHandler))
+	handle("/api/token", rateLimit(LimitPage, apiTokenHandler))
+
+	// Проверки для оркестратора
+	handle("/healthz", healthzHandler)
+	handle("/readyz", readyzHandler)
+
+	// Раздел администратора подключается, только если задан пароль
+	if AdminPassword != "" {
+		setupAdminRoutes(handle)
+	}
+
+	// Метрики на основном адресе, если не вынесены на отдельный
+	if MetricsAddr == "" {
+		mux.HandleFunc("/metrics", metricsHandler)
+	}
 
 	return mux
 }
 
 // handleStaticFiles обрабатывает статические файлы
 func handleStaticFiles(w http.ResponseWriter, r *http.Request) {
-	filePath := StaticPath + r.URL.Path[len("/static"):]
+	filePath := path.Clean("static/" + strings.TrimPrefix(r.URL.Path, "/static/"))
 
-	// Определение MIME типа
-	setContentType(w, filePath)
+	if !strings.HasPrefix(filePath, "static/") {
+		http.NotFound(w, r)
+		return
+	}
 
 	// Проверка существования файла
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	info, err := fs.Stat(assets, filePath)
+	if err != nil || info.IsDir() {
 		http.NotFound(w, r)
 		return
 	}
 
-	http.ServeFile(w, r, filePath)
+	// Определение MIME типа
+	setContentType(w, filePath)
+
+	http.ServeFileFS(w, r, assets, filePath)
 }
 
 // setContentType устанавливает Content-Type для статических файлов
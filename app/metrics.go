@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics configuration
+var (
+	// MetricsAddr — отдельный адрес для /metrics; если задан, основной сервер метрики не отдает
+	MetricsAddr = ""
+	// MetricsToken — если задан, /metrics требует заголовок Authorization: Bearer <token>
+	MetricsToken = ""
+)
+
+const (
+	// activeSessionWindow — сессия считается активной, если была замечена за это время
+	activeSessionWindow = 15 * time.Minute
+	// maxTrackedSessions ограничивает память под учет активных сессий
+	maxTrackedSessions = 100000
+)
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	cleanupBuckets = []float64{.1, .5, 1, 5, 15, 60, 300, 900}
+)
+
+// counterVec — счетчик с метками в формате Prometheus
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // ключ — значения меток через \xff
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogram хранит распределение наблюдений одной серии
+type histogram struct {
+	counts []uint64 // по числу границ, не накопительно
+	sum    float64
+	count  uint64
+}
+
+// histogramVec — гистограмма с метками в формате Prometheus
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+// Metrics собирает все метрики приложения
+type Metrics struct {
+	requests          *counterVec
+	requestDuration   *histogramVec
+	uploads           *counterVec
+	uploadBytes       *counterVec
+	uploadRejected    *counterVec
+	cleanupRuns       *counterVec
+	cleanupDeleted    *counterVec
+	cleanupDuration   *histogramVec
+	reports           *counterVec
+	scans             *counterVec
+	webhookDeliveries *counterVec
+	transforms        *counterVec
+	reencodes         *counterVec
+	decodesAbandoned  *counterVec
+
+	// abandonedDecodes — брошенные по таймауту декодирования, еще занимающие слот
+	abandonedDecodes atomic.Int64
+
+	sessionsMu sync.Mutex
+	sessions   map[string]time.Time
+}
+
+// NewMetrics создает набор метрик приложения
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:          newCounterVec("screenguru_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code"),
+		requestDuration:   newHistogramVec("screenguru_http_request_duration_seconds", "HTTP request latency by route.", latencyBuckets, "route"),
+		uploads:           newCounterVec("screenguru_uploads_total", "Stored uploads by MIME type.", "mime"),
+		uploadBytes:       newCounterVec("screenguru_upload_bytes_total", "Stored upload bytes by MIME type.", "mime"),
+		uploadRejected:    newCounterVec("screenguru_upload_rejected_total", "Rejected uploads by reason.", "reason"),
+		cleanupRuns:       newCounterVec("screenguru_cleanup_runs_total", "Cleanup passes by result.", "result"),
+		cleanupDeleted:    newCounterVec("screenguru_cleanup_deleted_files_total", "Files deleted by the cleanup worker."),
+		cleanupDuration:   newHistogramVec("screenguru_cleanup_duration_seconds", "Cleanup pass duration.", cleanupBuckets),
+		reports:           newCounterVec("screenguru_abuse_reports_total", "Abuse reports received by reason.", "reason"),
+		scans:             newCounterVec("screenguru_content_scans_total", "Content scanner verdicts, including scanner errors.", "verdict"),
+		webhookDeliveries: newCounterVec("screenguru_webhook_deliveries_total", "Webhook delivery attempts by event and result.", "event", "result"),
+		transforms:        newCounterVec("screenguru_image_transforms_total", "Image transformation requests by cache result.", "result"),
+		reencodes:         newCounterVec("screenguru_upload_reencodes_total", "Uploads re-encoded by the storage policy, by uploaded and stored format.", "from", "to"),
+		decodesAbandoned:  newCounterVec("screenguru_image_decodes_abandoned_total", "Upload check decodes abandoned after the timeout or a cancelled request."),
+		sessions:          make(map[string]time.Time),
+	}
+}
+
+// Global metrics instance
+var metrics = NewMetrics()
+
+// SeenSession отмечает активность сессии
+func (m *Metrics) SeenSession(sessionID string) {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+
+	if _, ok := m.sessions[sessionID]; !ok && len(m.sessions) >= maxTrackedSessions {
+		m.pruneSessions(time.Now())
+		if len(m.sessions) >= maxTrackedSessions {
+			return
+		}
+	}
+	m.sessions[sessionID] = time.Now()
+}
+
+// activeSessions возвращает число сессий, активных за последнее окно
+func (m *Metrics) activeSessions() int {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+	m.pruneSessions(time.Now())
+	return len(m.sessions)
+}
+
+func (m *Metrics) pruneSessions(now time.Time) {
+	for id, seen := range m.sessions {
+		if now.Sub(seen) > activeSessionWindow {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// Write выводит все метрики в текстовом формате Prometheus
+func (m *Metrics) Write(w io.Writer) {
+	m.requests.write(w)
+	m.requestDuration.write(w)
+	m.uploads.write(w)
+	m.uploadBytes.write(w)
+	m.uploadRejected.write(w)
+	m.cleanupRuns.write(w)
+	m.cleanupDeleted.write(w)
+	m.cleanupDuration.write(w)
+	m.reports.write(w)
+	m.scans.write(w)
+	m.webhookDeliveries.write(w)
+	m.transforms.write(w)
+	m.reencodes.write(w)
+	m.decodesAbandoned.write(w)
+
+	fmt.Fprintf(w, "# HELP screenguru_active_sessions Sessions seen in the last %s.\n# TYPE screenguru_active_sessions gauge\nscreenguru_active_sessions %d\n",
+		activeSessionWindow, m.activeSessions())
+	snapshot := stats.Snapshot()
+	for _, gauge := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"screenguru_storage_bytes", "Bytes used by stored images.", snapshot.Bytes},
+		{"screenguru_stored_images", "Stored images.", snapshot.Images},
+		{"screenguru_stored_albums", "Stored albums.", snapshot.Albums},
+		{"screenguru_stored_users", "Users with stored data.", snapshot.Users},
+		{"screenguru_image_decodes_abandoned_running", "Abandoned upload check decodes still holding a decode slot.", m.abandonedDecodes.Load()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", gauge.name, gauge.help, gauge.name, gauge.name, gauge.value)
+	}
+}
+
+// metricsHandler отдает метрики, проверяя токен если он задан
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if MetricsToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(MetricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			ErrorResponseCode(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Write(w)
+}
+
+// statusRecorder запоминает код ответа и число записанных байт
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap позволяет http.ResponseController добраться до исходного writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// instrument оборачивает обработчик сбором метрик запросов по маршруту
+func instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		if sessionID, ok := readSessionID(r); ok {
+			metrics.SeenSession(sessionID)
+		}
+
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		metrics.requests.Inc(route, methodLabel(r.Method), strconv.Itoa(rec.status))
+		metrics.requestDuration.Observe(time.Since(start).Seconds(), route)
+	}
+}
+
+// methodLabel сводит метод запроса к известному набору: метод задает клиент,
+// и произвольные значения плодили бы серии без ограничений
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// sortedKeys возвращает ключи карты в стабильном порядке
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels собирает метки серии; extraName/extraValue добавляют метку le для гистограмм
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var parts []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				parts = append(parts, names[i]+`="`+escapeLabel(value)+`"`)
+			}
+		}
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
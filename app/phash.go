@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	// phashSize — сторона уменьшенного изображения, от которого берется DCT
+	phashSize = 32
+	// phashLowFreq — сторона блока низких частот, дающего 64 бита хеша
+	phashLowFreq = 8
+	// phashSamples — сколько точек по каждой оси берется из исходника;
+	// выборка вместо усреднения всех пикселей делает время хеша независимым от размера
+	phashSamples = 256
+)
+
+// perceptualHash вычисляет 64-битный DCT-хеш изображения. Похожие изображения
+// (пересжатые, уменьшенные, с другим форматом) дают близкие хеши.
+func perceptualHash(img image.Image) uint64 {
+	gray := downscaleGray(img)
+
+	// Двумерное DCT-II: по строкам, затем по столбцам, только нужные частоты
+	var rows [phashSize][phashLowFreq]float64
+	for y := 0; y < phashSize; y++ {
+		for u := 0; u < phashLowFreq; u++ {
+			var sum float64
+			for x := 0; x < phashSize; x++ {
+				sum += gray[y][x] * dctCos[u][x]
+			}
+			rows[y][u] = sum
+		}
+	}
+
+	var coeffs [phashLowFreq * phashLowFreq]float64
+	for v := 0; v < phashLowFreq; v++ {
+		for u := 0; u < phashLowFreq; u++ {
+			var sum float64
+			for y := 0; y < phashSize; y++ {
+				sum += rows[y][u] * dctCos[v][y]
+			}
+			coeffs[v*phashLowFreq+u] = sum
+		}
+	}
+
+	// Медиана без постоянной составляющей, которая отражает только яркость
+	median := medianOf(coeffs[1:])
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// dctCos — таблица косинусов DCT для phashSize точек
+var dctCos = func() (table [phashLowFreq][phashSize]float64) {
+	for u := 0; u < phashLowFreq; u++ {
+		for x := 0; x < phashSize; x++ {
+			table[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * phashSize))
+		}
+	}
+	return table
+}()
+
+// downscaleGray уменьшает изображение до phashSize×phashSize в оттенках серого
+func downscaleGray(img image.Image) (gray [phashSize][phashSize]float64) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return gray
+	}
+
+	var counts [phashSize][phashSize]int
+	for sy := 0; sy < phashSamples; sy++ {
+		y := bounds.Min.Y + sy*h/phashSamples
+		for sx := 0; sx < phashSamples; sx++ {
+			x := bounds.Min.X + sx*w/phashSamples
+			r, g, b, _ := img.At(x, y).RGBA()
+			luma := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+
+			by, bx := sy*phashSize/phashSamples, sx*phashSize/phashSamples
+			gray[by][bx] += luma
+			counts[by][bx]++
+		}
+	}
+
+	for y := range gray {
+		for x := range gray[y] {
+			if counts[y][x] > 0 {
+				gray[y][x] /= float64(counts[y][x]) * 257 // в диапазон 0..255
+			}
+		}
+	}
+	return gray
+}
+
+// medianOf возвращает медиану значений, не изменяя исходный срез
+func medianOf(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	// Вставками: 63 элемента, сортировка из пакета здесь избыточна
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && sorted[j] < sorted[j-1]; j-- {
+			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+		}
+	}
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// hammingDistance возвращает число различающихся битов двух хешей
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// formatPHash переводит перцептивный хеш в 16 hex-символов
+func formatPHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// parsePHash разбирает перцептивный хеш из 16 hex-символов
+func parsePHash(value string) (uint64, error) {
+	if len(value) != 16 {
+		return 0, fmt.Errorf("perceptual hash must be 16 hex characters")
+	}
+	return strconv.ParseUint(value, 16, 64)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+)
+
+const (
+	// placeholderGrid — сторона сетки усредненных цветов, по которой считается BlurHash
+	placeholderGrid = 32
+	// placeholderSamples — длинная сторона уменьшенной копии, с которой работает заглушка;
+	// выборка точек делает время независимым от размера исходника
+	placeholderSamples = 128
+	// blurHashComponents — число компонент по длинной стороне (по короткой на одну меньше)
+	blurHashComponents = 4
+)
+
+// imagePlaceholder вычисляет заглушку для сетки альбома: строку BlurHash и
+// преобладающий цвет в виде #rrggbb. orientation — тег EXIF Orientation, с
+// которым браузер покажет изображение. Прозрачные пиксели не учитываются.
+func imagePlaceholder(img image.Image, orientation int) (blurHash, color string) {
+	small := applyOrientation(sampleImage(img), orientation)
+	bounds := small.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return "", ""
+	}
+
+	// Линейные цвета ячеек, взвешенные по непрозрачности, и гистограмма
+	// цветов по 4 бита на канал для преобладающего цвета. У узких и мелких
+	// изображений сетка не больше самого изображения, иначе часть ячеек
+	// осталась бы пустой и затемняла заглушку.
+	gridW, gridH := min(placeholderGrid, w), min(placeholderGrid, h)
+	cells := make([][][4]float64, gridH)
+	for y := range cells {
+		cells[y] = make([][4]float64, gridW)
+	}
+	buckets := make(map[uint16]*[4]float64)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, a := small.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			if a == 0 {
+				continue
+			}
+			// RGBA возвращает цвет, умноженный на альфу
+			r8, g8, b8 := r*0xff/a, g*0xff/a, b*0xff/a
+			alpha := float64(a) / 0xffff
+
+			cell := &cells[y*gridH/h][x*gridW/w]
+			cell[0] += srgbToLinear(r8) * alpha
+			cell[1] += srgbToLinear(g8) * alpha
+			cell[2] += srgbToLinear(b8) * alpha
+			cell[3] += alpha
+
+			key := uint16(r8>>4)<<8 | uint16(g8>>4)<<4 | uint16(b8>>4)
+			bucket := buckets[key]
+			if bucket == nil {
+				bucket = &[4]float64{}
+				buckets[key] = bucket
+			}
+			bucket[0] += float64(r8) * alpha
+			bucket[1] += float64(g8) * alpha
+			bucket[2] += float64(b8) * alpha
+			bucket[3] += alpha
+		}
+	}
+
+	var dominant *[4]float64
+	for _, bucket := range buckets {
+		if dominant == nil || bucket[3] > dominant[3] {
+			dominant = bucket
+		}
+	}
+	if dominant == nil {
+		return "", "" // полностью прозрачное изображение
+	}
+	color = fmt.Sprintf("#%02x%02x%02x", int(dominant[0]/dominant[3]+0.5), int(dominant[1]/dominant[3]+0.5), int(dominant[2]/dominant[3]+0.5))
+
+	for y := range cells {
+		for x := range cells[y] {
+			if cells[y][x][3] > 0 {
+				for c := 0; c < 3; c++ {
+					cells[y][x][c] /= cells[y][x][3]
+				}
+			}
+		}
+	}
+	componentsX, componentsY := blurHashComponents, blurHashComponents-1
+	if h > w {
+		componentsX, componentsY = componentsY, componentsX
+	}
+	// Ячейки берутся по центрам; компонент не больше, чем ячеек по стороне
+	componentsX, componentsY = min(componentsX, gridW), min(componentsY, gridH)
+	return encodeBlurHash(cells, componentsX, componentsY), color
+}
+
+// sampleImage уменьшает изображение выборкой точек так, чтобы длинная сторона
+// была не больше placeholderSamples, сохраняя пропорции
+func sampleImage(img image.Image) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	sw, sh := w, h
+	if w >= h && w > placeholderSamples {
+		sw, sh = placeholderSamples, max(1, h*placeholderSamples/w)
+	} else if h > w && h > placeholderSamples {
+		sw, sh = max(1, w*placeholderSamples/h), placeholderSamples
+	}
+	small := image.NewRGBA64(image.Rect(0, 0, sw, sh))
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			small.Set(x, y, img.At(bounds.Min.X+x*w/sw, bounds.Min.Y+y*h/sh))
+		}
+	}
+	return small
+}
+
+// displayOrientation возвращает тег EXIF Orientation, с которым браузер
+// покажет хранимый файл; у форматов, кроме JPEG, он всегда 1
+func displayOrientation(file io.ReadSeeker, format string) (int, error) {
+	if format != "jpeg" {
+		return 1, nil
+	}
+	orientation, err := jpegOrientation(file)
+	if err != nil {
+		return 1, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return orientation, err
+}
+
+// encodeBlurHash кодирует сетку линейных цветов cells[y][x] в строку BlurHash
+// (формат https://github.com/woltapp/blurhash)
+func encodeBlurHash(cells [][][4]float64, componentsX, componentsY int) string {
+	gridH, gridW := len(cells), len(cells[0])
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < gridH; y++ {
+				for x := 0; x < gridW; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*(float64(x)+0.5)/float64(gridW)) *
+						math.Cos(math.Pi*float64(j)*(float64(y)+0.5)/float64(gridH))
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * cells[y][x][c]
+					}
+				}
+			}
+			for c := 0; c < 3; c++ {
+				factor[c] /= float64(gridW * gridH)
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	maximumValue := 1.0
+	ac := factors[1:]
+	if len(ac) > 0 {
+		var actualMax float64
+		for _, factor := range ac {
+			for _, v := range factor {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := clampInt(int(math.Floor(actualMax*166-0.5)), 0, 82)
+		maximumValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, factor := range ac {
+		var value int
+		for _, v := range factor {
+			q := clampInt(int(math.Floor(signPow(v/maximumValue, 0.5)*9+9.5)), 0, 18)
+			value = value*19 + q
+		}
+		hash.WriteString(encodeBase83(value, 2))
+	}
+	return hash.String()
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encodeBase83 записывает value заданным числом символов base83
+func encodeBase83(value, length int) string {
+	buf := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		buf[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(buf)
+}
+
+func srgbToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+func clampInt(value, low, high int) int {
+	return max(low, min(high, value))
+}
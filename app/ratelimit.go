@@ -0,0 +1,279 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Классы запросов с раздельными бюджетами
+const (
+	LimitUpload = "upload"
+	LimitAlbum  = "album"
+	LimitDelete = "delete"
+	LimitPage   = "page"
+	LimitFile   = "file"
+	LimitAdmin  = "admin"
+	LimitReport = "report"
+)
+
+// RateLimit описывает бюджет токен-бакета
+type RateLimit struct {
+	PerMinute float64 // скорость пополнения, запросов в минуту
+	Burst     int     // ёмкость бакета
+}
+
+// Rate limiting configuration
+var (
+	RateLimits = map[string]RateLimit{
+		LimitUpload: {PerMinute: 60, Burst: 30},
+		LimitAlbum:  {PerMinute: 10, Burst: 10},
+		LimitDelete: {PerMinute: 60, Burst: 30},
+		LimitPage:   {PerMinute: 600, Burst: 120},
+		LimitFile:   {PerMinute: 6000, Burst: 1000},
+		LimitAdmin:  {PerMinute: 120, Burst: 60},
+		LimitReport: {PerMinute: 2, Burst: 5},
+	}
+
+	// MaxRateLimitEntries ограничивает число отслеживаемых ключей в памяти
+	MaxRateLimitEntries = 10000
+
+	// TrustedProxies — сети, которым разрешено передавать IP клиента в заголовках.
+	// По умолчанию только loopback: сети прокси оператор добавляет сам.
+	TrustedProxies = mustParseCIDRs("127.0.0.0/8,::1/128")
+)
+
+// bucket хранит состояние токен-бакета для одного ключа
+type bucket struct {
+	key      string
+	tokens   float64
+	lastSeen time.Time
+	limit    RateLimit
+}
+
+// RateLimiter — токен-бакет лимитер с ограниченным LRU-хранилищем ключей
+type RateLimiter struct {
+	mu         sync.Mutex
+	buckets    map[string]*list.Element
+	lru        *list.List // начало — самые свежие ключи
+	maxEntries int
+	now        func() time.Time
+}
+
+// NewRateLimiter создает лимитер, хранящий не более maxEntries ключей
+func NewRateLimiter(maxEntries int) *RateLimiter {
+	return &RateLimiter{
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}
+}
+
+// Allow списывает по токену со всех ключей сразу. Если хотя бы в одном бакете
+// токенов нет, ничего не списывается; возвращается этот ключ и время до
+// появления в нем следующего токена.
+func (rl *RateLimiter) Allow(keys []string, limit RateLimit) (bool, string, time.Duration) {
+	if limit.PerMinute <= 0 || limit.Burst <= 0 {
+		return true, "", 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.evictIdle(now)
+
+	buckets := make([]*bucket, 0, len(keys))
+	for _, key := range keys {
+		b := rl.bucket(key, limit, now)
+		if b.tokens < 1 {
+			perSecond := limit.PerMinute / 60
+			wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+			return false, key, wait
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, "", 0
+}
+
+// bucket возвращает пополненный бакет ключа, создавая полный при первом обращении
+func (rl *RateLimiter) bucket(key string, limit RateLimit, now time.Time) *bucket {
+	if el, ok := rl.buckets[key]; ok {
+		b := el.Value.(*bucket)
+		rl.lru.MoveToFront(el)
+		b.refill(now)
+		return b
+	}
+	if rl.lru.Len() >= rl.maxEntries {
+		rl.removeElement(rl.lru.Back())
+	}
+	b := &bucket{key: key, tokens: float64(limit.Burst), lastSeen: now, limit: limit}
+	rl.buckets[key] = rl.lru.PushFront(b)
+	return b
+}
+
+// evictIdle удаляет ключи, бакеты которых уже полностью восполнились:
+// их состояние не отличается от нового бакета
+func (rl *RateLimiter) evictIdle(now time.Time) {
+	for el := rl.lru.Back(); el != nil; el = rl.lru.Back() {
+		b := el.Value.(*bucket)
+		if now.Sub(b.lastSeen) < b.limit.fullAfter() {
+			return
+		}
+		rl.removeElement(el)
+	}
+}
+
+func (rl *RateLimiter) removeElement(el *list.Element) {
+	rl.lru.Remove(el)
+	delete(rl.buckets, el.Value.(*bucket).key)
+}
+
+// refill пополняет бакет пропорционально прошедшему времени
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.lastSeen).Seconds()
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.PerMinute/60)
+	b.lastSeen = now
+}
+
+// fullAfter возвращает время полного восполнения пустого бакета
+func (l RateLimit) fullAfter() time.Duration {
+	return time.Duration(float64(l.Burst) / l.PerMinute * float64(time.Minute))
+}
+
+// Global rate limiter instance, создается в initializeApp после загрузки конфигурации
+var rateLimiter *RateLimiter
+
+// rateLimit оборачивает обработчик проверкой бюджета по IP и по сессии
+func rateLimit(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := RateLimits[class]
+
+		keys := []string{class + "|ip|" + clientIP(r)}
+		if sessionID, ok := readSessionID(r); ok {
+			keys = append(keys, class+"|sid|"+sessionID)
+		}
+
+		if ok, key, wait := rateLimiter.Allow(keys, limit); !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			logger.DebugContext(r.Context(), "rate limit exceeded", "key", key, "retry_after", retryAfter)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			ErrorResponseCode(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// rateLimitContent ограничивает корневой маршрут: файлы изображений и их варианты
+// идут по классу file, чтобы большой альбом не выбирал бюджет страниц
+func rateLimitContent(next http.HandlerFunc) http.HandlerFunc {
+	pages, files := rateLimit(LimitPage, next), rateLimit(LimitFile, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.Count(strings.Trim(r.URL.Path, "/"), "/") == 2 {
+			files(w, r)
+			return
+		}
+		pages(w, r)
+	}
+}
+
+// clientIP определяет IP клиента с учетом доверенных прокси
+func clientIP(r *http.Request) string {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+
+	if !isTrustedProxy(remoteIP) {
+		return remoteIP
+	}
+
+	// Идем по X-Forwarded-For справа налево до первого недоверенного адреса
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !isTrustedProxy(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return remoteIP
+}
+
+// isTrustedProxy проверяет, входит ли адрес в список доверенных прокси
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRateLimit разбирает бюджет в формате "запросов_в_минуту:ёмкость"
+func parseRateLimit(value string) (RateLimit, error) {
+	perMinuteStr, burstStr, found := strings.Cut(value, ":")
+	perMinute, err := strconv.ParseFloat(strings.TrimSpace(perMinuteStr), 64)
+	if err != nil || perMinute < 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate %q", perMinuteStr)
+	}
+
+	burst := int(math.Ceil(perMinute))
+	if found {
+		burst, err = strconv.Atoi(strings.TrimSpace(burstStr))
+		if err != nil || burst < 0 {
+			return RateLimit{}, fmt.Errorf("invalid burst %q", burstStr)
+		}
+	}
+	return RateLimit{PerMinute: perMinute, Burst: burst}, nil
+}
+
+// parseCIDRs разбирает список сетей через запятую
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseCIDRs(value string) []*net.IPNet {
+	networks, err := parseCIDRs(value)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock — управляемое время лимитера
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// newTestLimiter создает лимитер на управляемом времени
+func newTestLimiter(maxEntries int) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rl := NewRateLimiter(maxEntries)
+	rl.now = func() time.Time { return clock.now }
+	return rl, clock
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	rl, clock := newTestLimiter(10)
+	limit := RateLimit{PerMinute: 60, Burst: 2}
+	keys := []string{"page|ip|1.2.3.4"}
+
+	steps := []struct {
+		advance  time.Duration
+		want     bool
+		wantWait time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, time.Second},
+		{400 * time.Millisecond, false, 600 * time.Millisecond},
+		{600 * time.Millisecond, true, 0},
+		{0, false, time.Second},
+		// Простой дольше полного восполнения не дает больше Burst токенов
+		{time.Hour, true, 0},
+		{0, true, 0},
+		{0, false, time.Second},
+	}
+	for i, step := range steps {
+		clock.advance(step.advance)
+		ok, key, wait := rl.Allow(keys, limit)
+		if ok != step.want || wait.Round(time.Millisecond) != step.wantWait {
+			t.Fatalf("step %d: Allow() = %v, wait %v; want %v, wait %v", i, ok, wait, step.want, step.wantWait)
+		}
+		if !ok && key != keys[0] {
+			t.Errorf("step %d: denied key %q, want %q", i, key, keys[0])
+		}
+	}
+}
+
+func TestRateLimiterChecksAllBucketsBeforeSpending(t *testing.T) {
+	rl, _ := newTestLimiter(10)
+	limit := RateLimit{PerMinute: 1, Burst: 2}
+	ip, sid := "upload|ip|1.2.3.4", "upload|sid|abc"
+
+	// Сессия тратит свой бюджет с другого адреса
+	for range 2 {
+		if ok, _, _ := rl.Allow([]string{"upload|ip|5.6.7.8", sid}, limit); !ok {
+			t.Fatal("session budget exhausted too early")
+		}
+	}
+
+	ok, key, _ := rl.Allow([]string{ip, sid}, limit)
+	if ok || key != sid {
+		t.Fatalf("Allow() = %v, key %q; want denied by %q", ok, key, sid)
+	}
+	// Отказ по сессии не списал токен с бакета адреса
+	for i := range 2 {
+		if ok, _, _ := rl.Allow([]string{ip}, limit); !ok {
+			t.Errorf("ip request %d denied: tokens were spent on a rejected request", i)
+		}
+	}
+	if ok, _, _ := rl.Allow([]string{ip}, limit); ok {
+		t.Error("ip budget not exhausted after Burst requests")
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	limit := RateLimit{PerMinute: 60, Burst: 1}
+
+	t.Run("least recently used", func(t *testing.T) {
+		rl, clock := newTestLimiter(2)
+		for _, key := range []string{"a", "b", "a", "c"} {
+			clock.advance(100 * time.Millisecond)
+			rl.Allow([]string{key}, limit)
+		}
+		if _, ok := rl.buckets["b"]; ok {
+			t.Error("b was used least recently but kept")
+		}
+		for _, key := range []string{"a", "c"} {
+			if _, ok := rl.buckets[key]; !ok {
+				t.Errorf("%s evicted, want kept", key)
+			}
+		}
+		if rl.lru.Len() != 2 || len(rl.buckets) != 2 {
+			t.Errorf("limiter holds %d/%d keys, want 2", rl.lru.Len(), len(rl.buckets))
+		}
+	})
+
+	t.Run("idle buckets", func(t *testing.T) {
+		rl, clock := newTestLimiter(10)
+		rl.Allow([]string{"a"}, limit)
+		clock.advance(500 * time.Millisecond)
+		rl.Allow([]string{"b"}, limit)
+
+		// a восполнился полностью и удаляется, b еще нет
+		clock.advance(600 * time.Millisecond)
+		rl.Allow([]string{"c"}, limit)
+		if _, ok := rl.buckets["a"]; ok {
+			t.Error("refilled bucket a kept")
+		}
+		if _, ok := rl.buckets["b"]; !ok {
+			t.Error("bucket b evicted before it refilled")
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	previous := TrustedProxies
+	TrustedProxies = mustParseCIDRs("127.0.0.0/8,10.0.0.0/8")
+	t.Cleanup(func() { TrustedProxies = previous })
+
+	tests := []struct {
+		name, remote, xff, realIP, want string
+	}{
+		{"direct client", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"untrusted peer cannot spoof", "203.0.113.5:1234", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"trusted proxy", "127.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"client-supplied hops are skipped", "127.0.0.1:1234", "6.6.6.6, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"all hops trusted", "127.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"malformed hop", "127.0.0.1:1234", "not-an-ip", "198.51.100.7", "198.51.100.7"},
+		{"real ip header", "10.0.0.1:1234", "", "198.51.100.7", "198.51.100.7"},
+		{"proxy without headers", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"ipv6 peer", "[2001:db8::1]:1234", "198.51.100.1", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(req); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitContentSeparatesFiles(t *testing.T) {
+	previousLimiter, previousLimits := rateLimiter, RateLimits
+	rateLimiter, _ = newTestLimiter(10)
+	RateLimits = map[string]RateLimit{
+		LimitPage: {PerMinute: 1, Burst: 1},
+		LimitFile: {PerMinute: 1, Burst: 3},
+	}
+	t.Cleanup(func() { rateLimiter, RateLimits = previousLimiter, previousLimits })
+
+	handler := rateLimitContent(func(w http.ResponseWriter, r *http.Request) {})
+	for i, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/user/album", http.StatusOK},
+		{"/user/album/a.png", http.StatusOK},
+		{"/user/album/b.png?w=64", http.StatusOK},
+		{"/user/album", http.StatusTooManyRequests},
+		{"/", http.StatusTooManyRequests},
+		{"/user/album/c.png", http.StatusOK},
+		{"/user/album/d.png", http.StatusTooManyRequests},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("request %d %s: status %d, want %d", i, tt.path, rec.Code, tt.want)
+		}
+	}
+}
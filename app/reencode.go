@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// Политики перекодирования загрузок
+const (
+	// ReencodeKeep хранит файлы как загружены
+	ReencodeKeep = "keep"
+	// ReencodeLossless пересобирает PNG с максимальным сжатием и GIF покадрово;
+	// JPEG и WebP хранятся как есть
+	ReencodeLossless = "lossless"
+	// ReencodeJPEG дополнительно переводит крупные фотографии (JPEG и WebP без
+	// прозрачности) в JPEG с качеством ReencodeJPEGQuality
+	ReencodeJPEG = "jpeg"
+)
+
+// Re-encoding configuration
+var (
+	ReencodePolicy = ReencodeKeep
+	// ReencodeJPEGQuality — качество JPEG при конвертации фотографий
+	ReencodeJPEGQuality = 85
+	// ReencodeJPEGMinPixels — площадь, начиная с которой фотография конвертируется
+	ReencodeJPEGMinPixels = 1_000_000
+)
+
+// reencodePolicyValue — настройка политики перекодирования
+type reencodePolicyValue struct{ p *string }
+
+func (v reencodePolicyValue) String() string { return *v.p }
+func (v reencodePolicyValue) Set(value string) error {
+	value = strings.ToLower(value)
+	switch value {
+	case ReencodeKeep, ReencodeLossless, ReencodeJPEG:
+		*v.p = value
+		return nil
+	}
+	return fmt.Errorf("expected %s, %s or %s, got %q", ReencodeKeep, ReencodeLossless, ReencodeJPEG, value)
+}
+
+// reencodedImage — результат перекодирования загрузки
+type reencodedImage struct {
+	data   []byte
+	format string // имя формата, как у image.DecodeConfig
+	width  int
+	height int
+	pixels image.Image // изображение, если пиксели изменились (поворот по EXIF)
+}
+
+// extension возвращает расширение файла для формата
+func (r *reencodedImage) extension() string {
+	if r.format == "jpeg" {
+		return "jpg"
+	}
+	return r.format
+}
+
+// reencodeUpload перекодирует проверенную загрузку по ReencodePolicy. Новый файл
+// собирается только из пикселей, поэтому посторонние чанки, метаданные и
+// вложения исходника в него не попадают. Возвращает nil, если файл хранится как есть.
+func reencodeUpload(ctx context.Context, file io.ReadSeeker, size int64, img image.Image, format string) (*reencodedImage, error) {
+	var buf bytes.Buffer
+	result := &reencodedImage{format: format}
+	switch {
+	case format == "svg":
+		// SVG очищается при любой политике
+		sanitized, err := sanitizeSVG(file)
+		if err != nil {
+			return nil, rejectImage(RejectMalformed, "invalid svg: %v", err)
+		}
+		buf.Write(sanitized)
+
+	case (format == "bmp" || format == "tiff") && ConvertBMPTIFF:
+		if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		result.format = "png"
+
+	case ReencodePolicy == ReencodeKeep:
+		return nil, nil
+
+	case format == "png":
+		if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		// Исходник, сжатый лучше кодировщика Go, хранится как есть
+		if int64(buf.Len()) >= size {
+			return nil, nil
+		}
+
+	case format == "gif":
+		animation, err := decodeGIFFrames(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		if err := gif.EncodeAll(&buf, animation); err != nil {
+			return nil, err
+		}
+
+	case ReencodePolicy == ReencodeJPEG && (format == "jpeg" || format == "webp"):
+		bounds := img.Bounds()
+		if bounds.Dx()*bounds.Dy() < ReencodeJPEGMinPixels || !isOpaque(img) {
+			return nil, nil
+		}
+		// Метаданные не переносятся, поэтому поворот из EXIF применяется к пикселям
+		if format == "jpeg" {
+			orientation, err := jpegOrientation(file)
+			if err != nil {
+				return nil, err
+			}
+			img = applyOrientation(img, orientation)
+		}
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: ReencodeJPEGQuality}); err != nil {
+			return nil, err
+		}
+		result.format, result.pixels = "jpeg", img
+
+	default:
+		return nil, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var config image.Config
+	var err error
+	if result.format == "svg" {
+		config, err = svgConfig(bytes.NewReader(buf.Bytes()))
+	} else {
+		config, _, err = image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.data, result.width, result.height = buf.Bytes(), config.Width, config.Height
+	metrics.reencodes.Inc(format, result.format)
+	return result, nil
+}
+
+// decodeGIFFrames декодирует все кадры GIF. Суммарная площадь кадров
+// проверяется заранее: маленький файл может содержать тысячи огромных кадров.
+func decodeGIFFrames(ctx context.Context, file io.ReadSeeker) (*gif.GIF, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s := &byteScanner{r: bufio.NewReader(file)}
+	if err := s.skipGIF(); err != nil {
+		return nil, rejectImage(RejectMalformed, "broken gif structure: %v", err)
+	}
+	if s.framePixels > ImageDecodeMemory {
+		return nil, rejectImage(RejectPixels, "gif frames need %s to decode", formatBytes(s.framePixels))
+	}
+
+	select {
+	case decodeSlots <- struct{}{}:
+		defer func() { <-decodeSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	animation, err := gif.DecodeAll(file)
+	if err != nil {
+		return nil, rejectImage(RejectMalformed, "cannot decode gif frames: %v", err)
+	}
+	return animation, nil
+}
+
+// isOpaque сообщает, что у изображения нет прозрачных пикселей
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// jpegOrientation возвращает значение тега Orientation из EXIF (1, если его нет)
+func jpegOrientation(file io.ReadSeeker) (int, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 1, err
+	}
+	r := bufio.NewReader(file)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return 1, nil
+	}
+	for {
+		if _, err := io.ReadFull(r, header); err != nil || header[0] != 0xFF {
+			return 1, nil
+		}
+		marker, length := header[1], int(binary.BigEndian.Uint16(header[2:]))-2
+		if marker == 0xDA || marker == 0xD9 || length < 0 {
+			return 1, nil
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1, nil
+		}
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:]), nil
+		}
+	}
+}
+
+// exifOrientation ищет тег Orientation (0x0112) в IFD0 заголовка TIFF
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation поворачивает и отражает изображение согласно тегу EXIF Orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Ориентации 5–8 меняют ширину и высоту местами
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ReportsDirName — скрытый каталог в DataPath с жалобами, по файлу JSON на жалобу
+const ReportsDirName = ".reports"
+
+// MaxReportDetails ограничивает длину комментария к жалобе в символах
+const MaxReportDetails = 2000
+
+// Статусы жалобы
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportHidden    = "hidden"
+	ReportDeleted   = "deleted"
+)
+
+// ReportReasons — допустимые причины жалобы и их подписи для модератора
+var ReportReasons = map[string]string{
+	"illegal":   "Незаконный контент",
+	"sexual":    "Сексуальный контент",
+	"violence":  "Насилие",
+	"copyright": "Нарушение авторских прав",
+	"privacy":   "Личные данные",
+	"spam":      "Спам",
+	"other":     "Другое",
+}
+
+// Report — жалоба на альбом или изображение
+type Report struct {
+	ID         string     `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Status     string     `json:"status"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details,omitempty"`
+	UserID     string     `json:"user_id"`
+	AlbumID    string     `json:"album_id"`
+	Filename   string     `json:"filename,omitempty"`    // пусто — жалоба на альбом целиком
+	ReporterIP string     `json:"reporter_ip,omitempty"` // ключ клиента лимитера, по нему отсекаются повторы
+	ReporterID string     `json:"reporter_id,omitempty"` // сессия отправителя
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+}
+
+// Target возвращает путь объекта жалобы вида user/album[/file]
+func (r Report) Target() string {
+	if r.Filename == "" {
+		return r.UserID + "/" + r.AlbumID
+	}
+	return r.UserID + "/" + r.AlbumID + "/" + r.Filename
+}
+
+// ReasonLabel возвращает подпись причины для шаблона
+func (r Report) ReasonLabel() string {
+	if label, ok := ReportReasons[r.Reason]; ok {
+		return label
+	}
+	return r.Reason
+}
+
+// covers проверяет, относится ли жалоба к объекту или его содержимому
+func (r Report) covers(userID, albumID, filename string) bool {
+	if r.UserID != userID || r.AlbumID != albumID {
+		return false
+	}
+	return filename == "" || r.Filename == filename
+}
+
+// resolve возвращает жалобу, закрытую с данным статусом
+func (r Report) resolve(status, resolvedBy string) Report {
+	now := time.Now().UTC()
+	r.Status = status
+	r.ResolvedAt = &now
+	r.ResolvedBy = resolvedBy
+	return r
+}
+
+// reportsMu сериализует изменения жалоб и защищает индекс открытых жалоб
+var reportsMu sync.Mutex
+
+// openReports — открытые жалобы по ID. Индекс читается с диска при первом
+// обращении, дальше обновляется вместе с файлами: отправка жалобы и счетчик
+// в админке не перечитывают каталог.
+var openReports map[string]Report
+
+// loadOpenReports заполняет индекс открытых жалоб; вызывается под reportsMu
+func loadOpenReports() error {
+	if openReports != nil {
+		return nil
+	}
+	open, err := listReports(ReportOpen)
+	if err != nil {
+		return err
+	}
+	openReports = make(map[string]Report, len(open))
+	for _, report := range open {
+		openReports[report.ID] = report
+	}
+	return nil
+}
+
+func reportsDir() string          { return filepath.Join(DataPath, ReportsDirName) }
+func reportPath(id string) string { return filepath.Join(reportsDir(), id+".json") }
+func newReportID() string         { return RandomHex(6) }
+func validReportID(id string) bool {
+	return len(id) == 12 && strings.Trim(id, "0123456789abcdef") == ""
+}
+
+// reportTargetExists проверяет, что объект жалобы существует
+func reportTargetExists(r Report) bool {
+	path := albumPath(r.UserID, r.AlbumID)
+	if r.Filename != "" {
+		path = imagePath(r.UserID, r.AlbumID, r.Filename)
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// saveReport атомарно записывает жалобу на диск
+func saveReport(report Report) error {
+	if err := EnsureDir(reportsDir()); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicPerm(reportPath(report.ID), bytes.NewReader(data), 0600)
+}
+
+// loadReport читает жалобу по ID
+func loadReport(id string) (Report, error) {
+	var report Report
+	data, err := os.ReadFile(reportPath(id))
+	if os.IsNotExist(err) {
+		return report, fmt.Errorf("report not found")
+	} else if err != nil {
+		return report, err
+	}
+	err = json.Unmarshal(data, &report)
+	return report, err
+}
+
+// listReports возвращает жалобы, новые первыми; status == "" — все
+func listReports(status string) ([]Report, error) {
+	entries, err := os.ReadDir(reportsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var reports []Report
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validReportID(id) {
+			continue
+		}
+		report, err := loadReport(id)
+		if err != nil {
+			logger.Warn("skipping unreadable report", "id", id, "error", err)
+			continue
+		}
+		if status == "" || report.Status == status {
+			reports = append(reports, report)
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].CreatedAt.After(reports[j].CreatedAt) })
+	return reports, nil
+}
+
+// submitReport сохраняет новую жалобу. Повторная жалоба с того же адреса
+// на тот же объект не создает дубликат, а возвращает прежний номер; created
+// сообщает, была ли жалоба новой. Адрес, а не сессия: новую сессию получает
+// любой запрос без cookie.
+func submitReport(report Report) (id string, created bool, err error) {
+	reportsMu.Lock()
+	defer reportsMu.Unlock()
+
+	if err := loadOpenReports(); err != nil {
+		return "", false, err
+	}
+	for _, existing := range openReports {
+		if existing.ReporterIP == report.ReporterIP && existing.Target() == report.Target() {
+			return existing.ID, false, nil
+		}
+	}
+
+	report.ID = newReportID()
+	report.CreatedAt = time.Now().UTC()
+	report.Status = ReportOpen
+	if err := saveReport(report); err != nil {
+		return "", false, err
+	}
+	openReports[report.ID] = report
+	return report.ID, true, nil
+}
+
+// resolveReports закрывает открытые жалобы на объект и его содержимое
+func resolveReports(userID, albumID, filename, status, resolvedBy string) error {
+	reportsMu.Lock()
+	defer reportsMu.Unlock()
+
+	if err := loadOpenReports(); err != nil {
+		return err
+	}
+
+	var errs []error
+	for id, report := range openReports {
+		if !report.covers(userID, albumID, filename) {
+			continue
+		}
+		if err := saveReport(report.resolve(status, resolvedBy)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(openReports, id)
+	}
+	return errors.Join(errs...)
+}
+
+// resolveReport закрывает одну жалобу без действий над объектом
+func resolveReport(id, status, resolvedBy string) error {
+	reportsMu.Lock()
+	defer reportsMu.Unlock()
+
+	report, err := loadReport(id)
+	if err != nil {
+		return err
+	}
+	if err := saveReport(report.resolve(status, resolvedBy)); err != nil {
+		return err
+	}
+	if openReports != nil {
+		delete(openReports, id)
+	}
+	return nil
+}
+
+// countOpenReports возвращает число жалоб, ожидающих решения
+func countOpenReports() int {
+	reportsMu.Lock()
+	defer reportsMu.Unlock()
+
+	if err := loadOpenReports(); err != nil {
+		logger.Warn("failed to load open reports", "error", err)
+		return 0
+	}
+	return len(openReports)
+}
+
+// reportHandler принимает жалобу на альбом или изображение и возвращает ее номер
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := Report{
+		UserID:     r.FormValue("user_id"),
+		AlbumID:    r.FormValue("album_id"),
+		Filename:   r.FormValue("filename"),
+		Reason:     r.FormValue("reason"),
+		Details:    strings.TrimSpace(r.FormValue("details")),
+		ReporterIP: clientIP(r),
+		ReporterID: getSessionID(w, r),
+	}
+
+	if _, ok := ReportReasons[report.Reason]; !ok {
+		ErrorResponseCode(w, http.StatusBadRequest, "invalid_reason", "Unknown report reason")
+		return
+	}
+	if utf8.RuneCountInString(report.Details) > MaxReportDetails {
+		ErrorResponseCode(w, http.StatusBadRequest, "details_too_long", fmt.Sprintf("Details must be at most %d characters", MaxReportDetails))
+		return
+	}
+	if !validStorageID(report.UserID) || !validStorageID(report.AlbumID) ||
+		(report.Filename != "" && !validStorageID(report.Filename)) || !reportTargetExists(report) {
+		ErrorResponseCode(w, http.StatusNotFound, "target_not_found", "Reported content not found")
+		return
+	}
+
+	id, created, err := submitReport(report)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to save report", "error", err)
+		ErrorResponseCode(w, http.StatusInternalServerError, "report_failed", "Could not save the report")
+		return
+	}
+
+	if created {
+		metrics.reports.Inc(report.Reason)
+		logger.InfoContext(r.Context(), "abuse report received", "report_id", id, "target", report.Target(), "reason", report.Reason)
+	}
+	SuccessResponse(w, map[string]string{"reference_id": id})
+}
+
+// hideContent убирает объект жалобы из публичного доступа в карантин
+func hideContent(ctx context.Context, userID, albumID, filename string) error {
+	if filename != "" {
+		return quarantineImage(ctx, userID, albumID, filename)
+	}
+
+	images, err := getUserImages(ctx, userID, albumID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, image := range images {
+		errs = append(errs, quarantineImage(ctx, userID, albumID, image.Filename))
+	}
+	return errors.Join(errs...)
+}
+
+// deleteContent удаляет объект жалобы
+func deleteContent(ctx context.Context, userID, albumID, filename string) error {
+	if filename != "" {
+		return deleteImage(ctx, userID, albumID, filename)
+	}
+	return deleteAlbum(ctx, userID, albumID)
+}
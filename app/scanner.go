@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Решения сканера содержимого
+const (
+	ScanAllow      = "allow"
+	ScanQuarantine = "quarantine"
+	ScanReject     = "reject"
+)
+
+// Scanner configuration
+var (
+	// ScannerCommand — локальная программа проверки; путь к файлу передается последним аргументом
+	ScannerCommand = ""
+	// ScannerURL — адрес HTTP сервиса проверки, принимающего содержимое файла в теле POST
+	ScannerURL = ""
+	// ScannerToken — Bearer-токен для ScannerURL
+	ScannerToken = ""
+	// ScannerTimeout ограничивает одну проверку
+	ScannerTimeout = 30 * time.Second
+	// ScannerFailOpen публикует загрузку, если сканер недоступен или ответил ошибкой;
+	// по умолчанию такая загрузка отклоняется
+	ScannerFailOpen = false
+)
+
+// maxScannerResponse ограничивает чтение ответа сканера
+const maxScannerResponse = 64 * 1024
+
+// errScanUnavailable возвращается, когда сканер не ответил, а загрузка без проверки запрещена
+var errScanUnavailable = errors.New("content scanner unavailable")
+
+// errUploadHeld возвращается, когда загрузка отправлена сканером на проверку модератору
+var errUploadHeld = errors.New("upload held for review")
+
+// ScanRequest описывает проверяемую загрузку
+type ScanRequest struct {
+	Path        string // временный файл, еще не видимый в альбоме
+	ContentType string
+	UserID      string
+	AlbumID     string
+	Filename    string // имя, под которым файл будет опубликован
+}
+
+// ScanResult — решение сканера
+type ScanResult struct {
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Scanner проверяет загрузку до публикации
+type Scanner interface {
+	Scan(ctx context.Context, req ScanRequest) (ScanResult, error)
+}
+
+// ScannerFunc позволяет использовать функцию как Scanner, например заглушку в тестах
+type ScannerFunc func(ctx context.Context, req ScanRequest) (ScanResult, error)
+
+func (f ScannerFunc) Scan(ctx context.Context, req ScanRequest) (ScanResult, error) {
+	return f(ctx, req)
+}
+
+// contentScanner — сканер, настроенный при запуске; nil — проверка отключена
+var contentScanner Scanner
+
+// setupScanner создает сканер по конфигурации
+func setupScanner() {
+	switch {
+	case ScannerCommand != "":
+		contentScanner = &commandScanner{args: strings.Fields(ScannerCommand)}
+		logger.Info("content scanner enabled", "command", ScannerCommand, "timeout", ScannerTimeout, "fail_open", ScannerFailOpen)
+	case ScannerURL != "":
+		contentScanner = &webhookScanner{url: ScannerURL, token: ScannerToken, client: &http.Client{}}
+		logger.Info("content scanner enabled", "url", ScannerURL, "timeout", ScannerTimeout, "fail_open", ScannerFailOpen)
+	default:
+		contentScanner = nil
+	}
+}
+
+// scanUpload проверяет загрузку настроенным сканером. Ошибка сканера
+// превращается в решение согласно ScannerFailOpen.
+func scanUpload(ctx context.Context, req ScanRequest) (ScanResult, error) {
+	if contentScanner == nil {
+		return ScanResult{Verdict: ScanAllow}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ScannerTimeout)
+	defer cancel()
+
+	started := time.Now()
+	result, err := contentScanner.Scan(ctx, req)
+	if err == nil {
+		err = result.validate()
+	}
+	if err != nil {
+		metrics.scans.Inc("error")
+		logger.ErrorContext(ctx, "content scan failed", "album_id", req.AlbumID, "fail_open", ScannerFailOpen, "error", err)
+		if ScannerFailOpen {
+			return ScanResult{Verdict: ScanAllow, Reason: "scanner error"}, nil
+		}
+		return ScanResult{}, errScanUnavailable
+	}
+
+	metrics.scans.Inc(result.Verdict)
+	logger.DebugContext(ctx, "content scanned", "file", req.Filename, "verdict", result.Verdict, "reason", result.Reason, "duration", time.Since(started))
+	return result, nil
+}
+
+// validate проверяет, что решение сканера известно
+func (r ScanResult) validate() error {
+	switch r.Verdict {
+	case ScanAllow, ScanQuarantine, ScanReject:
+		return nil
+	}
+	return fmt.Errorf("unknown verdict %q", r.Verdict)
+}
+
+// commandScanner запускает локальную программу с путем к файлу последним аргументом.
+// Программа печатает в stdout решение и, через пробел, причину, например
+// "reject malware"; ненулевой код выхода считается ошибкой сканера.
+type commandScanner struct {
+	args []string
+}
+
+func (s *commandScanner) Scan(ctx context.Context, req ScanRequest) (ScanResult, error) {
+	cmd := exec.CommandContext(ctx, s.args[0], append(s.args[1:], req.Path)...)
+	cmd.Env = append(os.Environ(),
+		"SCREENGURU_CONTENT_TYPE="+req.ContentType,
+		"SCREENGURU_USER_ID="+req.UserID,
+		"SCREENGURU_ALBUM_ID="+req.AlbumID,
+	)
+	// Дочерние процессы программы могут держать stdout открытым после ее остановки
+	cmd.WaitDelay = time.Second
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ScanResult{}, ctx.Err()
+		}
+		return ScanResult{}, fmt.Errorf("%w: %s", err, truncate(strings.TrimSpace(stderr.String()), 200))
+	}
+
+	line, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+	verdict, reason, _ := strings.Cut(strings.TrimSpace(line), " ")
+	return ScanResult{Verdict: strings.ToLower(verdict), Reason: strings.TrimSpace(reason)}, nil
+}
+
+// webhookScanner отправляет содержимое файла POST запросом и ожидает
+// ответ 2xx с JSON {"verdict": "...", "reason": "..."}
+type webhookScanner struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *webhookScanner) Scan(ctx context.Context, req ScanRequest) (ScanResult, error) {
+	file, err := os.Open(req.Path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, file)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	httpReq.ContentLength = info.Size()
+	httpReq.Header.Set("Content-Type", req.ContentType)
+	httpReq.Header.Set("X-Screenguru-User", req.UserID)
+	httpReq.Header.Set("X-Screenguru-Album", req.AlbumID)
+	httpReq.Header.Set("X-Screenguru-Filename", req.Filename)
+	if s.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxScannerResponse))
+	if err != nil {
+		return ScanResult{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ScanResult{}, fmt.Errorf("scanner returned %s", resp.Status)
+	}
+
+	var result ScanResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return ScanResult{}, fmt.Errorf("invalid scanner response: %w", err)
+	}
+	result.Verdict = strings.ToLower(result.Verdict)
+	return result, nil
+}
+
+// truncate обрезает строку до n байт
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withDataPath направляет DataPath во временный каталог на время теста
+func withDataPath(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	previous := DataPath
+	DataPath = dir
+	t.Cleanup(func() { DataPath = previous })
+	return dir
+}
+
+// withScanner подменяет настроенный сканер на время теста
+func withScanner(t *testing.T, scanner Scanner, failOpen bool) {
+	t.Helper()
+	previous, previousFailOpen, previousTimeout := contentScanner, ScannerFailOpen, ScannerTimeout
+	contentScanner, ScannerFailOpen = scanner, failOpen
+	t.Cleanup(func() {
+		contentScanner, ScannerFailOpen, ScannerTimeout = previous, previousFailOpen, previousTimeout
+	})
+}
+
+// verdictScanner возвращает одно и то же решение для любого файла
+func verdictScanner(verdict string) ScannerFunc {
+	return func(ctx context.Context, req ScanRequest) (ScanResult, error) {
+		return ScanResult{Verdict: verdict, Reason: "test"}, nil
+	}
+}
+
+// writeScanTemp создает временный файл загрузки в каталоге альбома
+func writeScanTemp(t *testing.T, userID, albumID, filename string) string {
+	t.Helper()
+	if err := EnsureDir(albumPath(userID, albumID)); err != nil {
+		t.Fatal(err)
+	}
+	tmpPath, err := writeTempFile(imagePath(userID, albumID, filename), bytes.NewReader([]byte("image")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpPath
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestPublishScannedVerdicts(t *testing.T) {
+	tests := []struct {
+		verdict         string
+		wantErr         error
+		published, held bool
+	}{
+		{ScanAllow, nil, true, false},
+		{ScanQuarantine, errUploadHeld, false, true},
+		{ScanReject, errUploadRejected, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.verdict, func(t *testing.T) {
+			withDataPath(t)
+			withScanner(t, verdictScanner(tt.verdict), false)
+
+			tmpPath := writeScanTemp(t, "user", "album", "a.png")
+			err := publishScanned(context.Background(), tmpPath, "image/png", "user", "album", "a.png")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("publishScanned() error = %v, want %v", err, tt.wantErr)
+			}
+			if fileExists(tmpPath) {
+				t.Error("temporary file left behind")
+			}
+			if got := fileExists(imagePath("user", "album", "a.png")); got != tt.published {
+				t.Errorf("published = %v, want %v", got, tt.published)
+			}
+			if got := fileExists(quarantinePath("user", "album", "a.png")); got != tt.held {
+				t.Errorf("quarantined = %v, want %v", got, tt.held)
+			}
+		})
+	}
+}
+
+func TestScanUploadTimeout(t *testing.T) {
+	// Сканер, который отвечает только после отмены контекста
+	slow := ScannerFunc(func(ctx context.Context, req ScanRequest) (ScanResult, error) {
+		<-ctx.Done()
+		return ScanResult{}, ctx.Err()
+	})
+
+	t.Run("fail closed", func(t *testing.T) {
+		withDataPath(t)
+		withScanner(t, slow, false)
+		ScannerTimeout = 20 * time.Millisecond
+
+		tmpPath := writeScanTemp(t, "user", "album", "a.png")
+		err := publishScanned(context.Background(), tmpPath, "image/png", "user", "album", "a.png")
+		if !errors.Is(err, errScanUnavailable) {
+			t.Fatalf("publishScanned() error = %v, want %v", err, errScanUnavailable)
+		}
+		if fileExists(tmpPath) || fileExists(imagePath("user", "album", "a.png")) {
+			t.Error("upload kept although the scanner timed out")
+		}
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		withDataPath(t)
+		withScanner(t, slow, true)
+		ScannerTimeout = 20 * time.Millisecond
+
+		tmpPath := writeScanTemp(t, "user", "album", "a.png")
+		if err := publishScanned(context.Background(), tmpPath, "image/png", "user", "album", "a.png"); err != nil {
+			t.Fatalf("publishScanned() error = %v, want upload published", err)
+		}
+		if !fileExists(imagePath("user", "album", "a.png")) {
+			t.Error("upload not published although the scanner fails open")
+		}
+	})
+}
+
+func TestScanUploadUnknownVerdict(t *testing.T) {
+	withScanner(t, verdictScanner("maybe"), false)
+	if _, err := scanUpload(context.Background(), ScanRequest{}); !errors.Is(err, errScanUnavailable) {
+		t.Errorf("scanUpload() error = %v, want %v", err, errScanUnavailable)
+	}
+}
+
+// testPNG кодирует градиент заданной ширины и высотой 16 px
+func testPNG(t *testing.T, width int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessUploadHoldsOneOfSeveralFiles(t *testing.T) {
+	withDataPath(t)
+	// Сканер задерживает только изображение шириной 64 px
+	withScanner(t, ScannerFunc(func(ctx context.Context, req ScanRequest) (ScanResult, error) {
+		file, err := os.Open(req.Path)
+		if err != nil {
+			return ScanResult{}, err
+		}
+		defer file.Close()
+		config, _, err := image.DecodeConfig(file)
+		if err != nil {
+			return ScanResult{}, err
+		}
+		if config.Width == 64 {
+			return ScanResult{Verdict: ScanQuarantine, Reason: "needs review"}, nil
+		}
+		return ScanResult{Verdict: ScanAllow}, nil
+	}), false)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for i, width := range []int{32, 64, 48} {
+		part, err := form.CreateFormFile("image", string(rune('a'+i))+".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(testPNG(t, width))
+	}
+	form.Close()
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if err := req.ParseMultipartForm(MaxFileSize); err != nil {
+		t.Fatal(err)
+	}
+
+	err := processUpload(context.Background(), getUploadFiles(req), "user", "album")
+	if !errors.Is(err, errUploadHeld) {
+		t.Fatalf("processUpload() error = %v, want %v", err, errUploadHeld)
+	}
+
+	images, err := getUserImages(context.Background(), "user", "album")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Errorf("album has %d images, want the 2 allowed ones", len(images))
+	}
+
+	held, err := os.ReadDir(filepath.Join(DataPath, QuarantineDirName, "user", "album"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 1 {
+		t.Fatalf("quarantine has %d files, want 1", len(held))
+	}
+	// В карантине именно задержанное сканером изображение
+	file, err := os.Open(filepath.Join(DataPath, QuarantineDirName, "user", "album", held[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if config, _, err := image.DecodeConfig(file); err != nil || config.Width != 64 {
+		t.Errorf("quarantined %s is %dpx wide (%v), want the 64px image", held[0].Name(), config.Width, err)
+	}
+}
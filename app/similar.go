@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// SimilarPHashDistance — максимальное расстояние Хэмминга между перцептивными
+// хешами, при котором изображения считаются похожими (пересжатие, обрезка краев)
+var SimilarPHashDistance = 6
+
+// minHashBlockBits — наименьшая длина блока хеша, при которой поиск по блокам
+// быстрее полного перебора пар
+const minHashBlockBits = 8
+
+// findSimilarImages группирует похожие изображения во всех альбомах пользователя.
+// Группа — связная компонента: каждое изображение похоже хотя бы на одно
+// другое из группы. Изображения в группе идут от старых к новым.
+func findSimilarImages(ctx context.Context, userID string) ([][]ImageInfo, error) {
+	albums, err := getUserAlbums(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []ImageInfo
+	var hashes []uint64
+	for _, album := range albums {
+		albumImages, err := getUserImages(ctx, userID, album.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range backfillPHashes(ctx, userID, album.ID, albumImages) {
+			if hash, err := parsePHash(info.PHash); err == nil {
+				images = append(images, info)
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+
+	groups := newUnionFind(len(images))
+	matchNearHashes(hashes, SimilarPHashDistance, groups.union)
+
+	members := make(map[int][]ImageInfo)
+	for i, info := range images {
+		root := groups.find(i)
+		members[root] = append(members[root], info)
+	}
+	var result [][]ImageInfo
+	for _, group := range members {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].UploadedAt.Before(group[j].UploadedAt) })
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if len(result[i]) != len(result[j]) {
+			return len(result[i]) > len(result[j])
+		}
+		return result[i][0].UploadedAt.Before(result[j][0].UploadedAt)
+	})
+	return result, nil
+}
+
+// backfillPHashes вычисляет недостающие перцептивные хеши изображений,
+// загруженных до их появления в индексе, и сохраняет их в индекс альбома
+func backfillPHashes(ctx context.Context, userID, albumID string, images []ImageInfo) []ImageInfo {
+	var updated []ImageInfo
+	for i, info := range images {
+		if info.PHash != "" || info.Format == "" || !canDecodePixels(info.Format) || info.Width*info.Height > maxHashPixels {
+			continue
+		}
+		hashes, err := hashImageFile(info.Path)
+		if err != nil || !hashes.HasPHash {
+			continue
+		}
+		images[i].PHash = formatPHash(hashes.PHash)
+		updated = append(updated, images[i])
+	}
+	if len(updated) > 0 {
+		indexImage(ctx, userID, albumID, updated...)
+	}
+	return images
+}
+
+// matchNearHashes вызывает match для каждой пары хешей, различающихся не больше
+// чем на radius бит. Хеш делится на radius+1 блоков: у такой пары хотя бы один
+// блок совпадает целиком, поэтому сравниваются только хеши с общим блоком, а не
+// все пары. При большом radius блоки слишком короткие, чтобы отсеивать
+// кандидатов, и быстрее сравнить все пары.
+func matchNearHashes(hashes []uint64, radius int, match func(i, j int)) {
+	blocks := radius + 1
+	if 64/blocks < minHashBlockBits {
+		for i, hash := range hashes {
+			for j := range i {
+				if hammingDistance(hash, hashes[j]) <= radius {
+					match(i, j)
+				}
+			}
+		}
+		return
+	}
+
+	buckets := make([]map[uint64][]int, blocks)
+	for b := range buckets {
+		buckets[b] = make(map[uint64][]int)
+	}
+
+	compared := make(map[int]bool)
+	for i, hash := range hashes {
+		clear(compared)
+		for b := range buckets {
+			key := hashBlock(hash, b, blocks)
+			for _, j := range buckets[b][key] {
+				if !compared[j] {
+					compared[j] = true
+					if hammingDistance(hash, hashes[j]) <= radius {
+						match(i, j)
+					}
+				}
+			}
+			buckets[b][key] = append(buckets[b][key], i)
+		}
+	}
+}
+
+// hashBlock возвращает биты блока b из blocks почти равных частей хеша
+func hashBlock(hash uint64, b, blocks int) uint64 {
+	start, end := b*64/blocks, (b+1)*64/blocks
+	return hash << (64 - end) >> (64 - end + start)
+}
+
+// unionFind — система непересекающихся множеств для сборки групп
+type unionFind []int
+
+func newUnionFind(n int) unionFind {
+	parent := make(unionFind, n)
+	for i := range parent {
+		parent[i] = i
+	}
+	return parent
+}
+
+func (u unionFind) find(i int) int {
+	for u[i] != i {
+		u[i] = u[u[i]]
+		i = u[i]
+	}
+	return i
+}
+
+func (u unionFind) union(i, j int) {
+	u[u.find(i)] = u.find(j)
+}
+
+// similarHandler показывает владельцу группы похожих изображений из всех его альбомов
+func similarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	groups, err := findSimilarImages(r.Context(), sessionID)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to find similar images", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Groups          [][]ImageInfo
+		Distance        int
+		SessionID       string
+		CSRFToken       string
+		TotalImageCount int64
+	}{
+		Groups:          groups,
+		Distance:        SimilarPHashDistance,
+		SessionID:       sessionID,
+		CSRFToken:       csrfToken(sessionID),
+		TotalImageCount: stats.Images(),
+	}
+	if err := renderTemplate(w, "similar.html", data); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// deleteImagesHandler удаляет несколько изображений владельца. Каждое значение
+// image имеет вид album/filename.
+func deleteImagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	// Весь список проверяется до удаления первого файла
+	type target struct{ albumID, filename string }
+	var targets []target
+	for _, value := range r.PostForm["image"] {
+		albumID, filename, ok := strings.Cut(value, "/")
+		if !ok || !validStorageID(albumID) || !validStorageID(filename) {
+			http.Error(w, "Invalid image "+value, http.StatusBadRequest)
+			return
+		}
+		targets = append(targets, target{albumID, filename})
+	}
+
+	deleted := 0
+	for _, t := range targets {
+		// Удаленное в другой вкладке или очисткой пропускается
+		if err := deleteImage(r.Context(), sessionID, t.albumID, t.filename); err != nil {
+			logger.WarnContext(r.Context(), "bulk delete skipped image", "album_id", t.albumID, "file", t.filename, "error", err)
+			continue
+		}
+		deleted++
+	}
+	logger.InfoContext(r.Context(), "images deleted", "requested", len(targets), "deleted", deleted)
+
+	http.Redirect(w, r, "/similar", http.StatusSeeOther)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StatsReconcileInterval — как часто счетчики сверяются с содержимым DataPath
+var StatsReconcileInterval = 10 * time.Minute
+
+// StorageStats — снимок содержимого хранилища
+type StorageStats struct {
+	Users  int64 `json:"users"`
+	Albums int64 `json:"albums"`
+	Images int64 `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// Stats хранит счетчики хранилища. Операции с файлами обновляют их атомарно,
+// а периодическая сверка исправляет расхождения после ручных правок на диске.
+type Stats struct {
+	users        atomic.Int64
+	albums       atomic.Int64
+	images       atomic.Int64
+	bytes        atomic.Int64
+	reconciledAt atomic.Int64 // unix-время последней сверки
+}
+
+// Global stats instance
+var stats = &Stats{}
+
+// Snapshot возвращает текущие значения счетчиков
+func (s *Stats) Snapshot() StorageStats {
+	return StorageStats{
+		Users:  s.users.Load(),
+		Albums: s.albums.Load(),
+		Images: s.images.Load(),
+		Bytes:  s.bytes.Load(),
+	}
+}
+
+// Images возвращает число хранимых изображений
+func (s *Stats) Images() int64 { return s.images.Load() }
+
+// ReconciledAt возвращает время последней сверки
+func (s *Stats) ReconciledAt() time.Time {
+	if ts := s.reconciledAt.Load(); ts > 0 {
+		return time.Unix(ts, 0)
+	}
+	return time.Time{}
+}
+
+// UserCreated учитывает новый каталог пользователя
+func (s *Stats) UserCreated() { s.users.Add(1) }
+
+// AlbumCreated учитывает новый каталог альбома
+func (s *Stats) AlbumCreated() { s.albums.Add(1) }
+
+// ImageAdded учитывает сохраненное изображение
+func (s *Stats) ImageAdded(size int64) {
+	s.images.Add(1)
+	s.bytes.Add(size)
+}
+
+// Removed вычитает удаленное содержимое
+func (s *Stats) Removed(removed StorageStats) {
+	s.users.Add(-removed.Users)
+	s.albums.Add(-removed.Albums)
+	s.images.Add(-removed.Images)
+	s.bytes.Add(-removed.Bytes)
+}
+
+// Reconcile пересчитывает счетчики по содержимому DataPath
+func (s *Stats) Reconcile() (StorageStats, error) {
+	actual, err := scanStorage(DataPath)
+	if err != nil {
+		return actual, err
+	}
+
+	before := s.Snapshot()
+	s.users.Store(actual.Users)
+	s.albums.Store(actual.Albums)
+	s.images.Store(actual.Images)
+	s.bytes.Store(actual.Bytes)
+	s.reconciledAt.Store(time.Now().Unix())
+
+	if before != actual {
+		logger.Debug("stats reconciled", "before", before, "actual", actual)
+	}
+	return actual, nil
+}
+
+// Уровни вложенности хранилища: DataPath/<user>/<album>/<image>
+const (
+	levelData = iota
+	levelUser
+	levelAlbum
+	levelImage
+)
+
+// storageLevel возвращает уровень пути относительно DataPath
+func storageLevel(path string) int {
+	rel, err := filepath.Rel(DataPath, path)
+	if err != nil || rel == "." {
+		return levelData
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// scanStorage подсчитывает пользователей, альбомы и изображения в DataPath
+func scanStorage(root string) (StorageStats, error) {
+	return measureTree(root, levelData)
+}
+
+// measureTree подсчитывает содержимое поддерева хранилища, корень которого
+// находится на уровне level. Сам корень учитывается как пользователь или альбом.
+// Скрытые файлы и каталоги пропускаются.
+func measureTree(root string, level int) (StorageStats, error) {
+	var result StorageStats
+	root = filepath.Clean(root)
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // Пропускаем файлы с ошибками доступа
+		}
+
+		depth := level
+		if path != root {
+			if strings.HasPrefix(entry.Name(), ".") {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel := strings.TrimPrefix(path, root+string(filepath.Separator))
+			depth += strings.Count(rel, string(filepath.Separator)) + 1
+		}
+
+		switch {
+		case entry.IsDir() && depth == levelUser:
+			result.Users++
+		case entry.IsDir() && depth == levelAlbum:
+			result.Albums++
+		case entry.IsDir() && depth > levelAlbum:
+			return filepath.SkipDir
+		case !entry.IsDir() && depth == levelImage && IsImageFile(entry.Name()):
+			if info, err := entry.Info(); err == nil {
+				result.Images++
+				result.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	return result, err
+}
+
+// startStatsReconciler периодически сверяет счетчики с диском
+func startStatsReconciler(ctx context.Context) {
+	ticker := time.NewTicker(StatsReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := stats.Reconcile(); err != nil {
+				logger.Error("stats reconciliation failed", "error", err)
+			}
+		}
+	}
+}
+
+// statsHandler отдает счетчики хранилища в JSON
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshot := stats.Snapshot()
+	SuccessResponse(w, struct {
+		StorageStats
+		ReconciledAt time.Time `json:"reconciled_at"`
+	}{snapshot, stats.ReconciledAt()})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStatsConcurrentUpdatesMatchReconcile(t *testing.T) {
+	root := withDataPath(t)
+	s := &Stats{}
+
+	const (
+		users  = 4
+		images = 50
+	)
+	var wg sync.WaitGroup
+	for u := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dir := filepath.Join(root, fmt.Sprintf("user%d", u), "album")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Error(err)
+				return
+			}
+			s.UserCreated()
+			s.AlbumCreated()
+
+			for i := range images {
+				data := make([]byte, 100+i)
+				path := filepath.Join(dir, fmt.Sprintf("%d.png", i))
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					t.Error(err)
+					return
+				}
+				s.ImageAdded(int64(len(data)))
+
+				// Каждое третье изображение сразу удаляется
+				if i%3 == 0 {
+					if err := os.Remove(path); err != nil {
+						t.Error(err)
+						return
+					}
+					s.Removed(StorageStats{Images: 1, Bytes: int64(len(data))})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	before := s.Snapshot()
+	actual, err := s.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != actual {
+		t.Errorf("counters drifted from disk: counted %+v, on disk %+v", before, actual)
+	}
+	if actual.Users != users || actual.Albums != users {
+		t.Errorf("got %d users and %d albums, want %d each", actual.Users, actual.Albums, users)
+	}
+	if s.ReconciledAt().IsZero() {
+		t.Error("ReconciledAt not set")
+	}
+}
+
+func TestStatsReconcileFixesDrift(t *testing.T) {
+	root := withDataPath(t)
+	dir := filepath.Join(root, "user", "album")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg"), make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Скрытые файлы и файлы не изображений не учитываются
+	if err := os.WriteFile(filepath.Join(dir, ".index.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Stats{}
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.ImageAdded(5)
+			s.Snapshot()
+		}()
+	}
+	wg.Wait()
+
+	actual, err := s.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StorageStats{Users: 1, Albums: 1, Images: 1, Bytes: 10}
+	if actual != want {
+		t.Errorf("Reconcile() = %+v, want %+v", actual, want)
+	}
+	if got := s.Snapshot(); got != want {
+		t.Errorf("Snapshot() after Reconcile = %+v, want %+v", got, want)
+	}
+}
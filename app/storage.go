@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -19,17 +23,27 @@ func albumPath(userID, albumID string) string { return filepath.Join(DataPath, u
 func imagePath(userID, albumID, filename string) string {
 	return filepath.Join(DataPath, userID, albumID, filename)
 }
+func secretFilePath() string { return filepath.Join(DataPath, SecretFileName) }
+func quarantinePath(userID, albumID, filename string) string {
+	return filepath.Join(DataPath, QuarantineDirName, userID, albumID, filename)
+}
 
-// Глобальная переменная для хранения общего количества изображений
-var TotalImageCount int
-
-// ImageInfo хранит информацию об изображении
+// ImageInfo хранит информацию об изображении. Метаданные извлекаются при
+// загрузке и хранятся в индексе альбома (см. AlbumIndexFileName).
 type ImageInfo struct {
-	Filename string
-	Path     string
-	Size     int64
-	UserID   string
-	AlbumID  string
+	Filename   string    `json:"filename"`
+	Path       string    `json:"-"`
+	Size       int64     `json:"size"`
+	UserID     string    `json:"-"`
+	AlbumID    string    `json:"-"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	Format     string    `json:"format,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	SHA256     string    `json:"sha256,omitempty"`
+	PHash      string    `json:"phash,omitempty"`    // перцептивный хеш для поиска похожих
+	BlurHash   string    `json:"blurhash,omitempty"` // заглушка плитки в альбоме до загрузки
+	Color      string    `json:"color,omitempty"`    // преобладающий цвет, #rrggbb
 }
 
 // AlbumInfo хранит информацию об альбоме
@@ -41,21 +55,89 @@ type AlbumInfo struct {
 }
 
 // saveImage сохраняет загруженное изображение
-func saveImage(file multipart.File, header *multipart.FileHeader, userID, albumID string) (*ImageInfo, error) {
-	// Проверка размера файла
-	if header.Size > MaxFileSize {
-		return nil, fmt.Errorf("file too large: %d bytes", header.Size)
-	}
-
+func saveImage(ctx context.Context, file multipart.File, header *multipart.FileHeader, userID, albumID string) (*ImageInfo, error) {
 	// Валидация типа изображения
 	extension, valid := validateImageType(file)
-	if !valid {
-		return nil, fmt.Errorf("invalid image type")
+	if !valid || isVideoExtension(extension) && !VideoUploads {
+		return nil, rejectImage(RejectInvalidType, "unsupported image type")
+	}
+
+	// Проверка размера файла; у роликов свой лимит
+	maxSize := MaxFileSize
+	if isVideoExtension(extension) {
+		maxSize = MaxVideoSize
+	}
+	if header.Size > maxSize {
+		return nil, rejectImage(RejectTooLarge, "file too large: %d bytes", header.Size)
+	}
+
+	// Размеры, структура файла и полное декодирование до записи на диск
+	config, format, img, err := inspectImage(ctx, file, header.Size, extension)
+	if err != nil {
+		var rejection *ImageRejection
+		if errors.As(err, &rejection) {
+			logger.WarnContext(ctx, "image rejected", "album_id", albumID, "reason", rejection.Reason, "detail", rejection.Detail)
+		}
+		return nil, err
+	}
+
+	// Проверка по списку блокировки до записи на диск
+	hashes, err := hashDecodedImage(file, img)
+	if err != nil {
+		metrics.uploadRejected.Inc("write_error")
+		return nil, err
+	}
+	if err := checkBlocklist(ctx, hashes, userID, albumID); err != nil {
+		return nil, err
+	}
+
+	phash, hasPHash := hashes.PHash, hashes.HasPHash
+
+	// Перекодирование по политике хранения
+	var src io.Reader = file
+	reencoded, err := reencodeUpload(ctx, file, header.Size, img, format)
+	if err != nil {
+		return nil, err
+	}
+	if reencoded != nil {
+		logger.DebugContext(ctx, "upload re-encoded", "from", format, "to", reencoded.format, "size", header.Size, "stored_size", len(reencoded.data))
+		src = bytes.NewReader(reencoded.data)
+		extension, format = reencoded.extension(), reencoded.format
+		config.Width, config.Height = reencoded.width, reencoded.height
+		if reencoded.pixels != nil {
+			img = reencoded.pixels
+			phash = perceptualHash(img)
+		}
+		if hashes, err = hashDecodedImage(bytes.NewReader(reencoded.data), nil); err != nil {
+			return nil, err
+		}
+		// Блокировка по снятому файлу хранит хеш перекодированной копии, поэтому
+		// повторная загрузка того же исходника сверяется и с ним
+		hashes.PHash, hashes.HasPHash = phash, hasPHash
+		if err := checkBlocklist(ctx, hashes, userID, albumID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Размеры и заглушка плитки — такие, какими браузер покажет файл.
+	// Перекодированный JPEG уже повернут по EXIF.
+	var blurHash, color string
+	if img != nil {
+		orientation := 1
+		if reencoded == nil {
+			if orientation, err = displayOrientation(file, format); err != nil {
+				return nil, err
+			}
+			if orientation >= 5 {
+				config.Width, config.Height = config.Height, config.Width
+			}
+		}
+		blurHash, color = imagePlaceholder(img, orientation)
 	}
 
 	// Создание директории для альбома
 	albumPath := albumPath(userID, albumID)
-	if err := EnsureDir(albumPath); err != nil {
+	if err := ensureAlbumDir(userID, albumID); err != nil {
 		return nil, err
 	}
 
@@ -63,15 +145,30 @@ func saveImage(file multipart.File, header *multipart.FileHeader, userID, albumI
 	filename := generateUniqueFilename(extension)
 	filePath := albumPath + "/" + filename
 
-	// Создание файла
-	dst, err := os.Create(filePath)
+	info := ImageInfo{
+		Filename: filename,
+		Path:     filePath,
+		UserID:   userID,
+		AlbumID:  albumID,
+		Width:    config.Width,
+		Height:   config.Height,
+		Format:   format,
+		SHA256:   hashes.SHA256,
+		BlurHash: blurHash,
+		Color:    color,
+	}
+	if hasPHash {
+		info.PHash = formatPHash(phash)
+	}
+
+	// Запись во временный файл и переименование: недописанный или еще
+	// не проверенный сканером файл никогда не появится в альбоме
+	tmpPath, err := writeTempFile(filePath, src, 0644)
 	if err != nil {
+		metrics.uploadRejected.Inc("write_error")
 		return nil, err
 	}
-	defer dst.Close()
-
-	// Копирование содержимого
-	if _, err := io.Copy(dst, file); err != nil {
+	if err := publishScanned(ctx, tmpPath, imageContentType(extension), userID, albumID, filename); err != nil {
 		return nil, err
 	}
 
@@ -81,20 +178,127 @@ func saveImage(file multipart.File, header *multipart.FileHeader, userID, albumI
 		return nil, err
 	}
 
-	// Увеличиваем глобальный счетчик изображений
-	TotalImageCount++
+	info.Size = stat.Size()
+	info.UploadedAt = stat.ModTime().UTC()
+	indexImage(ctx, userID, albumID, info)
 
-	return &ImageInfo{
-		Filename: filename,
-		Path:     filePath,
-		Size:     stat.Size(),
-		UserID:   userID,
-		AlbumID:  albumID,
-	}, nil
+	stats.ImageAdded(stat.Size())
+	emitImageEvent(EventImageUploaded, userID, albumID, filename, stat.Size())
+
+	contentType := imageContentType(extension)
+	metrics.uploads.Inc(contentType)
+	metrics.uploadBytes.Add(float64(stat.Size()), contentType)
+
+	return &info, nil
+}
+
+// checkBlocklist отклоняет загрузку, хеши которой есть в списке блокировки.
+// Клиент получает общий отказ, чтобы по ответу нельзя было подбирать обход.
+func checkBlocklist(ctx context.Context, hashes imageHashes, userID, albumID string) error {
+	entry, blocked := blocklist.Match(ctx, hashes)
+	if !blocked {
+		return nil
+	}
+	metrics.uploadRejected.Inc("blocked")
+	logger.WarnContext(ctx, "blocked upload rejected", "user_id", userID, "album_id", albumID, "kind", entry.Kind, "hash", entry.Hash)
+	return errUploadRejected
+}
+
+// writeFileAtomic записывает содержимое во временный файл рядом с целевым и переименовывает его
+func writeFileAtomic(filePath string, src io.Reader) error {
+	return writeFileAtomicPerm(filePath, src, 0644)
+}
+
+// writeFileAtomicPerm — writeFileAtomic с заданными правами на файл
+func writeFileAtomicPerm(filePath string, src io.Reader, perm os.FileMode) error {
+	tmpPath, err := writeTempFile(filePath, src, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeTempFile записывает содержимое в скрытый временный файл рядом с filePath
+// и возвращает его путь; переименование остается вызывающему
+func writeTempFile(filePath string, src io.Reader, perm os.FileMode) (string, error) {
+	dst, err := os.CreateTemp(filepath.Dir(filePath), TempFilePrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := dst.Name()
+
+	// os.CreateTemp создает файл с правами 0600
+	if err := dst.Chmod(perm); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// publishScanned проверяет временный файл сканером и, по решению, публикует
+// его в альбоме, переносит в карантин или удаляет
+func publishScanned(ctx context.Context, tmpPath, contentType, userID, albumID, filename string) error {
+	result, err := scanUpload(ctx, ScanRequest{
+		Path:        tmpPath,
+		ContentType: contentType,
+		UserID:      userID,
+		AlbumID:     albumID,
+		Filename:    filename,
+	})
+	if err != nil {
+		os.Remove(tmpPath)
+		metrics.uploadRejected.Inc("scan_error")
+		return err
+	}
+
+	target := userID + "/" + albumID + "/" + filename
+	switch result.Verdict {
+	case ScanReject:
+		os.Remove(tmpPath)
+		metrics.uploadRejected.Inc("scan_rejected")
+		recordAudit(AuditEntry{Actor: "scanner", Action: "scan-reject", Target: target, Result: result.Reason})
+		return errUploadRejected
+	case ScanQuarantine:
+		dst := quarantinePath(userID, albumID, filename)
+		if err := EnsureDir(filepath.Dir(dst)); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := os.Rename(tmpPath, dst); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		metrics.uploadRejected.Inc("scan_quarantined")
+		recordAudit(AuditEntry{Actor: "scanner", Action: "scan-quarantine", Target: target, Result: result.Reason})
+		return errUploadHeld
+	}
+
+	if err := os.Rename(tmpPath, imagePath(userID, albumID, filename)); err != nil {
+		os.Remove(tmpPath)
+		metrics.uploadRejected.Inc("write_error")
+		return err
+	}
+	return nil
 }
 
 // validateImageType проверяет тип изображения
-func validateImageType(file multipart.File) (string, bool) {
+func validateImageType(file io.ReadSeeker) (string, bool) {
 	// Чтение заголовка файла
 	buffer := make([]byte, 512)
 	if _, err := file.Read(buffer); err != nil {
@@ -102,13 +306,13 @@ func validateImageType(file multipart.File) (string, bool) {
 	}
 
 	// Восстановление указателя
-	file.Seek(0, 0)
+	file.Seek(0, io.SeekStart)
 
 	// Определение MIME типа
-	contentType := http.DetectContentType(buffer)
+	contentType := sniffImageType(buffer)
 
 	// Проверка разрешенных типов
-	if !AllowedImageTypes[contentType] {
+	if !AllowedImageTypes[contentType] && !AllowedVideoTypes[contentType] {
 		return "", false
 	}
 
@@ -120,6 +324,20 @@ func validateImageType(file multipart.File) (string, bool) {
 	return "", false
 }
 
+// imageContentType возвращает MIME тип по расширению из ImageExtensions
+func imageContentType(extension string) string {
+	extension = strings.TrimPrefix(strings.ToLower(extension), ".")
+	if extension == "tif" {
+		extension = "tiff"
+	}
+	for contentType, ext := range ImageExtensions {
+		if ext == extension {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
 // generateUniqueFilename генерирует уникальное имя файла
 func generateUniqueFilename(extension string) string {
 	ext := strings.ToLower(extension)
@@ -133,63 +351,69 @@ func generateUniqueFilename(extension string) string {
 	return randomID + ext
 }
 
-// getUserImages возвращает список изображений пользователя
-func getUserImages(userID, albumID string) ([]ImageInfo, error) {
+// getUserImages возвращает список изображений альбома по его индексу.
+// Файлы, которых нет в индексе (например, загруженные до его появления или
+// скопированные вручную), добавляются в индекс, отсутствующие на диске — удаляются.
+func getUserImages(ctx context.Context, userID, albumID string) ([]ImageInfo, error) {
 	dirPath := albumPath(userID, albumID)
 
-	// Проверка существования директории
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		return []ImageInfo{}, nil
-	}
-
 	// Чтение содержимого директории
 	entries, err := os.ReadDir(dirPath)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return []ImageInfo{}, nil
+	} else if err != nil {
 		return nil, err
 	}
 
-	var images []ImageInfo
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
+	unlock := lockAlbumIndex(userID, albumID)
+	defer unlock()
 
+	indexed := readAlbumIndex(ctx, userID, albumID)
+	current := make(map[string]ImageInfo, len(entries))
+	changed := false
+	for _, entry := range entries {
 		filename := entry.Name()
-		if !IsImageFile(filename) {
+		if entry.IsDir() || !IsImageFile(filename) {
 			continue
 		}
 
-		info, err := entry.Info()
-		if err != nil {
-			continue
+		info, ok := indexed[filename]
+		if !ok {
+			if info, err = readImageMeta(filepath.Join(dirPath, filename)); err != nil {
+				logger.WarnContext(ctx, "failed to index image", "user_id", userID, "album_id", albumID, "file", filename, "error", err)
+				continue
+			}
+			changed = true
 		}
-
-		images = append(images, ImageInfo{
-			Filename: filename,
-			Path:     filepath.Join(dirPath, filename),
-			Size:     info.Size(),
-			UserID:   userID,
-			AlbumID:  albumID,
-		})
+		current[filename] = info
 	}
-
-	// Сортировка изображений по времени модификации (старые сверху, новые снизу)
-	sort.Slice(images, func(i, j int) bool {
-		infoI, errI := os.Stat(images[i].Path)
-		infoJ, errJ := os.Stat(images[j].Path)
-
-		if errI != nil || errJ != nil {
-			return false // если не можем получить статус файла, не меняем порядок
+	if len(current) != len(indexed) {
+		changed = true
+	}
+	if changed {
+		if err := writeAlbumIndex(userID, albumID, current); err != nil {
+			logger.ErrorContext(ctx, "failed to update album index", "user_id", userID, "album_id", albumID, "error", err)
 		}
+	}
 
-		return infoI.ModTime().Before(infoJ.ModTime())
-	})
-
+	// Порядок загрузки: старые сверху, новые снизу
+	images := sortedImages(current)
+	for i := range images {
+		images[i].Path = filepath.Join(dirPath, images[i].Filename)
+		images[i].UserID = userID
+		images[i].AlbumID = albumID
+	}
 	return images, nil
 }
 
 // getSessionID получает или генерирует ID сессии пользователя с проверкой подписи
 func getSessionID(w http.ResponseWriter, r *http.Request) string {
+	// Клиенты API передают сессию токеном вместо cookie
+	if sessionID, ok := readAPIToken(r); ok {
+		setRequestUser(r, sessionID)
+		return sessionID
+	}
+
 	// Проверка наличия cookie
 	cookie, err := r.Cookie(SessionCookieName)
 	if err == nil && cookie.Value != "" {
@@ -200,29 +424,27 @@ func getSessionID(w http.ResponseWriter, r *http.Request) string {
 
 			// Проверка подписи
 			if VerifyData(userID, signature) {
-				logger.Debug(fmt.Sprintf("getSessionID: signature verified, userID=%s", userID))
+				// После ротации секрета переподписываем cookie текущим
+				if !IsSignedWithCurrentSecret(userID, signature) {
+					http.SetCookie(w, sessionCookie(userID+":"+SignData(userID), int(SessionMaxAge.Seconds())))
+				}
+				setRequestUser(r, userID)
 				return userID
 			}
-			logger.Error(fmt.Sprintf("getSessionID: INVALID signature for userID=%s", userID))
+			logger.WarnContext(r.Context(), "invalid session signature", "claimed_user_id", userID)
 		} else if len(parts) == 1 {
 			// МИГРАЦИЯ: Если кука без подписи, проверяем существует ли такой пользователь
 			oldUserID := parts[0]
 			userDir := userPath(oldUserID)
 			if info, err := os.Stat(userDir); err == nil && info.IsDir() {
-				logger.Info(fmt.Sprintf("getSessionID: Migrating old user %s to signed session", oldUserID))
+				logger.InfoContext(r.Context(), "migrating unsigned session", "user_id", oldUserID)
 
 				// Подписываем старый ID и обновляем куку
 				signature := SignData(oldUserID)
 				signedValue := fmt.Sprintf("%s:%s", oldUserID, signature)
 
-				http.SetCookie(w, &http.Cookie{
-					Name:     SessionCookieName,
-					Value:    signedValue,
-					Path:     "/",
-					MaxAge:   SessionMaxAge,
-					HttpOnly: true,
-					SameSite: http.SameSiteLaxMode,
-				})
+				http.SetCookie(w, sessionCookie(signedValue, int(SessionMaxAge.Seconds())))
+				setRequestUser(r, oldUserID)
 				return oldUserID
 			}
 		}
@@ -233,39 +455,43 @@ func getSessionID(w http.ResponseWriter, r *http.Request) string {
 	signature := SignData(sessionID)
 	signedValue := fmt.Sprintf("%s:%s", sessionID, signature)
 
-	logger.Debug(fmt.Sprintf("getSessionID: creating new signed session, sessionID=%s", sessionID))
+	setRequestUser(r, sessionID)
+	logger.DebugContext(r.Context(), "new session created")
 
 	// Установка cookie с подписью
-	http.SetCookie(w, &http.Cookie{
+	http.SetCookie(w, sessionCookie(signedValue, int(SessionMaxAge.Seconds())))
+
+	return sessionID
+}
+
+// sessionCookie создает cookie сессии с атрибутами из конфигурации
+func sessionCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
 		Name:     SessionCookieName,
-		Value:    signedValue,
+		Value:    value,
 		Path:     "/",
-		MaxAge:   SessionMaxAge,
+		MaxAge:   maxAge,
 		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
-
-	return sessionID
+		Secure:   SessionCookieSecure,
+		SameSite: SessionSameSite,
+	}
 }
 
 // getUserAlbums возвращает список альбомов пользователя
-func getUserAlbums(userID string) ([]AlbumInfo, error) {
+func getUserAlbums(ctx context.Context, userID string) ([]AlbumInfo, error) {
 	userDir := userPath(userID)
-	logger.Debug(fmt.Sprintf("getUserAlbums: userDir=%s", userDir))
 
 	// Проверка существования директории
 	if _, err := os.Stat(userDir); os.IsNotExist(err) {
-		logger.Debug("getUserAlbums: user dir does not exist")
 		return []AlbumInfo{}, nil
 	}
 
 	// Чтение содержимого директории
 	entries, err := os.ReadDir(userDir)
 	if err != nil {
-		logger.Debug(fmt.Sprintf("getUserAlbums: error reading dir: %v", err))
+		logger.ErrorContext(ctx, "failed to read user directory", "path", userDir, "error", err)
 		return nil, err
 	}
-	logger.Debug(fmt.Sprintf("getUserAlbums: found %d entries", len(entries)))
 
 	var albums []AlbumInfo
 	for _, entry := range entries {
@@ -285,13 +511,13 @@ func getUserAlbums(userID string) ([]AlbumInfo, error) {
 		}
 
 		// Подсчет количества изображений
-		imageCount := countImagesInDir(albumDir)
+		albumStats, _ := measureTree(albumDir, levelAlbum)
 
 		// Добавление альбома в список
 		albums = append(albums, AlbumInfo{
 			ID:         albumID,
 			Name:       albumID,
-			ImageCount: imageCount,
+			ImageCount: int(albumStats.Images),
 			CreatedAt:  createdAt,
 		})
 	}
@@ -307,128 +533,240 @@ func getUserAlbums(userID string) ([]AlbumInfo, error) {
 	return albums, nil
 }
 
-// countImagesInDir подсчитывает количество изображений в директории
-func countImagesInDir(dirPath string) int {
-	count := 0
-	processDir(dirPath, func(entry os.DirEntry) bool {
-		return !entry.IsDir() && IsImageFile(entry.Name())
-	}, func(path string, info os.FileInfo) error {
-		count++
-		return nil
-	})
-	return count
-}
-
 // createAlbum создает новый альбом для пользователя
-func createAlbum(userID string) (string, error) {
+func createAlbum(ctx context.Context, userID string) (string, error) {
 	albumID := RandomID()
 
 	// Создание директории для альбома
-	albumDir := albumPath(userID, albumID)
-	logger.Debug(fmt.Sprintf("createAlbum: creating albumDir=%s", albumDir))
-	if err := EnsureDir(albumDir); err != nil {
+	if err := ensureAlbumDir(userID, albumID); err != nil {
+		logger.ErrorContext(ctx, "failed to create album", "album_id", albumID, "error", err)
 		return "", err
 	}
-	logger.Debug(fmt.Sprintf("createAlbum: album created, albumID=%s", albumID))
+	logger.DebugContext(ctx, "album created", "album_id", albumID)
 
 	return albumID, nil
 }
 
+// ensureAlbumDir создает каталоги пользователя и альбома и учитывает новые в статистике.
+// os.Mkdir атомарен, поэтому при параллельных загрузках каталог учитывается один раз.
+func ensureAlbumDir(userID, albumID string) error {
+	if err := EnsureDir(DataPath); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(userPath(userID), DefaultFilePerm); err == nil {
+		stats.UserCreated()
+	} else if !os.IsExist(err) {
+		return err
+	}
+
+	if err := os.Mkdir(albumPath(userID, albumID), DefaultFilePerm); err == nil {
+		stats.AlbumCreated()
+	} else if !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
 // deleteImage удаляет изображение
-func deleteImage(userID, albumID, filename string) error {
+func deleteImage(ctx context.Context, userID, albumID, filename string) error {
 	filePath := imagePath(userID, albumID, filename)
 
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
 		return fmt.Errorf("image not found")
+	} else if err != nil {
+		return err
 	}
 
-	err := os.Remove(filePath)
-	if err == nil {
-		// Уменьшаем глобальный счетчик изображений
-		TotalImageCount--
+	if err := os.Remove(filePath); err != nil {
+		return err
 	}
-	return err
+	unindexImage(ctx, userID, albumID, filename)
+	purgeTransforms(ctx, userID, albumID, filename)
+	purgeImageVersions(ctx, userID, albumID, filename)
+
+	if IsImageFile(filename) {
+		stats.Removed(StorageStats{Images: 1, Bytes: info.Size()})
+		emitImageEvent(EventImageDeleted, userID, albumID, filename, info.Size())
+	}
+	return nil
 }
 
 // deleteAlbum удаляет альбом со всеми изображениями
-func deleteAlbum(userID, albumID string) error {
+func deleteAlbum(ctx context.Context, userID, albumID string) error {
 	albumDir := albumPath(userID, albumID)
 
 	if _, err := os.Stat(albumDir); os.IsNotExist(err) {
 		return fmt.Errorf("album not found")
 	}
 
-	// Подсчитываем количество изображений в альбоме перед удалением
-	imageCount := countImagesInDir(albumDir)
+	// Подсчитываем содержимое альбома перед удалением
+	removed, err := measureTree(albumDir, levelAlbum)
 
-	err := os.RemoveAll(albumDir)
+	if errRemove := os.RemoveAll(albumDir); errRemove != nil {
+		return errRemove
+	}
+	purgeTransforms(ctx, userID, albumID, "")
+	purgeImageVersions(ctx, userID, albumID, "")
 	if err == nil {
-		// Уменьшаем глобальный счетчик изображений на количество удаленных изображений
-		TotalImageCount -= imageCount
+		stats.Removed(removed)
 	}
-	return err
+	emitAlbumEvent(EventAlbumDeleted, userID, albumID)
+	return nil
 }
 
 // deleteUser удаляет все данные пользователя
-func deleteUser(userID string) error {
+func deleteUser(ctx context.Context, userID string) error {
 	userDir := userPath(userID)
 
 	if _, err := os.Stat(userDir); os.IsNotExist(err) {
 		return fmt.Errorf("user directory not found")
 	}
 
-	// Подсчитываем количество изображений в пользовательской директории перед удалением
-	totalImages := 0
-	// Рекурсивный обход всей директории пользователя
-	err := filepath.Walk(userDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			// Пропускаем ошибки доступа к файлам
-			return nil
-		}
+	// Подсчитываем содержимое пользователя перед удалением
+	removed, err := measureTree(userDir, levelUser)
+	albums, _ := os.ReadDir(userDir)
 
-		// Пропускаем директории
-		if !info.IsDir() {
-			// Проверяем, является ли файл изображением
-			if IsImageFile(info.Name()) {
-				totalImages++
-			}
+	if errRemove := os.RemoveAll(userDir); errRemove != nil {
+		return errRemove
+	}
+	purgeTransforms(ctx, userID, "", "")
+	purgeImageVersions(ctx, userID, "", "")
+	if err == nil {
+		stats.Removed(removed)
+	}
+
+	// События рассылаются до удаления вебхуков пользователя: получатели уже выбраны
+	for _, album := range albums {
+		if album.IsDir() && !strings.HasPrefix(album.Name(), ".") {
+			emitAlbumEvent(EventAlbumDeleted, userID, album.Name())
 		}
+	}
+	if _, err := removeWebhooks(func(hook Webhook) bool { return hook.UserID == userID }); err != nil {
+		logger.ErrorContext(ctx, "failed to remove user webhooks", "user_id", userID, "error", err)
+	}
+	return nil
+}
 
-		return nil
-	})
+// quarantineImage переносит изображение в карантин: оно пропадает из публичного
+// доступа и статистики, но остается на диске до решения модератора
+func quarantineImage(ctx context.Context, userID, albumID, filename string) error {
+	src := imagePath(userID, albumID, filename)
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("image not found")
+	} else if err != nil {
+		return err
+	}
+
+	dst := quarantinePath(userID, albumID, filename)
+	if err := EnsureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	unindexImage(ctx, userID, albumID, filename)
+	purgeTransforms(ctx, userID, albumID, filename)
+	purgeImageVersions(ctx, userID, albumID, filename)
 
-	errRemove := os.RemoveAll(userDir)
-	if errRemove == nil && err == nil {
-		// Уменьшаем глобальный счетчик изображений на количество удаленных изображений
-		TotalImageCount -= totalImages
+	if IsImageFile(filename) {
+		stats.Removed(StorageStats{Images: 1, Bytes: info.Size()})
 	}
-	return errRemove
+	return nil
 }
 
-// countAllFilesInDataPath подсчитывает количество всех файлов в директории data при запуске приложения
-func countAllFilesInDataPath() int {
-	count := 0
+// restoreImage возвращает изображение из карантина в альбом
+func restoreImage(ctx context.Context, userID, albumID, filename string) error {
+	src := quarantinePath(userID, albumID, filename)
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("quarantined image not found")
+	} else if err != nil {
+		return err
+	}
+
+	dst := imagePath(userID, albumID, filename)
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("image already exists")
+	}
+	if err := ensureAlbumDir(userID, albumID); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	removeEmptyQuarantineDirs(userID, albumID)
+	if meta, err := readImageMeta(dst); err == nil {
+		indexImage(ctx, userID, albumID, meta)
+	}
+
+	if IsImageFile(filename) {
+		stats.ImageAdded(info.Size())
+	}
+	return nil
+}
 
-	// Рекурсивный обход всей директории DataPath
-	err := filepath.Walk(DataPath, func(path string, info os.FileInfo, err error) error {
+// deleteQuarantined окончательно удаляет изображение из карантина
+func deleteQuarantined(userID, albumID, filename string) error {
+	if err := os.Remove(quarantinePath(userID, albumID, filename)); os.IsNotExist(err) {
+		return fmt.Errorf("quarantined image not found")
+	} else if err != nil {
+		return err
+	}
+	removeEmptyQuarantineDirs(userID, albumID)
+	return nil
+}
+
+// removeEmptyQuarantineDirs убирает опустевшие каталоги карантина.
+// os.Remove не удаляет непустые каталоги, поэтому ошибки игнорируются.
+func removeEmptyQuarantineDirs(userID, albumID string) {
+	albumDir := filepath.Join(DataPath, QuarantineDirName, userID, albumID)
+	os.Remove(albumDir)
+	os.Remove(filepath.Dir(albumDir))
+}
+
+// getQuarantinedImages возвращает все изображения в карантине
+func getQuarantinedImages() ([]ImageInfo, error) {
+	root := filepath.Join(DataPath, QuarantineDirName)
+	var images []ImageInfo
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			// Пропускаем ошибки доступа к файлам
+			if path == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
 			return nil
 		}
 
-		// Пропускаем директории
-		if !info.IsDir() {
-			count++
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) != 3 {
+			return nil
 		}
 
+		var size int64
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		images = append(images, ImageInfo{
+			Filename: parts[2],
+			Path:     path,
+			Size:     size,
+			UserID:   parts[0],
+			AlbumID:  parts[1],
+		})
 		return nil
 	})
 
-	if err != nil {
-		logger.Error(fmt.Sprintf("countAllFilesInDataPath: error walking data directory: %v", err))
-	}
-
-	return count
+	return images, err
 }
 
 // loadOrGenerateSecret загружает секрет из файла или генерирует новый
@@ -438,28 +776,64 @@ func loadOrGenerateSecret() error {
 		return nil
 	}
 
+	// Предыдущий секрет остается после rotate-secret
+	if previous, err := os.ReadFile(filepath.Join(DataPath, PreviousSecretFileName)); err == nil && len(previous) >= 32 {
+		PreviousAppSecret = previous
+	}
+
 	// Пробуем прочитать из файла
-	data, err := os.ReadFile(SecretFilePath)
+	data, err := os.ReadFile(secretFilePath())
 	if err == nil && len(data) >= 32 {
 		AppSecret = data
-		logger.Info("App secret loaded from file")
+		logger.Info("app secret loaded from file", "previous_secret", len(PreviousAppSecret) > 0)
 		return nil
 	}
 
 	// Генерируем новый секрет
-	secret := make([]byte, 32)
-	// Используем crypto/rand напрямую здесь для безопасности
-	if _, err := rand.Read(secret); err != nil {
-		return fmt.Errorf("failed to generate random secret: %v", err)
+	secret, err := generateSecret()
+	if err != nil {
+		return err
 	}
 
 	// Сохраняем в файл
-	if err := os.WriteFile(SecretFilePath, secret, 0600); err != nil {
-		logger.Error(fmt.Sprintf("Failed to save secret to file: %v. Sessions will not persist across restarts.", err))
+	if err := os.WriteFile(secretFilePath(), secret, 0600); err != nil {
+		logger.Error("failed to save app secret, sessions will not persist across restarts", "error", err)
 	} else {
-		logger.Info("New app secret generated and saved")
+		logger.Info("new app secret generated and saved")
 	}
 
 	AppSecret = secret
 	return nil
 }
+
+// generateSecret генерирует новый секрет для подписи cookie
+func generateSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	// Используем crypto/rand напрямую здесь для безопасности
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate random secret: %v", err)
+	}
+	return secret, nil
+}
+
+// rotateSecret заменяет секрет новым, сохраняя текущий как предыдущий.
+// Cookie, подписанные прежним секретом, принимаются до следующей ротации.
+func rotateSecret() error {
+	current, err := os.ReadFile(secretFilePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		return err
+	}
+
+	if len(current) >= 32 {
+		previousPath := filepath.Join(DataPath, PreviousSecretFileName)
+		if err := writeFileAtomicPerm(previousPath, bytes.NewReader(current), 0600); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomicPerm(secretFilePath(), bytes.NewReader(secret), 0600)
+}
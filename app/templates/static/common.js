@@ -32,6 +32,9 @@ document.addEventListener('DOMContentLoaded', function () {
   // Инициализация темы
   initTheme();
 
+  // Размытые заглушки плиток до загрузки изображений
+  initPlaceholders();
+
 });
 
 // Функции для работы с темами
@@ -96,7 +99,8 @@ function handleUpload(files, form) {
   // Иначе создаем новый альбом на сервере
   fetch('/create-album', {
     method: 'POST',
-    credentials: 'same-origin'
+    credentials: 'same-origin',
+    headers: csrfHeaders()
   })
     .then(response => response.json())
     .then(data => {
@@ -112,10 +116,22 @@ function handleUpload(files, form) {
     });
 }
 
+// uploadRejectReasons — тексты для причин отказа, которые сервер возвращает в поле code
+const uploadRejectReasons = {
+  too_large: 'файл слишком большой',
+  invalid_type: 'неподдерживаемый формат',
+  malformed_image: 'файл повреждён или не является изображением',
+  dimensions_too_large: 'слишком большое разрешение',
+  too_many_pixels: 'слишком большое разрешение',
+  decode_timeout: 'файл слишком долго обрабатывается',
+  trailing_data: 'после изображения в файле есть посторонние данные'
+};
+
 // uploadFilesParallel отправляет файлы параллельно небольшими пачками
 function uploadFilesParallel(files, albumID, sessionID) {
   const total = files.length;
   let completed = 0;
+  let held = 0;
   const progress = showUploadProgress(total);
   const concurrencyLimit = 3; // Загружаем по 3 файла одновременно
   let currentIndex = 0;
@@ -142,13 +158,19 @@ function uploadFilesParallel(files, albumID, sessionID) {
           method: 'POST',
           body: formData,
           credentials: 'same-origin',
-          headers: {
+          headers: csrfHeaders({
             'X-Requested-With': 'XMLHttpRequest'
-          }
+          })
         });
 
         if (!response.ok) {
-          throw new Error('Upload failed for ' + file.name);
+          const body = await response.json().catch(() => ({}));
+          const reason = uploadRejectReasons[body.code];
+          throw new Error(file.name + (reason ? ': ' + reason : ' не загружен'));
+        }
+        // 202: файл принят, но появится в альбоме только после проверки
+        if (response.status === 202) {
+          held++;
         }
 
         completed++;
@@ -170,6 +192,9 @@ function uploadFilesParallel(files, albumID, sessionID) {
   Promise.all(workers)
     .then(() => {
       progress.hide();
+      if (held > 0) {
+        alert('Файлов на проверке: ' + held + '. Они появятся в альбоме после проверки модератором.');
+      }
       window.location.href = '/' + sessionID + '/' + albumID;
     })
     .catch(error => {
@@ -191,6 +216,16 @@ function getSessionID() {
   return '';
 }
 
+// csrfHeaders добавляет CSRF-токен страницы к заголовкам запроса
+function csrfHeaders(headers) {
+  const result = headers || {};
+  const meta = document.querySelector('meta[name="csrf-token"]');
+  if (meta) {
+    result['X-CSRF-Token'] = meta.getAttribute('content');
+  }
+  return result;
+}
+
 const EMPTY_STATE_HTML = `
   <div class="empty-state">
     <div class="empty-icon">📂</div>
@@ -263,7 +298,8 @@ function deleteImage(sessionID, albumID, filename, button) {
 
   fetch('/delete-image', {
     method: 'POST',
-    body: formData
+    body: formData,
+    headers: csrfHeaders()
   })
     .then(response => {
       if (response.ok) {
@@ -290,13 +326,239 @@ function deleteImage(sessionID, albumID, filename, button) {
     });
 }
 
+// Жалоба на альбом (filename пустой) или изображение
+function openReport(userID, albumID, filename) {
+  const modal = document.getElementById('reportModal');
+  const form = document.getElementById('reportForm');
+  if (!modal || !form) return;
+
+  form.reset();
+  form.elements.user_id.value = userID;
+  form.elements.album_id.value = albumID;
+  form.elements.filename.value = filename;
+  document.getElementById('reportResult').textContent = '';
+  document.getElementById('reportSubmit').disabled = false;
+
+  modal.classList.add('active');
+  document.body.style.overflow = 'hidden';
+}
+
+function submitReport(event) {
+  event.preventDefault();
+  const form = event.target;
+  const result = document.getElementById('reportResult');
+  const submit = document.getElementById('reportSubmit');
+  submit.disabled = true;
+
+  fetch('/report', {
+    method: 'POST',
+    body: new FormData(form),
+    headers: csrfHeaders()
+  })
+    .then(response => response.json().then(body => ({ ok: response.ok, status: response.status, body })))
+    .then(({ ok, status, body }) => {
+      if (ok) {
+        result.textContent = 'Жалоба отправлена. Номер обращения: ' + body.data.reference_id;
+        return;
+      }
+      submit.disabled = false;
+      if (status === 429) {
+        result.textContent = 'Слишком много жалоб, попробуйте позже';
+      } else {
+        result.textContent = 'Не удалось отправить жалобу';
+      }
+    })
+    .catch(error => {
+      console.error('Error:', error);
+      submit.disabled = false;
+      result.textContent = 'Не удалось отправить жалобу';
+    });
+}
+
+function closeReport() {
+  document.getElementById('reportModal').classList.remove('active');
+  document.body.style.overflow = '';
+}
+
+function openWatermark() {
+  document.getElementById('watermarkModal').classList.add('active');
+  document.body.style.overflow = 'hidden';
+}
+
+function closeWatermark() {
+  document.getElementById('watermarkModal').classList.remove('active');
+  document.body.style.overflow = '';
+}
+
+// Редактор изображения: выделение области мышью и правки на сервере
+let editor = null;
+
+function openEditor(userID, albumID, filename) {
+  const modal = document.getElementById('editModal');
+  if (!modal) return;
+  editor = { userID, albumID, filename, selection: null, changed: false };
+  document.getElementById('editResult').textContent = '';
+  reloadEditorImage();
+  loadVersions();
+  initEditorSelection();
+  modal.classList.add('active');
+  document.body.style.overflow = 'hidden';
+}
+
+function closeEditor() {
+  document.getElementById('editModal').classList.remove('active');
+  document.body.style.overflow = '';
+  // Новые размеры и заглушки приходят с сервера вместе со страницей
+  if (editor && editor.changed) location.reload();
+  editor = null;
+}
+
+function reloadEditorImage() {
+  const img = document.getElementById('editImage');
+  img.src = '/' + editor.userID + '/' + editor.albumID + '/' + editor.filename + '?v=' + Date.now();
+  editor.selection = null;
+  document.getElementById('editSelection').style.display = 'none';
+}
+
+function initEditorSelection() {
+  const stage = document.getElementById('editStage');
+  if (stage.dataset.ready) return;
+  stage.dataset.ready = '1';
+  const img = document.getElementById('editImage');
+  const box = document.getElementById('editSelection');
+  let start = null;
+
+  const point = function (e) {
+    const rect = img.getBoundingClientRect();
+    return {
+      x: Math.min(Math.max(e.clientX - rect.left, 0), rect.width),
+      y: Math.min(Math.max(e.clientY - rect.top, 0), rect.height)
+    };
+  };
+  const update = function (e) {
+    const p = point(e);
+    const x = Math.min(start.x, p.x), y = Math.min(start.y, p.y);
+    const w = Math.abs(p.x - start.x), h = Math.abs(p.y - start.y);
+    box.style.left = x + 'px';
+    box.style.top = y + 'px';
+    box.style.width = w + 'px';
+    box.style.height = h + 'px';
+    box.style.display = 'block';
+    // Координаты на сервере — в пикселях исходного изображения
+    const scale = img.naturalWidth / img.clientWidth;
+    editor.selection = [x, y, w, h].map(v => Math.round(v * scale));
+  };
+
+  stage.addEventListener('pointerdown', function (e) {
+    if (!editor) return;
+    start = point(e);
+    stage.setPointerCapture(e.pointerId);
+    e.preventDefault();
+  });
+  stage.addEventListener('pointermove', function (e) {
+    if (start) update(e);
+  });
+  stage.addEventListener('pointerup', function (e) {
+    if (!start) return;
+    update(e);
+    start = null;
+    if (editor.selection[2] < 1 || editor.selection[3] < 1) {
+      editor.selection = null;
+      box.style.display = 'none';
+    }
+  });
+}
+
+function applyEdit(op, angle) {
+  if (!editor) return;
+  const result = document.getElementById('editResult');
+  const formData = new FormData();
+  formData.append('album_id', editor.albumID);
+  formData.append('filename', editor.filename);
+  formData.append('op', op);
+  if (op === 'rotate') {
+    formData.append('angle', angle);
+  } else if (editor.selection) {
+    formData.append('rect', editor.selection.join(','));
+  } else {
+    result.textContent = 'Сначала выделите область на изображении';
+    return;
+  }
+
+  result.textContent = 'Сохраняем...';
+  fetch('/edit-image', { method: 'POST', body: formData, headers: csrfHeaders() })
+    .then(response => response.json().then(body => ({ ok: response.ok, body })))
+    .then(({ ok, body }) => {
+      if (!ok) {
+        result.textContent = body.error || 'Не удалось изменить изображение';
+        return;
+      }
+      editor.changed = true;
+      result.textContent = 'Готово: ' + body.data.width + '×' + body.data.height;
+      reloadEditorImage();
+      loadVersions();
+    })
+    .catch(() => {
+      result.textContent = 'Не удалось изменить изображение';
+    });
+}
+
+function loadVersions() {
+  const list = document.getElementById('editVersions');
+  const query = '?album_id=' + encodeURIComponent(editor.albumID) + '&filename=' + encodeURIComponent(editor.filename);
+  fetch('/image-versions' + query)
+    .then(response => response.json())
+    .then(body => {
+      const versions = body.data;
+      list.innerHTML = '';
+      if (!Array.isArray(versions) || versions.length === 0) {
+        const empty = document.createElement('li');
+        empty.textContent = 'Версий пока нет';
+        list.appendChild(empty);
+        return;
+      }
+      versions.forEach(version => {
+        const item = document.createElement('li');
+        const link = document.createElement('a');
+        link.href = '/image-versions' + query + '&version=' + version.id;
+        link.target = '_blank';
+        link.textContent = new Date(version.created_at).toLocaleString() + ' · ' + (version.size / 1024).toFixed(1) + ' KiB';
+        const restore = document.createElement('button');
+        restore.className = 'copy-btn';
+        restore.textContent = 'Восстановить';
+        restore.onclick = () => restoreVersion(version.id);
+        item.append(link, restore);
+        list.appendChild(item);
+      });
+    });
+}
+
+function restoreVersion(id) {
+  const formData = new FormData();
+  formData.append('album_id', editor.albumID);
+  formData.append('filename', editor.filename);
+  formData.append('version', id);
+  fetch('/restore-image-version', { method: 'POST', body: formData, headers: csrfHeaders() })
+    .then(response => {
+      if (!response.ok) throw new Error();
+      editor.changed = true;
+      document.getElementById('editResult').textContent = 'Версия восстановлена';
+      reloadEditorImage();
+      loadVersions();
+    })
+    .catch(() => {
+      document.getElementById('editResult').textContent = 'Не удалось восстановить версию';
+    });
+}
+
 function deleteUser() {
   if (!confirm('Вы уверены, что хотите удалить весь профиль со всеми альбомами и изображениями? Это действие необратимо!')) {
     return;
   }
 
   fetch('/delete-user', {
-    method: 'POST'
+    method: 'POST',
+    headers: csrfHeaders()
   })
     .then(response => {
       if (response.ok) {
@@ -340,6 +602,107 @@ function closeZoom() {
   overlay.classList.remove('active');
 }
 
+// initPlaceholders рисует BlurHash фоном еще не загруженных изображений.
+// Пропорции и преобладающий цвет задаются в разметке и видны сразу; после
+// загрузки фон убирается, чтобы не просвечивать сквозь прозрачные области.
+function initPlaceholders() {
+  document.querySelectorAll('img[data-blurhash]').forEach(function (img) {
+    const clear = function () {
+      img.style.backgroundImage = '';
+      img.style.backgroundColor = '';
+    };
+    if (img.complete) {
+      clear();
+      return;
+    }
+    const url = blurHashToDataURL(img.dataset.blurhash, 32, 32);
+    if (url) {
+      img.style.backgroundImage = 'url(' + url + ')';
+      img.style.backgroundSize = '100% 100%';
+    }
+    img.addEventListener('load', clear, { once: true });
+  });
+}
+
+const base83Chars = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+
+function decodeBase83(str) {
+  let value = 0;
+  for (const c of str) {
+    const digit = base83Chars.indexOf(c);
+    if (digit < 0) {
+      return NaN;
+    }
+    value = value * 83 + digit;
+  }
+  return value;
+}
+
+function srgbToLinear(value) {
+  const v = value / 255;
+  return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+}
+
+function linearToSrgb(value) {
+  const v = Math.max(0, Math.min(1, value));
+  return v <= 0.0031308 ? Math.round(v * 12.92 * 255) : Math.round((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+}
+
+// blurHashToDataURL декодирует BlurHash в картинку width×height; null для некорректной строки
+function blurHashToDataURL(hash, width, height) {
+  if (!hash || hash.length < 6) {
+    return null;
+  }
+  const sizeFlag = decodeBase83(hash[0]);
+  const numX = (sizeFlag % 9) + 1;
+  const numY = Math.floor(sizeFlag / 9) + 1;
+  if (hash.length !== 4 + 2 * numX * numY) {
+    return null;
+  }
+  const maximumValue = (decodeBase83(hash[1]) + 1) / 166;
+
+  const colors = [];
+  const dc = decodeBase83(hash.substring(2, 6));
+  colors.push([srgbToLinear(dc >> 16), srgbToLinear((dc >> 8) & 255), srgbToLinear(dc & 255)]);
+  for (let i = 1; i < numX * numY; i++) {
+    const value = decodeBase83(hash.substring(4 + i * 2, 6 + i * 2));
+    colors.push([Math.floor(value / (19 * 19)), Math.floor(value / 19) % 19, value % 19].map(function (q) {
+      const v = (q - 9) / 9;
+      return Math.sign(v) * v * v * maximumValue;
+    }));
+  }
+  if (colors.some(function (c) { return c.some(isNaN); })) {
+    return null;
+  }
+
+  const canvas = document.createElement('canvas');
+  canvas.width = width;
+  canvas.height = height;
+  const ctx = canvas.getContext('2d');
+  const pixels = ctx.createImageData(width, height);
+  for (let y = 0; y < height; y++) {
+    for (let x = 0; x < width; x++) {
+      let r = 0, g = 0, b = 0;
+      for (let j = 0; j < numY; j++) {
+        for (let i = 0; i < numX; i++) {
+          const basis = Math.cos(Math.PI * x * i / width) * Math.cos(Math.PI * y * j / height);
+          const color = colors[i + j * numX];
+          r += color[0] * basis;
+          g += color[1] * basis;
+          b += color[2] * basis;
+        }
+      }
+      const offset = 4 * (x + y * width);
+      pixels.data[offset] = linearToSrgb(r);
+      pixels.data[offset + 1] = linearToSrgb(g);
+      pixels.data[offset + 2] = linearToSrgb(b);
+      pixels.data[offset + 3] = 255;
+    }
+  }
+  ctx.putImageData(pixels, 0, 0);
+  return canvas.toDataURL();
+}
+
 
 // convertToWebP конвертирует изображение в формат WebP
 function convertToWebP(file) {
@@ -350,6 +713,11 @@ function convertToWebP(file) {
       resolve(file);
       return;
     }
+    // Вектор и анимация при растеризации в WebP теряются: загружаем как есть
+    if (file.type === 'image/svg+xml' || file.type === 'image/gif') {
+      resolve(file);
+      return;
+    }
 
     // Создаем объект FileReader для чтения файла
     const reader = new FileReader();
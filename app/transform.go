@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// TransformCacheDir — скрытый каталог в DataPath с кешем преобразованных изображений:
+// .cache/transforms/<user>/<album>/<file>/<variant>.<ext>
+const TransformCacheDir = ".cache/transforms"
+
+// Transform configuration
+var (
+	// TransformSizes — допустимые значения w и h; пустой список отключает преобразования.
+	// Ограниченный набор не дает заполнить кеш произвольными размерами.
+	TransformSizes = []int{64, 128, 256, 320, 480, 640, 800, 1024, 1280, 1600, 1920}
+	// TransformCacheSize ограничивает общий объем кеша преобразований
+	TransformCacheSize = int64(256 * 1024 * 1024)
+)
+
+const (
+	// defaultTransformQuality — качество JPEG, если параметр quality не задан
+	defaultTransformQuality = 85
+	// maxTransformPixels ограничивает размер исходника, который декодируется для преобразования
+	maxTransformPixels = maxHashPixels
+)
+
+// transformParams — разобранные параметры преобразования
+type transformParams struct {
+	Width, Height int
+	Fit           string // contain или cover
+	Format        string // png или jpeg; пусто — по исходнику
+	Quality       int
+}
+
+// transformQueryKeys — параметры запроса, включающие преобразование
+var transformQueryKeys = []string{"w", "h", "fit", "format", "quality"}
+
+// wantsTransform проверяет, запрошено ли преобразование
+func wantsTransform(query url.Values) bool {
+	for _, key := range transformQueryKeys {
+		if query.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTransformParams проверяет параметры по списку допустимых значений
+func parseTransformParams(query url.Values) (transformParams, error) {
+	params := transformParams{Fit: "contain", Quality: defaultTransformQuality}
+
+	size := func(key string) (int, error) {
+		value := query.Get(key)
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || !slices.Contains(TransformSizes, n) {
+			return 0, fmt.Errorf("%s must be one of %s", key, intsString(TransformSizes))
+		}
+		return n, nil
+	}
+	var err error
+	if params.Width, err = size("w"); err != nil {
+		return params, err
+	}
+	if params.Height, err = size("h"); err != nil {
+		return params, err
+	}
+
+	switch fit := query.Get("fit"); fit {
+	case "", "contain":
+	case "cover":
+		params.Fit = fit
+	default:
+		return params, errors.New("fit must be contain or cover")
+	}
+
+	switch format := strings.ToLower(query.Get("format")); format {
+	case "":
+	case "png":
+		params.Format = "png"
+	case "jpeg", "jpg":
+		params.Format = "jpeg"
+	case "webp":
+		return params, errors.New("webp output is not supported, use png or jpeg")
+	default:
+		return params, errors.New("format must be png or jpeg")
+	}
+
+	if value := query.Get("quality"); value != "" {
+		q, err := strconv.Atoi(value)
+		if err != nil || q < 10 || q > 100 {
+			return params, errors.New("quality must be between 10 and 100")
+		}
+		// Шаг 5 ограничивает число вариантов одного изображения в кеше
+		params.Quality = (q + 2) / 5 * 5
+	}
+	return params, nil
+}
+
+// outputFormat выбирает формат результата: JPEG остается JPEG, остальное — PNG
+func (p transformParams) outputFormat(sourceExt string) string {
+	if p.Format != "" {
+		return p.Format
+	}
+	if sourceExt == "jpg" || sourceExt == "jpeg" {
+		return "jpeg"
+	}
+	return "png"
+}
+
+// variantName — имя файла варианта в кеше
+func (p transformParams) variantName(sourceExt string) string {
+	format := p.outputFormat(sourceExt)
+	name := fmt.Sprintf("w%d-h%d-%s", p.Width, p.Height, p.Fit)
+	if format == "jpeg" {
+		name += fmt.Sprintf("-q%d.jpg", p.Quality)
+	} else {
+		name += ".png"
+	}
+	return name
+}
+
+// transformSlots ограничивает число одновременных преобразований числом ядер
+var transformSlots = make(chan struct{}, runtime.NumCPU())
+
+// serveTransformed отдает преобразованное изображение, создавая вариант в кеше при промахе.
+// С водяным знаком вариант строится и без параметров преобразования: тогда
+// это копия исходника в полном размере со знаком.
+func serveTransformed(w http.ResponseWriter, r *http.Request, userID, albumID, filename string, watermark *Watermark) {
+	params := transformParams{Fit: "contain", Quality: defaultTransformQuality}
+	if wantsTransform(r.URL.Query()) {
+		if len(TransformSizes) == 0 {
+			http.Error(w, "Image transformations are disabled", http.StatusNotFound)
+			return
+		}
+		var err error
+		if params, err = parseTransformParams(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sourcePath := imagePath(userID, albumID, filename)
+	source, err := os.Stat(sourcePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	variantName := params.variantName(ext)
+	if watermark != nil {
+		fingerprint, err := watermark.fingerprint()
+		if err != nil {
+			logger.ErrorContext(r.Context(), "watermark unavailable", "album_id", albumID, "error", err)
+			http.Error(w, "Watermark is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		variantName = "wm-" + fingerprint + "-" + variantName
+	}
+	variantPath := filepath.Join(transformCacheRoot(), userID, albumID, filename, variantName)
+
+	// Вариант старше исходника (исходник заменен) считается промахом
+	if info, err := os.Stat(variantPath); err == nil && !info.ModTime().Before(source.ModTime()) {
+		transformCache.touch(variantPath)
+		metrics.transforms.Inc("hit")
+		http.ServeFile(w, r, variantPath)
+		return
+	}
+
+	// Брошенный клиентом запрос не должен стоять в очереди за слотом
+	select {
+	case transformSlots <- struct{}{}:
+	case <-r.Context().Done():
+		return
+	}
+	data, err := transformImage(sourcePath, params, ext, watermark)
+	<-transformSlots
+	if err != nil {
+		metrics.transforms.Inc("error")
+		logger.WarnContext(r.Context(), "image transform failed", "file", filename, "error", err)
+		http.Error(w, "Cannot transform this image", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Ошибка записи в кеш не мешает отдать результат
+	if err := EnsureDir(filepath.Dir(variantPath)); err != nil {
+		logger.ErrorContext(r.Context(), "failed to cache transformed image", "error", err)
+	} else if err := writeFileAtomic(variantPath, bytes.NewReader(data)); err != nil {
+		logger.ErrorContext(r.Context(), "failed to cache transformed image", "error", err)
+	} else {
+		transformCache.add(variantPath, int64(len(data)))
+	}
+
+	metrics.transforms.Inc("miss")
+	http.ServeContent(w, r, filepath.Base(variantPath), source.ModTime(), bytes.NewReader(data))
+}
+
+// transformImage декодирует исходник, масштабирует его, накладывает водяной
+// знак, если он задан, и кодирует результат. Метаданные не переносятся,
+// поэтому поворот из EXIF применяется к пикселям.
+func transformImage(sourcePath string, params transformParams, sourceExt string, watermark *Watermark) ([]byte, error) {
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxTransformPixels {
+		return nil, fmt.Errorf("image too large: %dx%d", config.Width, config.Height)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	src, format, err := image.Decode(file) // у GIF берется первый кадр
+	if err != nil {
+		return nil, err
+	}
+	orientation, err := displayOrientation(file, format)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := resizeImage(applyOrientation(src, orientation), params)
+	if watermark != nil {
+		if dst, err = watermark.apply(dst); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if params.outputFormat(sourceExt) == "jpeg" {
+		err = jpeg.Encode(&buf, flattenAlpha(dst), &jpeg.Options{Quality: params.Quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, dst)
+	}
+	return buf.Bytes(), err
+}
+
+// resizeImage вписывает (contain) или обрезает по центру (cover) изображение
+// под заданные размеры, не увеличивая его
+func resizeImage(src image.Image, params transformParams) image.Image {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	tw, th := params.Width, params.Height
+	if tw == 0 && th == 0 {
+		return src
+	}
+
+	// Область исходника, которая попадет в результат
+	crop := bounds
+	if params.Fit == "cover" && tw > 0 && th > 0 {
+		if sw*th > sh*tw {
+			cw := sh * tw / th
+			crop.Min.X += (sw - cw) / 2
+			crop.Max.X = crop.Min.X + cw
+		} else {
+			ch := sw * th / tw
+			crop.Min.Y += (sh - ch) / 2
+			crop.Max.Y = crop.Min.Y + ch
+		}
+		sw, sh = crop.Dx(), crop.Dy()
+	}
+
+	// Масштаб по наиболее ограничивающей стороне, без увеличения
+	scale := 1.0
+	if tw > 0 {
+		scale = min(scale, float64(tw)/float64(sw))
+	}
+	if th > 0 {
+		scale = min(scale, float64(th)/float64(sh))
+	}
+	dw, dh := max(1, int(float64(sw)*scale+0.5)), max(1, int(float64(sh)*scale+0.5))
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+// flattenAlpha накладывает изображение на белый фон: JPEG не хранит прозрачность
+func flattenAlpha(img image.Image) image.Image {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+func transformCacheRoot() string { return filepath.Join(DataPath, TransformCacheDir) }
+
+// purgeTransforms удаляет варианты изображения, альбома (filename == "") или
+// пользователя (albumID == ""), чтобы удаленное не оставалось доступным через кеш
+func purgeTransforms(ctx context.Context, userID, albumID, filename string) {
+	dir := filepath.Join(transformCacheRoot(), userID, albumID, filename)
+	if dir == transformCacheRoot() {
+		return
+	}
+	transformCache.removeDir(ctx, dir)
+}
+
+// lruCache учитывает файлы кеша на диске и удаляет давно не запрошенные,
+// когда общий объем превышает предел
+type lruCache struct {
+	mu    sync.Mutex
+	once  sync.Once
+	size  int64
+	order *list.List // от недавних к давним; значения *lruEntry
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	path string
+	size int64
+}
+
+// Global transform cache
+var transformCache = &lruCache{}
+
+// load восстанавливает учет по файлам на диске; порядок — по времени изменения
+func (c *lruCache) load() {
+	c.once.Do(func() {
+		c.order = list.New()
+		c.items = make(map[string]*list.Element)
+
+		type found struct {
+			path string
+			info fs.FileInfo
+		}
+		var files []found
+		filepath.WalkDir(transformCacheRoot(), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), TempFilePrefix) {
+				os.Remove(path)
+				return nil
+			}
+			if info, err := entry.Info(); err == nil {
+				files = append(files, found{path, info})
+			}
+			return nil
+		})
+		slices.SortFunc(files, func(a, b found) int { return b.info.ModTime().Compare(a.info.ModTime()) })
+		for _, f := range files {
+			c.items[f.path] = c.order.PushBack(&lruEntry{path: f.path, size: f.info.Size()})
+			c.size += f.info.Size()
+		}
+	})
+}
+
+// touch отмечает обращение к файлу кеша
+func (c *lruCache) touch(path string) {
+	c.load()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[path]; ok {
+		c.order.MoveToFront(elem)
+	}
+}
+
+// add учитывает новый файл и вытесняет давние, пока объем больше предела
+func (c *lruCache) add(path string, size int64) {
+	c.load()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[path]; ok {
+		c.size -= elem.Value.(*lruEntry).size
+		c.order.Remove(elem)
+	}
+	c.items[path] = c.order.PushFront(&lruEntry{path: path, size: size})
+	c.size += size
+
+	for c.size > TransformCacheSize && c.order.Len() > 1 {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		c.order.Remove(oldest)
+		delete(c.items, entry.path)
+		c.size -= entry.size
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			logger.Warn("failed to evict cached variant", "path", entry.path, "error", err)
+		}
+		removeEmptyParents(filepath.Dir(entry.path), transformCacheRoot())
+	}
+}
+
+// removeDir удаляет каталог кеша вместе с учетом его файлов
+func (c *lruCache) removeDir(ctx context.Context, dir string) {
+	c.load()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := dir + string(filepath.Separator)
+	for path, elem := range c.items {
+		if strings.HasPrefix(path, prefix) {
+			c.size -= elem.Value.(*lruEntry).size
+			c.order.Remove(elem)
+			delete(c.items, path)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		logger.WarnContext(ctx, "failed to purge cached variants", "path", dir, "error", err)
+	}
+	removeEmptyParents(filepath.Dir(dir), transformCacheRoot())
+}
+
+// removeEmptyParents удаляет опустевшие каталоги от dir вверх до root (не включая).
+// os.Remove не удаляет непустые каталоги, поэтому первая ошибка завершает подъем.
+func removeEmptyParents(dir, root string) {
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// intsString форматирует список чисел через запятую
+func intsString(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ",")
+}
@@ -7,7 +7,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -48,37 +47,21 @@ func isImageOld(modTime time.Time) bool {
 	return time.Since(modTime) > CleanupDuration
 }
 
-// Logger - простая структура для логирования
-type Logger struct {
-	debug bool
-}
-
-func NewLogger(debug bool) *Logger {
-	return &Logger{debug: debug}
+// ErrorResponse отправляет JSON ответ с ошибкой
+func ErrorResponse(w http.ResponseWriter, statusCode int, message string) {
+	ErrorResponseCode(w, statusCode, "", message)
 }
 
-func (l *Logger) Debug(msg string) {
-	if l.debug {
-		log.Printf("[DEBUG] %s", msg)
+// ErrorResponseCode отправляет JSON ответ с ошибкой и машиночитаемым кодом причины
+func ErrorResponseCode(w http.ResponseWriter, statusCode int, code, message string) {
+	body := map[string]string{"error": message}
+	if code != "" {
+		body["code"] = code
 	}
-}
-
-func (l *Logger) Info(msg string) {
-	log.Printf("[INFO] %s", msg)
-}
-
-func (l *Logger) Error(msg string) {
-	log.Printf("[ERROR] %s", msg)
-}
-
-// Global logger instance
-var logger = NewLogger(os.Getenv("DEBUG") == "true")
-
-// ErrorResponse отправляет JSON ответ с ошибкой
-func ErrorResponse(w http.ResponseWriter, statusCode int, message string) {
+	jsonData, _ := json.Marshal(body)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-	fmt.Fprintf(w, `{"error": "%s"}`, strings.ReplaceAll(message, `"`, `\\"`))
+	w.Write(jsonData)
 }
 
 // SuccessResponse отправляет JSON ответ с успешным результатом
@@ -96,6 +79,12 @@ func ValidatePath(path string) bool {
 	return !strings.Contains(cleanPath, "..") && !strings.HasPrefix(cleanPath, "/")
 }
 
+// validStorageID проверяет, что ID пользователя, альбома или имя файла — одно
+// имя без путей, не ведущее в скрытые служебные файлы
+func validStorageID(id string) bool {
+	return id != "" && !strings.HasPrefix(id, ".") && !strings.ContainsAny(id, `/\`) && ValidatePath(id)
+}
+
 // EnsureDir создает директорию если она не существует
 func EnsureDir(path string) error {
 	return os.MkdirAll(path, DefaultFilePerm)
@@ -114,6 +103,13 @@ var ValidImageExtensions = map[string]bool{
 	".png":  true,
 	".gif":  true,
 	".webp": true,
+	".bmp":  true,
+	".tiff": true,
+	".tif":  true,
+	".avif": true,
+	".svg":  true,
+	".mp4":  true,
+	".webm": true,
 }
 
 func IsImageFile(filename string) bool {
@@ -131,18 +127,39 @@ func RandomID() string {
 	return hex.EncodeToString(bytes)[:5]
 }
 
+// RandomHex генерирует случайную hex-строку из n байт
+func RandomHex(n int) string {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bytes)
+}
+
 // SignData генерирует HMAC-SHA256 подпись для данных
 func SignData(data string) string {
-	h := hmac.New(sha256.New, AppSecret)
+	return signWithSecret(AppSecret, data)
+}
+
+func signWithSecret(secret []byte, data string) string {
+	h := hmac.New(sha256.New, secret)
 	h.Write([]byte(data))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// VerifyData проверяет HMAC-SHA256 подпись
+// VerifyData проверяет HMAC-SHA256 подпись текущим или предыдущим секретом
 func VerifyData(data, signature string) bool {
+	if IsSignedWithCurrentSecret(data, signature) {
+		return true
+	}
+	return signature != "" && len(PreviousAppSecret) > 0 &&
+		hmac.Equal([]byte(signature), []byte(signWithSecret(PreviousAppSecret, data)))
+}
+
+// IsSignedWithCurrentSecret проверяет подпись только текущим секретом
+func IsSignedWithCurrentSecret(data, signature string) bool {
 	if signature == "" {
 		return false
 	}
-	expectedSignature := SignData(data)
-	return hmac.Equal([]byte(signature), []byte(expectedSignature))
+	return hmac.Equal([]byte(signature), []byte(SignData(data)))
 }
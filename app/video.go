@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"strings"
+)
+
+// Video configuration
+var (
+	// VideoUploads разрешает загрузку коротких роликов MP4 и WebM
+	VideoUploads = false
+	// MaxVideoSize — лимит размера ролика; для изображений действует MaxFileSize
+	MaxVideoSize = int64(100 * 1024 * 1024)
+)
+
+// AllowedVideoTypes — типы роликов; загрузка разрешена только при VideoUploads
+var AllowedVideoTypes = map[string]bool{
+	"video/mp4":  true,
+	"video/webm": true,
+}
+
+// isVideoExtension сообщает, что расширение относится к ролику
+func isVideoExtension(extension string) bool {
+	extension = strings.TrimPrefix(strings.ToLower(extension), ".")
+	return extension == "mp4" || extension == "webm"
+}
+
+// isVideoFile сообщает, что файл — ролик; шаблоны показывают для него плеер
+func isVideoFile(filename string) bool {
+	return isVideoExtension(GetFileExtension(filename))
+}
+
+// isMP4Header проверяет бокс ftyp с брендом MP4. AVIF и QuickTime не подходят.
+func isMP4Header(header []byte) bool {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" || isAVIFHeader(header) {
+		return false
+	}
+	switch string(header[8:12]) {
+	case "isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "dash", "M4V ", "MSNV":
+		return true
+	}
+	return false
+}
+
+// isWebMHeader проверяет заголовок EBML с DocType webm
+func isWebMHeader(header []byte) bool {
+	if !bytes.HasPrefix(header, []byte("\x1A\x45\xDF\xA3")) {
+		return false
+	}
+	if len(header) > 64 {
+		header = header[:64]
+	}
+	return bytes.Contains(header, []byte("\x42\x82\x84webm"))
+}
+
+// inspectVideo проверяет структуру контейнера до конца файла и читает размеры кадра
+func inspectVideo(file io.ReadSeeker, size int64, extension string) (image.Config, string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return image.Config{}, "", err
+	}
+	s := &byteScanner{r: bufio.NewReader(file)}
+
+	format := strings.TrimPrefix(strings.ToLower(extension), ".")
+	var config image.Config
+	var err error
+	switch format {
+	case "mp4":
+		config, err = s.mp4Config()
+	case "webm":
+		config, err = s.webmConfig()
+	default:
+		return config, "", rejectImage(RejectInvalidType, "unsupported video type")
+	}
+	if err != nil {
+		return config, format, rejectImage(RejectMalformed, "broken %s structure: %v", format, err)
+	}
+
+	rest, err := io.ReadAll(io.LimitReader(s.r, size-s.pos))
+	if err != nil {
+		return config, format, err
+	}
+	if len(bytes.Trim(rest, "\x00")) > 0 {
+		return config, format, rejectImage(RejectTrailingData, "%d bytes after end of %s data", len(rest), format)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return config, format, err
+}
+
+// videoConfig читает размеры кадра ролика на диске
+func videoConfig(r io.Reader, extension string) (image.Config, error) {
+	s := &byteScanner{r: bufio.NewReader(r)}
+	if strings.EqualFold(strings.TrimPrefix(extension, "."), "webm") {
+		return s.webmConfig()
+	}
+	return s.mp4Config()
+}
+
+// MP4
+
+// mp4Config проходит боксы верхнего уровня до конца файла и берет размеры
+// из заголовка первой дорожки с ненулевым кадром (moov/trak/tkhd)
+func (s *byteScanner) mp4Config() (image.Config, error) {
+	var config image.Config
+	seenMovie := false
+	for {
+		if _, err := s.r.Peek(1); err == io.EOF {
+			break
+		}
+		start := s.pos
+		typ, size, err := s.boxHeader()
+		if err != nil {
+			return config, err
+		}
+		if size == 0 {
+			n, err := io.Copy(io.Discard, s.r)
+			s.pos += n
+			if err != nil {
+				return config, err
+			}
+			break
+		}
+		if typ == "moov" {
+			seenMovie = true
+			if config.Width, config.Height, err = s.mp4TrackSize(start + size); err != nil {
+				return config, err
+			}
+		}
+		if err := s.skip(start + size - s.pos); err != nil {
+			return config, err
+		}
+	}
+	if !seenMovie {
+		return config, errors.New("no moov box")
+	}
+	return config, nil
+}
+
+// mp4TrackSize ищет tkhd с ненулевыми размерами среди боксов до позиции end
+func (s *byteScanner) mp4TrackSize(end int64) (int, int, error) {
+	for s.pos < end {
+		start := s.pos
+		typ, size, err := s.boxHeader()
+		if err != nil {
+			return 0, 0, err
+		}
+		if size == 0 || start+size > end {
+			return 0, 0, errStructure
+		}
+		switch typ {
+		case "trak":
+			if width, height, err := s.mp4TrackSize(start + size); err != nil || width > 0 {
+				return width, height, err
+			}
+		case "tkhd":
+			// FullBox; поля времени 32- или 64-битные в зависимости от версии
+			header := make([]byte, 4)
+			if err := s.read(header); err != nil {
+				return 0, 0, err
+			}
+			skip := int64(20 + 52)
+			if header[0] == 1 {
+				skip = 32 + 52
+			}
+			if err := s.skip(skip); err != nil {
+				return 0, 0, err
+			}
+			dimensions := make([]byte, 8)
+			if err := s.read(dimensions); err != nil {
+				return 0, 0, err
+			}
+			// Фиксированная точка 16.16
+			width := int(binary.BigEndian.Uint32(dimensions[:4]) >> 16)
+			height := int(binary.BigEndian.Uint32(dimensions[4:]) >> 16)
+			if width > 0 && height > 0 {
+				return width, height, nil
+			}
+		}
+		if err := s.skip(start + size - s.pos); err != nil {
+			return 0, 0, err
+		}
+	}
+	return 0, 0, nil
+}
+
+// WebM
+
+// Идентификаторы элементов EBML
+const (
+	ebmlHeaderID  = 0x1A45DFA3
+	webmSegmentID = 0x18538067
+	webmTracksID  = 0x1654AE6B
+	webmTrackID   = 0xAE
+	webmVideoID   = 0xE0
+	webmWidthID   = 0xB0
+	webmHeightID  = 0xBA
+)
+
+// ebmlUnknownSize — размер элемента, который продолжается до конца родителя
+const ebmlUnknownSize = -1
+
+// ebmlVint читает целое переменной длины; keepMarker оставляет старший бит (для ID)
+func (s *byteScanner) ebmlVint(keepMarker bool) (int64, error) {
+	first, err := s.byte()
+	if err != nil {
+		return 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, errStructure
+	}
+	value := int64(first)
+	if !keepMarker {
+		value &= int64(0xFF >> length)
+	}
+	allOnes := value == int64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		b, err := s.byte()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknownSize, nil
+	}
+	return value, nil
+}
+
+// ebmlElement читает ID и размер элемента
+func (s *byteScanner) ebmlElement() (int64, int64, error) {
+	id, err := s.ebmlVint(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := s.ebmlVint(false)
+	return id, size, err
+}
+
+// webmConfig проверяет заголовок EBML и сегмент и читает размеры кадра из
+// Tracks. Сегмент неизвестного размера (запись MediaRecorder) длится до конца
+// файла; его кластеры не разбираются.
+func (s *byteScanner) webmConfig() (image.Config, error) {
+	var config image.Config
+	id, size, err := s.ebmlElement()
+	if err != nil {
+		return config, err
+	}
+	if id != ebmlHeaderID || size == ebmlUnknownSize || size > 1024 {
+		return config, errStructure
+	}
+	header := make([]byte, size)
+	if err := s.read(header); err != nil {
+		return config, err
+	}
+	if !bytes.Contains(header, []byte("\x42\x82\x84webm")) {
+		return config, errors.New("doctype is not webm")
+	}
+
+	id, size, err = s.ebmlElement()
+	if err != nil {
+		return config, err
+	}
+	if id != webmSegmentID {
+		return config, errStructure
+	}
+	segmentEnd := s.pos + size
+
+	// Дочерние элементы сегмента до Tracks; кластер неизвестного размера прерывает поиск
+	for size == ebmlUnknownSize || s.pos < segmentEnd {
+		if _, err := s.r.Peek(1); err == io.EOF {
+			break
+		}
+		childID, childSize, err := s.ebmlElement()
+		if err != nil {
+			return config, err
+		}
+		if childSize == ebmlUnknownSize {
+			break
+		}
+		if childID == webmTracksID {
+			config.Width, config.Height, err = s.webmTrackSize(s.pos + childSize)
+			if err != nil {
+				return config, err
+			}
+			break
+		}
+		if err := s.skip(childSize); err != nil {
+			return config, err
+		}
+	}
+
+	if size == ebmlUnknownSize {
+		n, err := io.Copy(io.Discard, s.r)
+		s.pos += n
+		return config, err
+	}
+	return config, s.skip(segmentEnd - s.pos)
+}
+
+// webmTrackSize ищет PixelWidth и PixelHeight первой видеодорожки до позиции end
+func (s *byteScanner) webmTrackSize(end int64) (int, int, error) {
+	var width, height int
+	for s.pos < end {
+		id, size, err := s.ebmlElement()
+		if err != nil {
+			return 0, 0, err
+		}
+		if size == ebmlUnknownSize || s.pos+size > end {
+			return 0, 0, errStructure
+		}
+		switch id {
+		case webmTrackID, webmVideoID:
+			// Спускаемся внутрь: размеры лежат в TrackEntry/Video
+			continue
+		case webmWidthID, webmHeightID:
+			if size > 8 {
+				return 0, 0, errStructure
+			}
+			value := make([]byte, size)
+			if err := s.read(value); err != nil {
+				return 0, 0, err
+			}
+			var n int
+			for _, b := range value {
+				n = n<<8 | int(b)
+			}
+			if id == webmWidthID {
+				width = n
+			} else {
+				height = n
+			}
+			if width > 0 && height > 0 {
+				return width, height, nil
+			}
+			continue
+		}
+		if err := s.skip(size); err != nil {
+			return 0, 0, err
+		}
+	}
+	return width, height, nil
+}
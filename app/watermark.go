@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// AlbumWatermarkFileName — скрытый файл в каталоге альбома с настройками водяного знака.
+// Отдельный от индекса файл читается на каждый запрос изображения без разбора индекса.
+const AlbumWatermarkFileName = ".watermark.json"
+
+// WatermarkLogo — PNG-логотип, который владельцы альбомов могут выбрать вместо текста
+var WatermarkLogo = ""
+
+// Виды водяного знака
+const (
+	WatermarkText     = "text"
+	WatermarkLogoKind = "logo"
+)
+
+const (
+	// maxWatermarkText — предел длины текста водяного знака в символах
+	maxWatermarkText = 100
+	// watermarkTextScale — высота текста как доля короткой стороны изображения
+	watermarkTextScale = 16
+	// watermarkLogoScale — предел сторон логотипа как доля сторон изображения
+	watermarkLogoScale = 4
+)
+
+// watermarkPositions — допустимые положения знака на изображении
+var watermarkPositions = []string{"bottom-right", "bottom-left", "top-right", "top-left", "center"}
+
+// Watermark — настройки водяного знака альбома
+type Watermark struct {
+	Kind     string `json:"kind"`
+	Text     string `json:"text,omitempty"`
+	Position string `json:"position"`
+	Opacity  int    `json:"opacity"` // 10–100 %
+}
+
+// validate проверяет настройки, заданные владельцем альбома
+func (wm *Watermark) validate() error {
+	switch wm.Kind {
+	case WatermarkText:
+		if strings.TrimSpace(wm.Text) == "" {
+			return errors.New("watermark text must not be empty")
+		}
+		if utf8.RuneCountInString(wm.Text) > maxWatermarkText {
+			return fmt.Errorf("watermark text must be at most %d characters", maxWatermarkText)
+		}
+		if strings.IndexFunc(wm.Text, unicode.IsControl) >= 0 {
+			return errors.New("watermark text must not contain control characters")
+		}
+	case WatermarkLogoKind:
+		if WatermarkLogo == "" {
+			return errors.New("no watermark logo is configured on this server")
+		}
+		wm.Text = ""
+	default:
+		return errors.New("kind must be text or logo")
+	}
+	if !slices.Contains(watermarkPositions, wm.Position) {
+		return fmt.Errorf("position must be one of %s", strings.Join(watermarkPositions, ", "))
+	}
+	if wm.Opacity < 10 || wm.Opacity > 100 {
+		return errors.New("opacity must be between 10 and 100")
+	}
+	return nil
+}
+
+// fingerprint отличает варианты в кеше, построенные с разными настройками
+// или с другой версией логотипа
+func (wm *Watermark) fingerprint() (string, error) {
+	data, err := json.Marshal(wm)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(data)
+	if wm.Kind == WatermarkLogoKind {
+		info, err := os.Stat(WatermarkLogo)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "|%d|%d", info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+func albumWatermarkPath(userID, albumID string) string {
+	return filepath.Join(albumPath(userID, albumID), AlbumWatermarkFileName)
+}
+
+// albumWatermark возвращает настройки водяного знака альбома или nil, если он выключен.
+// Поврежденный файл считается ошибкой: отдавать оригинал вместо знака нельзя.
+func albumWatermark(userID, albumID string) (*Watermark, error) {
+	data, err := os.ReadFile(albumWatermarkPath(userID, albumID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var wm Watermark
+	if err := json.Unmarshal(data, &wm); err != nil {
+		return nil, err
+	}
+	return &wm, nil
+}
+
+// setAlbumWatermark сохраняет (nil — удаляет) настройки водяного знака альбома
+// и сбрасывает варианты альбома в кеше, построенные со старыми настройками
+func setAlbumWatermark(ctx context.Context, userID, albumID string, wm *Watermark) error {
+	path := albumWatermarkPath(userID, albumID)
+	if wm == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		data, err := json.Marshal(wm)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	purgeTransforms(ctx, userID, albumID, "")
+	return nil
+}
+
+// apply рисует водяной знак поверх изображения
+func (wm *Watermark) apply(img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	var mark image.Image
+	var err error
+	if wm.Kind == WatermarkLogoKind {
+		mark, err = logoMark(dst.Bounds())
+	} else {
+		mark, err = textMark(wm.Text, dst.Bounds())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	target := watermarkRect(dst.Bounds(), mark.Bounds().Size(), wm.Position)
+	opacity := image.NewUniform(color.Alpha{A: uint8(wm.Opacity * 0xff / 100)})
+	draw.DrawMask(dst, target, mark, mark.Bounds().Min, opacity, image.Point{}, draw.Over)
+	return dst, nil
+}
+
+// watermarkRect размещает знак размера size с отступом от края
+func watermarkRect(bounds image.Rectangle, size image.Point, position string) image.Rectangle {
+	margin := min(bounds.Dx(), bounds.Dy()) / 40
+	var at image.Point
+	switch position {
+	case "top-left":
+		at = image.Pt(margin, margin)
+	case "top-right":
+		at = image.Pt(bounds.Dx()-size.X-margin, margin)
+	case "bottom-left":
+		at = image.Pt(margin, bounds.Dy()-size.Y-margin)
+	case "center":
+		at = image.Pt((bounds.Dx()-size.X)/2, (bounds.Dy()-size.Y)/2)
+	default:
+		at = image.Pt(bounds.Dx()-size.X-margin, bounds.Dy()-size.Y-margin)
+	}
+	return image.Rectangle{Min: at, Max: at.Add(size)}.Add(bounds.Min)
+}
+
+// watermarkFont — встроенный шрифт Go Bold; в нем есть кириллица
+var watermarkFont = sync.OnceValues(func() (*sfnt.Font, error) {
+	return opentype.Parse(gobold.TTF)
+})
+
+// textMark рисует белый текст с тенью. Высота текста — 1/watermarkTextScale
+// короткой стороны; длинный текст уменьшается, чтобы поместиться по ширине.
+func textMark(text string, bounds image.Rectangle) (image.Image, error) {
+	f, err := watermarkFont()
+	if err != nil {
+		return nil, err
+	}
+	size := max(10, float64(min(bounds.Dx(), bounds.Dy()))/watermarkTextScale)
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	if width := font.MeasureString(face, text).Ceil(); width > bounds.Dx()*9/10 {
+		face.Close()
+		size = max(6, size*float64(bounds.Dx()*9/10)/float64(width))
+		if face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull}); err != nil {
+			return nil, err
+		}
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	shadow := max(1, int(size/16))
+	width := font.MeasureString(face, text).Ceil() + shadow
+	height := (metrics.Ascent + metrics.Descent).Ceil() + shadow
+	mark := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	drawer := &font.Drawer{Dst: mark, Face: face}
+	drawer.Src = image.NewUniform(color.NRGBA{A: 0x99})
+	drawer.Dot = fixed.Point26_6{X: fixed.I(shadow), Y: metrics.Ascent + fixed.I(shadow)}
+	drawer.DrawString(text)
+	drawer.Src = image.White
+	drawer.Dot = fixed.Point26_6{Y: metrics.Ascent}
+	drawer.DrawString(text)
+	return mark, nil
+}
+
+// watermarkLogoCache хранит декодированный логотип до изменения файла
+var watermarkLogoCache struct {
+	mu      sync.Mutex
+	path    string
+	modTime int64
+	img     image.Image
+}
+
+// loadWatermarkLogo читает WatermarkLogo, перечитывая файл после его замены
+func loadWatermarkLogo() (image.Image, error) {
+	info, err := os.Stat(WatermarkLogo)
+	if err != nil {
+		return nil, err
+	}
+	c := &watermarkLogoCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.img != nil && c.path == WatermarkLogo && c.modTime == info.ModTime().UnixNano() {
+		return c.img, nil
+	}
+	file, err := os.Open(WatermarkLogo)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	c.path, c.modTime, c.img = WatermarkLogo, info.ModTime().UnixNano(), img
+	return img, nil
+}
+
+// logoMark уменьшает логотип до 1/watermarkLogoScale сторон изображения, не увеличивая его
+func logoMark(bounds image.Rectangle) (image.Image, error) {
+	logo, err := loadWatermarkLogo()
+	if err != nil {
+		return nil, err
+	}
+	lb := logo.Bounds()
+	scale := min(1, float64(bounds.Dx())/watermarkLogoScale/float64(lb.Dx()), float64(bounds.Dy())/watermarkLogoScale/float64(lb.Dy()))
+	if scale == 1 {
+		return logo, nil
+	}
+	w, h := max(1, int(float64(lb.Dx())*scale+0.5)), max(1, int(float64(lb.Dy())*scale+0.5))
+	mark := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(mark, mark.Bounds(), logo, lb, draw.Src, nil)
+	return mark, nil
+}
+
+// albumWatermarkHandler включает, меняет или выключает водяной знак альбома владельца
+func albumWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	albumID := r.FormValue("album_id")
+	if !validStorageID(albumID) {
+		http.Error(w, "album_id required", http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(albumPath(sessionID, albumID)); err != nil || !info.IsDir() {
+		http.Error(w, "Album not found", http.StatusNotFound)
+		return
+	}
+
+	var wm *Watermark
+	if r.FormValue("enabled") != "" {
+		opacity, err := strconv.Atoi(r.FormValue("opacity"))
+		if err != nil {
+			http.Error(w, "opacity must be a number", http.StatusBadRequest)
+			return
+		}
+		wm = &Watermark{
+			Kind:     r.FormValue("kind"),
+			Text:     strings.TrimSpace(r.FormValue("text")),
+			Position: r.FormValue("position"),
+			Opacity:  opacity,
+		}
+		if err := wm.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := setAlbumWatermark(r.Context(), sessionID, albumID, wm); err != nil {
+		logger.ErrorContext(r.Context(), "failed to save album watermark", "album_id", albumID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(r.Context(), "album watermark updated", "album_id", albumID, "enabled", wm != nil)
+
+	http.Redirect(w, r, "/"+sessionID+"/"+albumID, http.StatusSeeOther)
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// WebhooksFileName — зарегистрированные вебхуки в DataPath
+	WebhooksFileName = ".webhooks.json"
+	// WebhookLogFileName — журнал доставок, по записи JSON на строку
+	WebhookLogFileName = ".webhooks.log"
+)
+
+// События вебхуков
+const (
+	EventImageUploaded = "image.uploaded"
+	EventImageDeleted  = "image.deleted"
+	EventImageExpired  = "image.expired"
+	EventImageEdited   = "image.edited"
+	EventAlbumDeleted  = "album.deleted"
+)
+
+// WebhookEvents — все события, на которые можно подписаться
+var WebhookEvents = []string{EventImageUploaded, EventImageDeleted, EventImageExpired, EventImageEdited, EventAlbumDeleted}
+
+// Webhook configuration
+var (
+	// WebhookTimeout ограничивает одну попытку доставки
+	WebhookTimeout = 10 * time.Second
+	// WebhookMaxAttempts — число попыток доставки, включая первую
+	WebhookMaxAttempts = 5
+	// WebhookAllowPrivate разрешает пользовательским вебхукам обращаться к
+	// локальным и внутренним адресам; вебхуки администратора не ограничены
+	WebhookAllowPrivate = false
+)
+
+const (
+	webhookQueueSize   = 1000
+	webhookWorkers     = 4
+	maxWebhooksPerUser = 10
+	maxWebhookURL      = 2000
+	// webhookLogMaxBytes — размер журнала доставок, после которого он сдвигается в .1
+	webhookLogMaxBytes = 5 * 1024 * 1024
+	// webhookLogLimit — сколько последних доставок показывать администратору
+	webhookLogLimit = 200
+)
+
+// Webhook — подписка на события. Вебхук пользователя получает события его
+// альбомов (или одного альбома), вебхук администратора — все события.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	UserID    string    `json:"user_id,omitempty"` // пусто — вебхук администратора
+	AlbumID   string    `json:"album_id,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Scope возвращает область событий вебхука для шаблона
+func (h Webhook) Scope() string {
+	switch {
+	case h.UserID == "":
+		return "все"
+	case h.AlbumID == "":
+		return h.UserID
+	default:
+		return h.UserID + "/" + h.AlbumID
+	}
+}
+
+// matches проверяет, подписан ли вебхук на событие
+func (h Webhook) matches(event WebhookEvent) bool {
+	if !slices.Contains(h.Events, event.Type) {
+		return false
+	}
+	if h.UserID != "" && h.UserID != event.UserID {
+		return false
+	}
+	return h.AlbumID == "" || h.AlbumID == event.AlbumID
+}
+
+// WebhookEvent — тело запроса вебхука
+type WebhookEvent struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"event"`
+	Time     time.Time `json:"time"`
+	UserID   string    `json:"user_id"`
+	AlbumID  string    `json:"album_id"`
+	Filename string    `json:"filename,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	URL      string    `json:"url"`
+}
+
+// WebhookDelivery — запись журнала доставок
+type WebhookDelivery struct {
+	Time     time.Time `json:"time"`
+	HookID   string    `json:"hook_id"`
+	EventID  string    `json:"event_id"`
+	Event    string    `json:"event"`
+	URL      string    `json:"url"`
+	Attempt  int       `json:"attempt"`
+	Status   int       `json:"status,omitempty"`
+	Result   string    `json:"result"` // ok, retry или failed
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// webhooksMu сериализует изменения списка вебхуков и записи журнала доставок
+var (
+	webhooksMu   sync.Mutex
+	webhookLogMu sync.Mutex
+)
+
+func webhooksPath() string   { return filepath.Join(DataPath, WebhooksFileName) }
+func webhookLogPath() string { return filepath.Join(DataPath, WebhookLogFileName) }
+
+// loadWebhooks читает зарегистрированные вебхуки
+func loadWebhooks() ([]Webhook, error) {
+	data, err := os.ReadFile(webhooksPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var hooks []Webhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("%s: %w", WebhooksFileName, err)
+	}
+	return hooks, nil
+}
+
+// updateWebhooks перечитывает список, применяет изменение и атомарно сохраняет его
+func updateWebhooks(change func([]Webhook) ([]Webhook, error)) error {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+
+	hooks, err := loadWebhooks()
+	if err != nil {
+		return err
+	}
+	hooks, err = change(hooks)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := EnsureDir(DataPath); err != nil {
+		return err
+	}
+	return writeFileAtomicPerm(webhooksPath(), bytes.NewReader(data), 0600)
+}
+
+// addWebhook регистрирует вебхук и возвращает его с ID и секретом подписи
+func addWebhook(hook Webhook) (Webhook, error) {
+	hook.ID = RandomHex(6)
+	hook.Secret = RandomHex(24)
+	hook.CreatedAt = time.Now().UTC()
+
+	err := updateWebhooks(func(hooks []Webhook) ([]Webhook, error) {
+		if hook.UserID != "" {
+			owned := 0
+			for _, existing := range hooks {
+				if existing.UserID == hook.UserID {
+					owned++
+				}
+			}
+			if owned >= maxWebhooksPerUser {
+				return nil, fmt.Errorf("at most %d webhooks per user", maxWebhooksPerUser)
+			}
+		}
+		return append(hooks, hook), nil
+	})
+	return hook, err
+}
+
+// removeWebhooks удаляет вебхуки, для которых match возвращает true, и сообщает, были ли такие
+func removeWebhooks(match func(Webhook) bool) (bool, error) {
+	removed := false
+	err := updateWebhooks(func(hooks []Webhook) ([]Webhook, error) {
+		kept := hooks[:0]
+		for _, hook := range hooks {
+			if match(hook) {
+				removed = true
+				continue
+			}
+			kept = append(kept, hook)
+		}
+		return kept, nil
+	})
+	return removed, err
+}
+
+// parseWebhookURL проверяет адрес получателя
+func parseWebhookURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(raw) > maxWebhookURL {
+		return "", errors.New("webhook URL must be an absolute http(s) URL")
+	}
+	return u.String(), nil
+}
+
+// parseWebhookEvents разбирает список событий; пустой список — все события
+func parseWebhookEvents(values []string) ([]string, error) {
+	var events []string
+	for _, value := range values {
+		for _, event := range strings.Split(value, ",") {
+			event = strings.TrimSpace(event)
+			if event == "" || slices.Contains(events, event) {
+				continue
+			}
+			if !slices.Contains(WebhookEvents, event) {
+				return nil, fmt.Errorf("unknown event %q", event)
+			}
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return slices.Clone(WebhookEvents), nil
+	}
+	return events, nil
+}
+
+// errWebhookDestination — адрес вебхука пользователя ведет во внутреннюю сеть; повтор бесполезен
+var errWebhookDestination = errors.New("webhook destination is not allowed")
+
+// webhookJob — одна доставка события одному вебхуку
+type webhookJob struct {
+	hook    Webhook
+	event   WebhookEvent
+	body    []byte
+	attempt int
+}
+
+// WebhookDispatcher доставляет события из очереди в фоне с повторами
+type WebhookDispatcher struct {
+	queue chan webhookJob
+	// client — для вебхуков администратора, userClient — для пользовательских
+	client, userClient *http.Client
+	// backoff возвращает паузу перед повтором после неудачной попытки attempt
+	backoff func(attempt int) time.Duration
+	running atomic.Bool
+}
+
+// NewWebhookDispatcher создает диспетчер с клиентами по текущей конфигурации
+func NewWebhookDispatcher() *WebhookDispatcher {
+	userClient := &http.Client{Timeout: WebhookTimeout}
+	if !WebhookAllowPrivate {
+		userClient.Transport = &http.Transport{
+			Proxy:       nil,
+			DialContext: (&net.Dialer{Timeout: WebhookTimeout, Control: denyPrivateAddress}).DialContext,
+		}
+	}
+	return &WebhookDispatcher{
+		queue:      make(chan webhookJob, webhookQueueSize),
+		client:     &http.Client{Timeout: WebhookTimeout},
+		userClient: userClient,
+		backoff:    webhookBackoff,
+	}
+}
+
+// Global webhook dispatcher; события принимаются только после Start
+var webhooks = NewWebhookDispatcher()
+
+// setupWebhooks пересоздает диспетчер после загрузки конфигурации
+func setupWebhooks() {
+	webhooks = NewWebhookDispatcher()
+}
+
+// Start запускает обработчики очереди до отмены контекста
+func (d *WebhookDispatcher) Start(ctx context.Context) {
+	d.running.Store(true)
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-d.queue:
+					d.deliver(ctx, job)
+				}
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		d.running.Store(false)
+		if dropped := len(d.queue); dropped > 0 {
+			logger.Warn("webhook deliveries dropped on shutdown", "count", dropped)
+		}
+	}()
+}
+
+// Emit отправляет событие всем подписанным вебхукам
+func (d *WebhookDispatcher) Emit(event WebhookEvent) {
+	if !d.running.Load() {
+		return // служебные команды CLI не рассылают события
+	}
+
+	hooks, err := loadWebhooks()
+	if err != nil {
+		logger.Error("failed to load webhooks", "error", err)
+		return
+	}
+
+	event.ID = RandomHex(8)
+	event.Time = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("failed to encode webhook event", "error", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if hook.matches(event) {
+			d.enqueue(webhookJob{hook: hook, event: event, body: body, attempt: 1})
+		}
+	}
+}
+
+// enqueue ставит доставку в очередь, отбрасывая ее при переполнении
+func (d *WebhookDispatcher) enqueue(job webhookJob) {
+	select {
+	case d.queue <- job:
+	default:
+		metrics.webhookDeliveries.Inc(job.event.Type, "dropped")
+		logger.Warn("webhook queue full, delivery dropped", "hook_id", job.hook.ID, "event", job.event.Type)
+	}
+}
+
+// deliver выполняет одну попытку доставки и планирует повтор при неудаче
+func (d *WebhookDispatcher) deliver(ctx context.Context, job webhookJob) {
+	started := time.Now()
+	status, err := d.send(ctx, job)
+
+	record := WebhookDelivery{
+		Time:     started.UTC(),
+		HookID:   job.hook.ID,
+		EventID:  job.event.ID,
+		Event:    job.event.Type,
+		URL:      job.hook.URL,
+		Attempt:  job.attempt,
+		Status:   status,
+		Result:   "ok",
+		Duration: float64(time.Since(started).Microseconds()) / 1000,
+	}
+
+	retry := false
+	if err != nil {
+		record.Error = truncate(err.Error(), 300)
+		retry = job.attempt < WebhookMaxAttempts && retryableWebhookStatus(status) && !errors.Is(err, errWebhookDestination)
+		record.Result = "failed"
+		if retry {
+			record.Result = "retry"
+		}
+	}
+	metrics.webhookDeliveries.Inc(job.event.Type, record.Result)
+	recordWebhookDelivery(record)
+
+	if !retry {
+		if err != nil {
+			logger.Warn("webhook delivery failed", "hook_id", job.hook.ID, "event", job.event.Type, "attempts", job.attempt, "error", err)
+		}
+		return
+	}
+
+	delay := d.backoff(job.attempt)
+	job.attempt++
+	time.AfterFunc(delay, func() {
+		if d.running.Load() {
+			d.enqueue(job)
+		}
+	})
+}
+
+// send отправляет подписанный запрос и возвращает код ответа
+func (d *WebhookDispatcher) send(ctx context.Context, job webhookJob) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.hook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "screenguru-webhooks")
+	req.Header.Set("X-Screenguru-Event", job.event.Type)
+	req.Header.Set("X-Screenguru-Delivery", job.event.ID)
+	req.Header.Set("X-Screenguru-Timestamp", timestamp)
+	req.Header.Set("X-Screenguru-Signature", "sha256="+signWebhook(job.hook.Secret, timestamp, job.body))
+
+	client := d.client
+	if job.hook.UserID != "" {
+		client = d.userClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook подписывает "timestamp.body" секретом вебхука
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff — экспоненциальная пауза: 2s, 4s, 8s... не больше 10 минут
+func webhookBackoff(attempt int) time.Duration {
+	delay := time.Duration(1<<min(attempt, 10)) * time.Second
+	return min(delay, 10*time.Minute)
+}
+
+// retryableWebhookStatus решает, имеет ли смысл повторять доставку:
+// сетевые ошибки, 5xx, 408 и 429 — да, остальные ответы 4xx — нет
+func retryableWebhookStatus(status int) bool {
+	return status == 0 || status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// denyPrivateAddress запрещает соединения с локальными и внутренними адресами
+func denyPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", errWebhookDestination, host)
+	}
+	return nil
+}
+
+// recordWebhookDelivery дописывает попытку в журнал доставок, сдвигая
+// слишком большой журнал в файл .1
+func recordWebhookDelivery(record WebhookDelivery) {
+	webhookLogMu.Lock()
+	defer webhookLogMu.Unlock()
+
+	if info, err := os.Stat(webhookLogPath()); err == nil && info.Size() > webhookLogMaxBytes {
+		if err := os.Rename(webhookLogPath(), webhookLogPath()+".1"); err != nil {
+			logger.Error("failed to rotate webhook log", "error", err)
+		}
+	}
+	if err := appendJSONLine(webhookLogPath(), record); err != nil {
+		logger.Error("failed to write webhook log", "error", err)
+	}
+}
+
+// readWebhookLog возвращает последние limit доставок, новые первыми
+func readWebhookLog(limit int) ([]WebhookDelivery, error) {
+	return readJSONLines[WebhookDelivery](webhookLogPath(), limit)
+}
+
+// emitImageEvent сообщает вебхукам о событии изображения
+func emitImageEvent(eventType, userID, albumID, filename string, size int64) {
+	webhooks.Emit(WebhookEvent{
+		Type:     eventType,
+		UserID:   userID,
+		AlbumID:  albumID,
+		Filename: filename,
+		Size:     size,
+		URL:      BaseURL + "/" + userID + "/" + albumID + "/" + filename,
+	})
+}
+
+// emitAlbumEvent сообщает вебхукам о событии альбома
+func emitAlbumEvent(eventType, userID, albumID string) {
+	webhooks.Emit(WebhookEvent{
+		Type:    eventType,
+		UserID:  userID,
+		AlbumID: albumID,
+		URL:     BaseURL + "/" + userID + "/" + albumID,
+	})
+}
+
+// webhookInfo — вебхук в ответе API без секрета
+type webhookInfo struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	AlbumID   string    `json:"album_id,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// webhooksHandler возвращает вебхуки пользователя (GET) или регистрирует новый (POST).
+// Секрет подписи возвращается только при регистрации.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+
+	switch r.Method {
+	case http.MethodGet:
+		hooks, err := loadWebhooks()
+		if err != nil {
+			logger.ErrorContext(r.Context(), "failed to load webhooks", "error", err)
+			ErrorResponseCode(w, http.StatusInternalServerError, "webhooks_failed", "Could not load webhooks")
+			return
+		}
+		list := []webhookInfo{}
+		for _, hook := range hooks {
+			if hook.UserID == sessionID {
+				list = append(list, webhookInfo{ID: hook.ID, URL: hook.URL, AlbumID: hook.AlbumID, Events: hook.Events, CreatedAt: hook.CreatedAt})
+			}
+		}
+		SuccessResponse(w, list)
+
+	case http.MethodPost:
+		hookURL, err := parseWebhookURL(r.FormValue("url"))
+		if err != nil {
+			ErrorResponseCode(w, http.StatusBadRequest, "invalid_url", err.Error())
+			return
+		}
+		events, err := parseWebhookEvents(r.Form["events"])
+		if err != nil {
+			ErrorResponseCode(w, http.StatusBadRequest, "invalid_events", err.Error())
+			return
+		}
+		albumID := r.FormValue("album_id")
+		if albumID != "" {
+			if _, err := os.Stat(albumPath(sessionID, albumID)); !validStorageID(albumID) || err != nil {
+				ErrorResponseCode(w, http.StatusNotFound, "album_not_found", "Album not found")
+				return
+			}
+		}
+
+		hook, err := addWebhook(Webhook{URL: hookURL, UserID: sessionID, AlbumID: albumID, Events: events})
+		if err != nil {
+			ErrorResponseCode(w, http.StatusBadRequest, "webhook_failed", err.Error())
+			return
+		}
+		logger.InfoContext(r.Context(), "webhook registered", "hook_id", hook.ID, "album_id", albumID, "events", strings.Join(events, ","))
+		SuccessResponse(w, map[string]string{"id": hook.ID, "secret": hook.Secret})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deleteWebhookHandler удаляет вебхук пользователя
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	id := r.FormValue("id")
+	removed, err := removeWebhooks(func(hook Webhook) bool { return hook.ID == id && hook.UserID == sessionID })
+	if err != nil {
+		ErrorResponseCode(w, http.StatusInternalServerError, "webhook_failed", "Could not delete the webhook")
+		return
+	}
+	if !removed {
+		ErrorResponseCode(w, http.StatusNotFound, "webhook_not_found", "Webhook not found")
+		return
+	}
+	SuccessResponse(w, map[string]string{"message": "Webhook deleted successfully"})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver — тестовый получатель, отвечающий кодами из statuses по очереди
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	status := http.StatusOK
+	if n := len(rcv.requests); n < len(rcv.statuses) {
+		status = rcv.statuses[n]
+	}
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	w.WriteHeader(status)
+}
+
+func (rcv *webhookReceiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.requests)
+}
+
+// startTestDispatcher запускает диспетчер с мгновенными повторами
+func startTestDispatcher(t *testing.T) *WebhookDispatcher {
+	t.Helper()
+	d := NewWebhookDispatcher()
+	d.backoff = func(int) time.Duration { return time.Millisecond }
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	d.Start(ctx)
+	return d
+}
+
+// waitWebhookLog ждет, пока в журнале доставок появится n записей
+func waitWebhookLog(t *testing.T, n int) []WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		records, err := readWebhookLog(webhookLogLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) >= n {
+			// Записей не должно стать больше: даем лишним попыткам время проявиться
+			time.Sleep(50 * time.Millisecond)
+			if records, err = readWebhookLog(webhookLogLimit); err != nil {
+				t.Fatal(err)
+			}
+			return records
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d webhook log records, want %d", len(records), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDeliverySignsAndRetriesServerErrors(t *testing.T) {
+	withDataPath(t)
+	rcv := &webhookReceiver{statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	hook, err := addWebhook(Webhook{URL: server.URL, Events: []string{EventImageUploaded}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := startTestDispatcher(t)
+	d.Emit(WebhookEvent{Type: EventImageUploaded, UserID: "user", AlbumID: "album", Filename: "a.png"})
+	// Событие без подписки не доставляется
+	d.Emit(WebhookEvent{Type: EventAlbumDeleted, UserID: "user", AlbumID: "album"})
+
+	records := waitWebhookLog(t, 3)
+	if len(records) != 3 || rcv.count() != 3 {
+		t.Fatalf("got %d log records and %d requests, want 3 each", len(records), rcv.count())
+	}
+	// Журнал отдает новые записи первыми
+	for i, want := range []struct {
+		attempt, status int
+		result          string
+	}{{3, 200, "ok"}, {2, 500, "retry"}, {1, 503, "retry"}} {
+		got := records[i]
+		if got.Attempt != want.attempt || got.Status != want.status || got.Result != want.result {
+			t.Errorf("record %d = attempt %d, status %d, result %q; want %d, %d, %q",
+				i, got.Attempt, got.Status, got.Result, want.attempt, want.status, want.result)
+		}
+		if got.HookID != hook.ID || got.Event != EventImageUploaded || got.URL != server.URL {
+			t.Errorf("record %d = %+v, want hook %s, event %s", i, got, hook.ID, EventImageUploaded)
+		}
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	for i, req := range rcv.requests {
+		body := rcv.bodies[i]
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write([]byte(req.Header.Get("X-Screenguru-Timestamp") + "."))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.Header.Get("X-Screenguru-Signature") != want {
+			t.Errorf("request %d: signature %q, want %q", i, req.Header.Get("X-Screenguru-Signature"), want)
+		}
+		if req.Header.Get("X-Screenguru-Event") != EventImageUploaded {
+			t.Errorf("request %d: event header %q", i, req.Header.Get("X-Screenguru-Event"))
+		}
+
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.ID != records[0].EventID || event.Filename != "a.png" {
+			t.Errorf("request %d: body %+v, want event %s for a.png", i, event, records[0].EventID)
+		}
+		if req.Header.Get("X-Screenguru-Delivery") != event.ID {
+			t.Errorf("request %d: delivery header %q, want %q", i, req.Header.Get("X-Screenguru-Delivery"), event.ID)
+		}
+	}
+}
+
+func TestWebhookDeliveryDoesNotRetryClientErrors(t *testing.T) {
+	withDataPath(t)
+	rcv := &webhookReceiver{statuses: []int{http.StatusGone}}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	if _, err := addWebhook(Webhook{URL: server.URL, Events: []string{EventImageDeleted}}); err != nil {
+		t.Fatal(err)
+	}
+	d := startTestDispatcher(t)
+	d.Emit(WebhookEvent{Type: EventImageDeleted, UserID: "user", AlbumID: "album", Filename: "a.png"})
+
+	records := waitWebhookLog(t, 1)
+	if len(records) != 1 || rcv.count() != 1 {
+		t.Fatalf("got %d log records and %d requests, want 1 each", len(records), rcv.count())
+	}
+	if got := records[0]; got.Result != "failed" || got.Status != http.StatusGone || got.Error == "" {
+		t.Errorf("record = %+v, want failed with status 410 and an error", got)
+	}
+}
+
+func TestWebhookDeliveryGivesUpAfterMaxAttempts(t *testing.T) {
+	withDataPath(t)
+	previous := WebhookMaxAttempts
+	WebhookMaxAttempts = 2
+	t.Cleanup(func() { WebhookMaxAttempts = previous })
+
+	rcv := &webhookReceiver{statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	if _, err := addWebhook(Webhook{URL: server.URL, Events: []string{EventImageExpired}}); err != nil {
+		t.Fatal(err)
+	}
+	d := startTestDispatcher(t)
+	d.Emit(WebhookEvent{Type: EventImageExpired, UserID: "user", AlbumID: "album", Filename: "a.png"})
+
+	records := waitWebhookLog(t, 2)
+	if len(records) != 2 || rcv.count() != 2 {
+		t.Fatalf("got %d log records and %d requests, want 2 each", len(records), rcv.count())
+	}
+	if records[0].Result != "failed" || records[1].Result != "retry" {
+		t.Errorf("results = %q, %q; want failed, retry", records[0].Result, records[1].Result)
+	}
+}
+
+func TestUserWebhookCannotReachPrivateAddress(t *testing.T) {
+	withDataPath(t)
+	previous := WebhookAllowPrivate
+	WebhookAllowPrivate = false
+	t.Cleanup(func() { WebhookAllowPrivate = previous })
+
+	rcv := &webhookReceiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	if _, err := addWebhook(Webhook{URL: server.URL, UserID: "user", Events: []string{EventImageUploaded}}); err != nil {
+		t.Fatal(err)
+	}
+	d := startTestDispatcher(t)
+	d.Emit(WebhookEvent{Type: EventImageUploaded, UserID: "user", AlbumID: "album", Filename: "a.png"})
+
+	records := waitWebhookLog(t, 1)
+	if len(records) != 1 || rcv.count() != 0 {
+		t.Fatalf("got %d log records and %d requests, want 1 record and no requests", len(records), rcv.count())
+	}
+	if records[0].Result != "failed" {
+		t.Errorf("result = %q, want failed without retry", records[0].Result)
+	}
+}
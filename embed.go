@@ -0,0 +1,9 @@
+// Package screenguru встраивает в бинарник файлы из корня репозитория
+package screenguru
+
+import _ "embed"
+
+// Changelog содержит changelog.md на момент сборки
+//
+//go:embed changelog.md
+var Changelog string